@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ENV_PREFIX = "BOTLNEK_"
+)
+
+const usageText = `Usage: %[1]s [flags] MODE [flags] [ARGS]
+
+Registers sources with a domain's aggregates, each aggregate key
+computed by the -aggregate rule, or by the domain's key rule if no
+-aggregate is given.  Modes:
+
+  once       register one source, given by -key and -attr
+  clock      register a source keyed by the time truncated to -every,
+             whenever that or its aggregate changes
+  watch DIR  register each file in the directory as it appears:
+             keys path and sha256, attrs size and mtime
+  stdin      register each line of JSON on stdin, like
+             {"Keys": {...}, "Attrs": {...}, "Time": "RFC 3339 time"}
+             with an optional "Aggregate" to override the rule
+
+The aggregate rule is "window=DURATION", keying each source by its time
+truncated to the duration, or a template like 'part-{{truncate "1m" .Time}}'
+over the source's .Keys, .Attrs, and .Time.  A source's time is when it's
+published, or a file's modification time.
+
+Flags may also be given by %[2]s* environment variables:
+`
+
+type publishConfig struct {
+	server      string
+	apiToken    string
+	publisher   string
+	domain      string
+	sourceToken string
+	rule        *keyRule
+	keys        kvFlag
+	attrs       kvFlag
+	// Clock mode
+	every time.Duration
+	// Watch mode
+	interval time.Duration
+	settle   time.Duration
+	pattern  string
+	once     bool
+	// Consecutive failures tolerated before giving up
+	maxFailures int
+}
+
+// Publishes sources, keeping track of consecutive failures.
+type publisher struct {
+	config   *publishConfig
+	client   *client.Client
+	stdout   io.Writer
+	stderr   io.Writer
+	failures int
+}
+
+// Given once too many publishes in a row have failed.
+var errTooManyFailures = errors.New("Too many consecutive failures")
+
+// Registers the source with the aggregate its rule gives, unless the
+// aggregate is given, telling whether it succeeded.  Failures are
+// reported, and only given as an error once too many happen in a row.
+func (p *publisher) publish(ctx context.Context, info sourceInfo, aggregate model.AggregateKey) (bool, error) {
+	err := p.register(ctx, info, aggregate)
+	if err == nil {
+		p.failures = 0
+		return true, nil
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	return false, p.fail(err)
+}
+
+// Reports the failure, giving an error if too many happened in a row.
+func (p *publisher) fail(err error) error {
+	p.failures++
+	fmt.Fprintf(p.stderr, "Failed to register source: %s\n", err)
+	if p.failures >= p.config.maxFailures {
+		return errTooManyFailures
+	}
+	return nil
+}
+
+// Without a rule, the server derives the aggregate keys by the
+// domain's rule, which may register the source with several.
+func (p *publisher) register(ctx context.Context, info sourceInfo, aggregate model.AggregateKey) error {
+	if aggregate == "" && p.config.rule != nil {
+		var err error
+		if aggregate, err = p.config.rule.key(info); err != nil {
+			return err
+		}
+	}
+	domain := model.DomainKey(p.config.domain)
+	source := model.Source{Keys: info.Keys, Attrs: info.Attrs}
+	var receipts []*model.SourceReceipt
+	if aggregate == "" {
+		var err error
+		if receipts, err = p.client.AppendDomainSource(ctx, domain, p.config.sourceToken, source); err != nil {
+			return err
+		}
+	} else {
+		receipt, err := p.client.AppendSource(ctx, domain, aggregate, p.config.sourceToken, source)
+		if err != nil {
+			return err
+		}
+		receipts = append(receipts, receipt)
+	}
+	for _, receipt := range receipts {
+		status := "registered"
+		if !receipt.New {
+			status = "already registered"
+		}
+		fmt.Fprintf(p.stdout, "Domain %q aggregate %q token %q keys %s: %s at version %d\n",
+			p.config.domain, receipt.Aggregate, p.config.sourceToken, kvFlag(info.Keys), status, receipt.VersionIdx+1)
+	}
+	return nil
+}
+
+// The source's keys and attributes, with the ones given by flags.
+func (c *publishConfig) sourceInfo(keys, attrs map[string]string, t time.Time) sourceInfo {
+	info := sourceInfo{Keys: make(map[string]string), Attrs: make(map[string]string), Time: t}
+	for k, v := range c.keys {
+		info.Keys[k] = v
+	}
+	for k, v := range c.attrs {
+		info.Attrs[k] = v
+	}
+	for k, v := range keys {
+		info.Keys[k] = v
+	}
+	for k, v := range attrs {
+		info.Attrs[k] = v
+	}
+	return info
+}
+
+type mode struct {
+	// Positional arguments, for usage
+	args []string
+	run  func(ctx context.Context, p *publisher, args []string, stdin io.Reader) error
+}
+
+var modes = map[string]mode{
+	"once":  {nil, runOnce},
+	"clock": {nil, runClock},
+	"watch": {[]string{"DIR"}, runWatch},
+	"stdin": {nil, runStdin},
+}
+
+func run(ctx context.Context, name string, args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) int {
+	config := &publishConfig{keys: make(kvFlag), attrs: make(kvFlag)}
+	var rule string
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&config.server, "server", "localhost:8080", "address of the botlnek server")
+	fs.StringVar(&config.apiToken, "token", "", "API token, if the server requires one")
+	fs.StringVar(&config.publisher, "publisher", "botlnek-publish", "publisher to record with the sources")
+	fs.StringVar(&config.domain, "domain", "", "domain to register sources with (required)")
+	fs.StringVar(&config.sourceToken, "source-token", "", "token to register sources under (required)")
+	fs.StringVar(&rule, "aggregate", "", "rule giving each source's aggregate key; the domain's key rule if not given")
+	fs.Var(config.keys, "key", "source key as KEY=VALUE, for every source; repeatable")
+	fs.Var(config.attrs, "attr", "source attribute as KEY=VALUE, for every source; repeatable")
+	fs.DurationVar(&config.every, "every", time.Minute, "clock: how often to register a source keyed by the time")
+	fs.DurationVar(&config.interval, "interval", 2*time.Second, "watch: how often to scan the directory")
+	fs.DurationVar(&config.settle, "settle", 2*time.Second, "watch: how long a file must go unmodified before it's registered")
+	fs.StringVar(&config.pattern, "pattern", "*", "watch: only files whose names match this glob pattern")
+	fs.BoolVar(&config.once, "once", false, "watch: scan the directory once, and exit")
+	fs.IntVar(&config.maxFailures, "max-failures", 3, "consecutive failures tolerated before exiting")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, usageText, name, ENV_PREFIX)
+		fs.PrintDefaults()
+	}
+	if err := setFromEnv(fs, getenv); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return 2
+	}
+	// Flags may come before and after the mode.
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	m, ok := modes[fs.Arg(0)]
+	if !ok {
+		if fs.NArg() > 0 {
+			fmt.Fprintf(stderr, "%s: unknown mode %q\n", name, fs.Arg(0))
+		}
+		fs.Usage()
+		return 2
+	}
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	problems := make([]string, 0)
+	if config.domain == "" {
+		problems = append(problems, "-domain is required")
+	}
+	if config.sourceToken == "" {
+		problems = append(problems, "-source-token is required")
+	}
+	if rule != "" {
+		parsed, err := parseKeyRule(rule)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		config.rule = parsed
+	}
+	if config.every <= 0 || config.interval <= 0 || config.settle < 0 || config.maxFailures <= 0 {
+		problems = append(problems, "-every, -interval, and -max-failures must be positive, and -settle not negative")
+	}
+	if fs.NArg() != len(m.args) {
+		problems = append(problems, fmt.Sprintf("expected arguments %q; got %q", m.args, fs.Args()))
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(stderr, "%s: %s\n", name, strings.Join(problems, "; "))
+		return 2
+	}
+
+	c := client.New(config.server)
+	c.Token = config.apiToken
+	c.Publisher = config.publisher
+	c.UserAgent = "botlnek-publish"
+	p := &publisher{config: config, client: c, stdout: stdout, stderr: stderr}
+	err := m.run(ctx, p, fs.Args(), stdin)
+	if err == nil || (err == context.Canceled && ctx.Err() != nil) {
+		return 0
+	}
+	fmt.Fprintf(stderr, "%s: %s\n", name, err)
+	return 1
+}
+
+// Sets each flag given by a BOTLNEK_* environment variable (with
+// dashes as underscores), so the command line can override it.
+func setFromEnv(fs *flag.FlagSet, getenv func(string) string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := ENV_PREFIX + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value := getenv(name); value != "" && err == nil {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("Invalid %s: %s", name, e)
+			}
+		}
+	})
+	return err
+}
+
+// A repeatable KEY=VALUE flag.
+type kvFlag map[string]string
+
+func (f kvFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f kvFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return errors.New("expected KEY=VALUE")
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	os.Exit(run(ctx, "botlnek-publish", os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"github.com/ethanrowe/botlnek/pkg/rest"
+	"github.com/ethanrowe/botlnek/pkg/store/inmemory"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer() (string, func()) {
+	store := inmemory.NewInMemoryStore()
+	app := &rest.RestApplication{
+		DomainWriter:    store,
+		DomainReader:    store,
+		AggregateWriter: store,
+		AggregateReader: store,
+	}
+	server := httptest.NewServer(app.Handler())
+	return server.URL, func() {
+		app.Shutdown()
+		server.Close()
+		store.Stop()
+	}
+}
+
+type result struct {
+	status         int
+	stdout, stderr string
+}
+
+func publish(server, stdin string, args ...string) result {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-server", server, "-domain", "d", "-source-token", "t"}, args...)
+	status := run(context.Background(), "botlnek-publish", args, func(string) string { return "" }, strings.NewReader(stdin), &stdout, &stderr)
+	return result{status, stdout.String(), stderr.String()}
+}
+
+// The keys of the aggregate's sources under token "t".
+func sourceKeys(t *testing.T, server string, aggregate model.AggregateKey) []map[string]string {
+	t.Helper()
+	aggr, err := client.New(server).GetAggregate(context.Background(), "d", aggregate)
+	if err != nil || aggr == nil {
+		t.Fatalf("Failed to get aggregate %s: %v", aggregate, err)
+	}
+	keys := make([]map[string]string, 0)
+	for _, source := range aggr.Sources["t"] {
+		keys = append(keys, source.Source.Keys)
+	}
+	return keys
+}
+
+func TestKeyRule(t *testing.T) {
+	info := sourceInfo{
+		Keys: map[string]string{"region": "eu"},
+		Time: time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC),
+	}
+	for spec, expected := range map[string]model.AggregateKey{
+		"window=1h":                    "2019-06-01T12:00:00Z",
+		`part-{{truncate "1m" .Time}}`: "part-2019-06-01T12:34:00Z",
+		`{{.Keys.region}}-{{format "20060102" .Time}}`: "eu-20190601",
+	} {
+		rule, err := parseKeyRule(spec)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %s", spec, err)
+			continue
+		}
+		if key, err := rule.key(info); key != expected || err != nil {
+			t.Errorf("Rule %q: expected %q; got %q, %v", spec, expected, key, err)
+		}
+	}
+	for _, spec := range []string{"window=soon", "{{.Keys", ""} {
+		if rule, err := parseKeyRule(spec); err == nil {
+			if _, err := rule.key(info); err == nil {
+				t.Errorf("Expected rule %q to fail", spec)
+			}
+		}
+	}
+	rule, _ := parseKeyRule("{{.Keys.missing}}")
+	if _, err := rule.key(info); err == nil {
+		t.Errorf("Expected a missing key to fail")
+	}
+}
+
+func TestOnceAndStdin(t *testing.T) {
+	server, stop := testServer()
+	defer stop()
+
+	r := publish(server, "", "-aggregate", "a", "once", "-key", "k=1", "-attr", "x=y")
+	if r.status != 0 || !strings.Contains(r.stdout, `aggregate "a"`) || !strings.Contains(r.stdout, "registered at version 1") {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+	r = publish(server, "", "-aggregate", "a", "once", "-key", "k=1")
+	if r.status != 0 || !strings.Contains(r.stdout, "already registered") {
+		t.Errorf("Expected a duplicate to be reported; got %+v", r)
+	}
+
+	stdin := strings.Join([]string{
+		`{"Keys": {"k": "2"}, "Time": "2019-06-01T12:34:56Z"}`,
+		``,
+		`{"Keys": {"k": "3"}, "Aggregate": "a"}`,
+		`nonsense`,
+		`{"Keys": {"k": "4"}, "Time": "2019-06-01T12:59:00Z"}`,
+	}, "\n")
+	r = publish(server, stdin, "-aggregate", "window=1h", "stdin")
+	if r.status != 0 || !strings.Contains(r.stderr, "line 4") {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+	if keys := sourceKeys(t, server, "2019-06-01T12:00:00Z"); len(keys) != 2 || keys[0]["k"] != "2" || keys[1]["k"] != "4" {
+		t.Errorf("Unexpected sources %v", keys)
+	}
+	if keys := sourceKeys(t, server, "a"); len(keys) != 2 || keys[1]["k"] != "3" {
+		t.Errorf("Unexpected sources %v", keys)
+	}
+
+	// Too many failures in a row give up.
+	r = publish(server, "x\ny\nz\n", "-aggregate", "a", "-max-failures", "2", "stdin")
+	if r.status != 1 || !strings.Contains(r.stderr, "Too many consecutive failures") {
+		t.Errorf("Expected failure; got %+v", r)
+	}
+	// Without -aggregate, the domain's key rule applies.
+	client.New(server).CreateDomain(context.Background(), model.Domain{Key: "ruled", KeyRule: model.KeyRule{TimeKey: "asof", Truncate: "24h", Layout: "20060102"}})
+	r = publish(server, "", "-domain", "ruled", "once", "-key", "asof=2019-07-10T11:28:10Z")
+	if r.status != 0 || !strings.Contains(r.stdout, `aggregate "20190710"`) {
+		t.Errorf("Expected the domain's key rule to apply; got %+v", r)
+	}
+	if r = publish(server, "", "-aggregate", "{{", "once"); r.status != 2 {
+		t.Errorf("Expected a usage error for a bad rule; got %+v", r)
+	}
+	if r = publish(server, "", "-aggregate", "a", "watch"); r.status != 2 {
+		t.Errorf("Expected a usage error without a directory; got %+v", r)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server, stop := testServer()
+	defer stop()
+	dir, err := ioutil.TempDir("", "publish")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	mtime := time.Date(2019, 6, 1, 12, 34, 56, 0, time.UTC)
+	for _, name := range []string{"a.csv", "sub/b.csv", "c.tmp"} {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(name), 0644)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	args := []string{"-aggregate", `day-{{format "2006-01-02" .Time}}`, "watch", "-pattern", "*.csv", "-once", dir}
+	if r := publish(server, "", args...); r.status != 0 || strings.Count(r.stdout, "registered at") != 2 {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+	keys := sourceKeys(t, server, "day-2019-06-01")
+	if len(keys) != 2 || keys[0]["path"] != "a.csv" || keys[1]["path"] != "sub/b.csv" || len(keys[0]["sha256"]) != 64 {
+		t.Fatalf("Unexpected sources %v", keys)
+	}
+
+	// Recently modified files are left to settle.
+	ioutil.WriteFile(filepath.Join(dir, "d.csv"), []byte("d"), 0644)
+	if r := publish(server, "", append([]string{"-settle", "1h"}, args...)...); r.status != 0 || strings.Contains(r.stdout, "d.csv") {
+		t.Errorf("Expected d.csv to be left; got %+v", r)
+	}
+
+	// Watching picks up new files as they appear.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan int)
+	var stdout, stderr bytes.Buffer
+	go func() {
+		done <- run(ctx, "botlnek-publish", []string{"-server", server, "-domain", "d", "-source-token", "t",
+			"-aggregate", "new", "-interval", "10ms", "-settle", "0s", "watch", "-pattern", "e.csv", dir},
+			func(string) string { return "" }, strings.NewReader(""), &stdout, &stderr)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ioutil.WriteFile(filepath.Join(dir, "e.csv"), []byte("e"), 0644)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		aggr, _ := client.New(server).GetAggregate(context.Background(), "d", "new")
+		if aggr != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for e.csv")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if status := <-done; status != 0 {
+		t.Errorf("Expected status 0 on cancellation; got %d (stderr %q)", status, stderr.String())
+	}
+}
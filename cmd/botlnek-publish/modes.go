@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Registers the source given by the flags, with the present time.
+func runOnce(ctx context.Context, p *publisher, args []string, stdin io.Reader) error {
+	return p.register(ctx, p.config.sourceInfo(nil, nil, time.Now()), "")
+}
+
+// Registers a source keyed by the present time truncated to -every,
+// each time that or the aggregate the rule gives for the present time
+// changes.  The clock is checked every second, or -every if sooner.
+// Without a rule, the domain's rule is left to pick the aggregate.
+func runClock(ctx context.Context, p *publisher, args []string, stdin io.Reader) error {
+	check := time.Second
+	if p.config.every < check {
+		check = p.config.every
+	}
+	var lastKey string
+	var lastAggregate model.AggregateKey
+	for {
+		now := time.Now()
+		key := now.Truncate(p.config.every).UTC().Format(time.RFC3339)
+		info := p.config.sourceInfo(map[string]string{"time": key}, nil, now)
+		var aggregate model.AggregateKey
+		if p.config.rule != nil {
+			var err error
+			if aggregate, err = p.config.rule.key(info); err != nil {
+				return err
+			}
+		}
+		if key != lastKey || aggregate != lastAggregate {
+			ok, err := p.publish(ctx, info, aggregate)
+			if err != nil {
+				return err
+			}
+			if ok {
+				lastKey, lastAggregate = key, aggregate
+			}
+		}
+		select {
+		case <-time.After(check):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// What was last seen of a file.
+type fileState struct {
+	size  int64
+	mtime time.Time
+}
+
+// Registers each file under the directory, and again whenever it
+// changes, until the context ends (or after one scan, with -once).
+func runWatch(ctx context.Context, p *publisher, args []string, stdin io.Reader) error {
+	dir := args[0]
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	seen := make(map[string]fileState)
+	for {
+		if err := scan(ctx, p, dir, seen); err != nil {
+			return err
+		}
+		if p.config.once {
+			return nil
+		}
+		select {
+		case <-time.After(p.config.interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Registers the files that are new or changed since they were last
+// seen.  Files modified within the -settle duration are left for a
+// later scan, as they may still be being written.
+func scan(ctx context.Context, p *publisher, dir string, seen map[string]fileState) error {
+	found := make(map[string]os.FileInfo)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Files may well vanish between listing and reading.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if matched, _ := filepath.Match(p.config.pattern, info.Name()); matched {
+			found[path] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(found))
+	for path := range found {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	settled := time.Now().Add(-p.config.settle)
+	for _, path := range paths {
+		info := found[path]
+		state := fileState{info.Size(), info.ModTime()}
+		last, ok := seen[path]
+		if (ok && last.size == state.size && last.mtime.Equal(state.mtime)) || state.mtime.After(settled) {
+			continue
+		}
+		sum, err := checksum(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		keys := map[string]string{"path": filepath.ToSlash(rel), "sha256": sum}
+		attrs := map[string]string{
+			"size":  strconv.FormatInt(state.size, 10),
+			"mtime": state.mtime.UTC().Format(time.RFC3339Nano),
+		}
+		ok, err = p.publish(ctx, p.config.sourceInfo(keys, attrs, state.mtime), "")
+		if err != nil {
+			return err
+		}
+		// Failed files are tried again on the next scan.
+		if ok {
+			seen[path] = state
+		}
+	}
+	return nil
+}
+
+func checksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A source to register, as a line of JSON.
+type sourceLine struct {
+	Keys  map[string]string
+	Attrs map[string]string
+	// Overrides the aggregate rule, if given
+	Aggregate model.AggregateKey
+	// The present time, if not given
+	Time *time.Time
+}
+
+// Registers the source on each line of stdin, until it ends.
+func runStdin(ctx context.Context, p *publisher, args []string, stdin io.Reader) error {
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var source sourceLine
+		if err := json.Unmarshal(line, &source); err != nil {
+			if err := p.fail(fmt.Errorf("Invalid source on line %d: %s", lineNum, err)); err != nil {
+				return err
+			}
+			continue
+		}
+		t := time.Now()
+		if source.Time != nil {
+			t = *source.Time
+		}
+		if _, err := p.publish(ctx, p.config.sourceInfo(source.Keys, source.Attrs, t), source.Aggregate); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// What an aggregate key is computed from.
+type sourceInfo struct {
+	Keys  map[string]string
+	Attrs map[string]string
+	// When the source came about: a file's modification time, or
+	// the time of publishing, for instance
+	Time time.Time
+}
+
+// Computes the aggregate key for a source.
+type keyRule struct {
+	tmpl *template.Template
+}
+
+const WINDOW_PREFIX = "window="
+
+// A rule is either "window=DURATION", which keys each source by its
+// time truncated to the duration, or a text/template over the source's
+// Keys, Attrs, and Time, with the functions of a domain's key rule:
+//
+//	part-{{truncate "1m" .Time}}
+//	{{.Keys.region}}-{{format "2006-01-02" .Time}}
+func parseKeyRule(spec string) (*keyRule, error) {
+	if strings.HasPrefix(spec, WINDOW_PREFIX) {
+		window, err := time.ParseDuration(strings.TrimPrefix(spec, WINDOW_PREFIX))
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("Invalid window in aggregate rule %q", spec)
+		}
+		spec = fmt.Sprintf("{{truncate %q .Time}}", window.String())
+	}
+	tmpl, err := template.New("aggregate").Option("missingkey=error").Funcs(model.KeyRuleFuncs).Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid aggregate rule: %s", err)
+	}
+	return &keyRule{tmpl}, nil
+}
+
+func (r *keyRule) key(info sourceInfo) (model.AggregateKey, error) {
+	var buf bytes.Buffer
+	if err := r.tmpl.Execute(&buf, info); err != nil {
+		return "", fmt.Errorf("Cannot compute aggregate key: %s", err)
+	}
+	if buf.Len() == 0 {
+		return "", fmt.Errorf("Aggregate rule gives an empty key")
+	}
+	return model.AggregateKey(buf.String()), nil
+}
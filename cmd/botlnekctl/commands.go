@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/filter"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"github.com/ethanrowe/botlnek/pkg/util"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+func domainCreate(e *env, fs *flag.FlagSet, args []string) error {
+	var rule model.KeyRule
+	fs.StringVar(&rule.TimeKey, "time-key", "", "key rule: source key holding the time that gives the aggregate key")
+	fs.StringVar(&rule.Truncate, "truncate", "", "key rule: duration to truncate the time to, like 24h")
+	fs.StringVar(&rule.Layout, "layout", "", "key rule: layout of the aggregate key, like 20060102")
+	fs.StringVar(&rule.Template, "template", "", "key rule: template over the source's .Keys and .Attrs giving the aggregate key")
+	var mirrors mirrorFlag
+	fs.Var(&mirrors, "mirror", "mirror the sources of another domain as DOMAIN, or DOMAIN:TOKEN,... for only some tokens, into the aggregates of the same keys; repeatable")
+	args, err := parse(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	attrs := make(kvFlag)
+	for _, arg := range args[1:] {
+		if err := attrs.Set(arg); err != nil {
+			return usagef("Invalid attribute %q: %s", arg, err)
+		}
+	}
+	domain, created, err := e.client.CreateDomain(e.ctx, model.Domain{
+		Key:     model.DomainKey(args[0]),
+		Attrs:   util.NewStringKVPairs(attrs),
+		KeyRule: rule,
+		Mirrors: mirrors,
+	})
+	if err != nil {
+		return err
+	}
+	if !created {
+		fmt.Fprintf(e.stderr, "Domain %q was already registered\n", domain.Key)
+	}
+	return e.printJson(domain)
+}
+
+func domainGet(e *env, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	domain, err := e.client.GetDomain(e.ctx, model.DomainKey(args[0]))
+	if err != nil {
+		return err
+	}
+	if domain == nil {
+		return fmt.Errorf("Cannot find domain %q", args[0])
+	}
+	return e.printJson(domain)
+}
+
+func domainList(e *env, fs *flag.FlagSet, args []string) error {
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	keys, err := e.client.ListDomains(e.ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Fprintln(e.stdout, key)
+	}
+	return nil
+}
+
+func sourceAdd(e *env, fs *flag.FlagSet, args []string) error {
+	keys, attrs := make(kvFlag), make(kvFlag)
+	var into listFlag
+	fs.Var(keys, "key", "source key as KEY=VALUE; repeatable")
+	fs.Var(attrs, "attr", "source attribute as KEY=VALUE; repeatable")
+	fs.Var(&into, "into", "without AGGREGATE, an aggregate to append to rather than those of the domain's key rule; repeatable")
+	version := fs.Int("version", model.AnyVersion, "append only if the aggregate is at this version")
+	args, err := parse(fs, args, 2, 3)
+	if err != nil {
+		return err
+	}
+	if len(args) == 2 && *version != model.AnyVersion {
+		return usagef("-version needs an AGGREGATE")
+	}
+	if len(args) == 3 && len(into) > 0 {
+		return usagef("-into can't be given with an AGGREGATE")
+	}
+
+	source := model.Source{Keys: keys, Attrs: attrs}
+	if len(keys) == 0 && len(attrs) == 0 {
+		decoder := json.NewDecoder(e.stdin)
+		decoder.DisallowUnknownFields()
+		source = model.Source{}
+		if err := decoder.Decode(&source); err != nil {
+			return fmt.Errorf("Invalid source on stdin: %s", err)
+		}
+	}
+	if len(args) == 3 {
+		receipt, err := e.client.AppendSourceAtVersion(e.ctx, model.DomainKey(args[0]), model.AggregateKey(args[1]), args[2], source, *version)
+		if err != nil {
+			return err
+		}
+		reportDuplicate(e, receipt)
+		return e.printJson(receipt)
+	}
+
+	aggregates := make([]model.AggregateKey, len(into))
+	for i, aggregate := range into {
+		aggregates[i] = model.AggregateKey(aggregate)
+	}
+	receipts, err := e.client.AppendDomainSource(e.ctx, model.DomainKey(args[0]), args[1], source, aggregates...)
+	if err != nil {
+		return err
+	}
+	for _, receipt := range receipts {
+		reportDuplicate(e, receipt)
+	}
+	return e.printJson(receipts)
+}
+
+func reportDuplicate(e *env, receipt *model.SourceReceipt) {
+	if !receipt.New {
+		fmt.Fprintf(e.stderr, "Source was already registered with aggregate %q at version %d\n", receipt.Aggregate, receipt.VersionIdx+1)
+	}
+}
+
+// Reads an aggregate that must exist.
+func (e *env) aggregate(domain, aggregate string, filter model.ProvenanceFilter, includeProvenance bool) (*model.Aggregate, error) {
+	aggr, err := e.client.GetAggregateView(e.ctx, model.DomainKey(domain), model.AggregateKey(aggregate), filter, includeProvenance)
+	if err == nil && aggr == nil {
+		err = fmt.Errorf("Cannot find domain %q aggregate %q", domain, aggregate)
+	}
+	return aggr, err
+}
+
+func aggregateGet(e *env, fs *flag.FlagSet, args []string) error {
+	provenance := fs.Bool("provenance", false, "include each source's provenance")
+	var filter model.ProvenanceFilter
+	fs.StringVar(&filter.Principal, "principal", "", "only sources appended by this principal")
+	fs.StringVar(&filter.Publisher, "publisher", "", "only sources appended by this publisher")
+	args, err := parse(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	aggr, err := e.aggregate(args[0], args[1], filter, *provenance)
+	if err != nil {
+		return err
+	}
+	return e.printJson(aggr)
+}
+
+func sourceSearch(e *env, fs *flag.FlagSet, args []string) error {
+	query := model.SourceQuery{Keys: make(kvFlag), Attrs: make(kvFlag)}
+	fs.Var(kvFlag(query.Keys), "key", "source key as KEY=VALUE; repeatable")
+	fs.Var(kvFlag(query.Attrs), "attr", "source attribute as KEY=VALUE; repeatable")
+	fs.StringVar(&query.Token, "token", "", "only sources registered under this token")
+	fs.StringVar(&query.Filter, "filter", "", "only sources of aggregates meeting this filter expression")
+	asJson := fs.Bool("json", false, "print JSON")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := query.Validate(); err != nil {
+		return usagef("At least one -key or -attr is required")
+	}
+	if err := checkFilter(query.Filter); err != nil {
+		return err
+	}
+	matches := make([]model.SourceMatch, 0)
+	var after model.ChangeSeq
+	for {
+		page, next, err := e.client.SearchSources(e.ctx, model.DomainKey(args[0]), query, true, after, 0)
+		if err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			break
+		}
+		matches = append(matches, page...)
+		after = next
+	}
+	if *asJson {
+		return e.printJson(matches)
+	}
+	for _, m := range matches {
+		fmt.Fprintf(e.stdout, "%s  version %d  %s\n", m.Aggregate, m.VersionIdx+1, describeSource(tokenSource{m.Token, m.SourceLog}))
+	}
+	return nil
+}
+
+func aggregateList(e *env, fs *flag.FlagSet, args []string) error {
+	expr := fs.String("filter", "", "only aggregates meeting this filter expression")
+	args, err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if err := checkFilter(*expr); err != nil {
+		return err
+	}
+	keys, err := listAggregates(e, model.DomainKey(args[0]), *expr)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Fprintln(e.stdout, key)
+	}
+	return nil
+}
+
+// Lists the domain's aggregates meeting the filter, if given, in order.
+func listAggregates(e *env, domain model.DomainKey, expr string) ([]model.AggregateKey, error) {
+	keys := make([]model.AggregateKey, 0)
+	var after model.AggregateKey
+	for {
+		page, next, err := e.client.ListAggregates(e.ctx, domain, expr, after, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			break
+		}
+		keys = append(keys, page...)
+		after = next
+	}
+	return keys, nil
+}
+
+// Gives a usage error if the filter expression is given but invalid.
+func checkFilter(expr string) error {
+	if expr == "" {
+		return nil
+	}
+	if _, err := filter.Parse(expr); err != nil {
+		return usagef("%s", err)
+	}
+	return nil
+}
+
+// A source as registered under its token.
+type tokenSource struct {
+	Token string
+	model.SourceLog
+}
+
+// A version of an aggregate, and the sources it added.
+type version struct {
+	Version    int
+	ClockEntry model.ClockEntry
+	Sources    []tokenSource
+}
+
+// The aggregate's versions from the given count up to (not
+// including) the other.
+func versions(aggr *model.Aggregate, from, to int) []version {
+	result := make([]version, 0, to-from)
+	for i := from; i < to; i++ {
+		result = append(result, version{Version: i + 1, ClockEntry: aggr.Log[i], Sources: make([]tokenSource, 0)})
+	}
+	tokens := make([]string, 0, len(aggr.Sources))
+	for token := range aggr.Sources {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		for _, log := range aggr.Sources[token] {
+			if log.VersionIdx >= from && log.VersionIdx < to {
+				v := &result[log.VersionIdx-from]
+				v.Sources = append(v.Sources, tokenSource{token, log})
+			}
+		}
+	}
+	return result
+}
+
+func (e *env) printVersions(versions []version, asJson bool) error {
+	if asJson {
+		return e.printJson(versions)
+	}
+	for _, v := range versions {
+		fmt.Fprintf(e.stdout, "version %d  %s  change %s\n", v.Version, v.ClockEntry.Approximate.UTC().Format(time.RFC3339), v.ClockEntry.ChangeSeq)
+		for _, s := range v.Sources {
+			fmt.Fprintf(e.stdout, "  + %s\n", describeSource(s))
+		}
+	}
+	return nil
+}
+
+func describeSource(s tokenSource) string {
+	text := fmt.Sprintf("%s  keys: %s  attrs: %s", s.Token, kvFlag(s.Source.Keys), kvFlag(s.Source.Attrs))
+	if s.Provenance != nil && s.Provenance.Principal != "" {
+		text += "  by " + s.Provenance.Principal
+	}
+	return text
+}
+
+func aggregateHistory(e *env, fs *flag.FlagSet, args []string) error {
+	asJson := fs.Bool("json", false, "print JSON")
+	args, err := parse(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	aggr, err := e.aggregate(args[0], args[1], model.ProvenanceFilter{}, true)
+	if err != nil {
+		return err
+	}
+	return e.printVersions(versions(aggr, 0, len(aggr.Log)), *asJson)
+}
+
+// Versions count from 1, so "diff 0 2" gives what the first two
+// versions added, and "diff 2" what was added after version 2.
+func aggregateDiff(e *env, fs *flag.FlagSet, args []string) error {
+	asJson := fs.Bool("json", false, "print JSON")
+	args, err := parse(fs, args, 3, 4)
+	if err != nil {
+		return err
+	}
+	aggr, err := e.aggregate(args[0], args[1], model.ProvenanceFilter{}, true)
+	if err != nil {
+		return err
+	}
+	from, err := strconv.Atoi(args[2])
+	if err != nil {
+		return usagef("Invalid version %q", args[2])
+	}
+	to := len(aggr.Log)
+	if len(args) > 3 {
+		if to, err = strconv.Atoi(args[3]); err != nil {
+			return usagef("Invalid version %q", args[3])
+		}
+	}
+	if from < 0 || from > to || to > len(aggr.Log) {
+		return fmt.Errorf("Versions must be in order, between 0 and %d", len(aggr.Log))
+	}
+	return e.printVersions(versions(aggr, from, to), *asJson)
+}
+
+func watch(e *env, fs *flag.FlagSet, args []string) error {
+	var domains listFlag
+	fs.Var(&domains, "domain", "only this domain; repeatable")
+	pattern := fs.String("aggregate", "", "only aggregates whose keys match this glob pattern")
+	expr := fs.String("filter", "", "only aggregates meeting this filter expression")
+	asJson := fs.Bool("json", false, "print each message as a line of JSON")
+	count := fs.Int("count", 0, "exit after this many messages (0 for no limit)")
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if _, err := path.Match(*pattern, ""); err != nil {
+		return usagef("Invalid pattern %q", *pattern)
+	}
+	if err := checkFilter(*expr); err != nil {
+		return err
+	}
+
+	opts := client.SubscribeOptions{Filter: *expr}
+	for _, domain := range domains {
+		opts.Domains = append(opts.Domains, model.DomainKey(domain))
+	}
+	sub := e.client.Subscribe(e.ctx, opts)
+	defer sub.Close()
+	seen := 0
+	for sub.Next() {
+		message := sub.Message()
+		if *pattern != "" {
+			if ok, _ := path.Match(*pattern, string(message.Aggregate.Key)); !ok {
+				continue
+			}
+		}
+		if *asJson {
+			if err := json.NewEncoder(e.stdout).Encode(message); err != nil {
+				return err
+			}
+		} else {
+			printMessage(e, message)
+		}
+		seen++
+		if *count > 0 && seen >= *count {
+			return nil
+		}
+	}
+	if e.ctx.Err() != nil {
+		// Interrupted
+		return nil
+	}
+	return sub.Err()
+}
+
+// Describes the message's aggregate by its latest version.
+func printMessage(e *env, message model.AggregateMessage) {
+	aggr := message.Aggregate
+	if len(aggr.Log) == 0 {
+		fmt.Fprintf(e.stdout, "%s/%s  (no versions)\n", message.DomainKey, aggr.Key)
+		return
+	}
+	latest := versions(&aggr, len(aggr.Log)-1, len(aggr.Log))[0]
+	fmt.Fprintf(e.stdout, "%s  %s/%s  version %d\n", latest.ClockEntry.Approximate.UTC().Format(time.RFC3339), message.DomainKey, aggr.Key, latest.Version)
+	for _, s := range latest.Sources {
+		fmt.Fprintf(e.stdout, "  + %s\n", describeSource(s))
+	}
+}
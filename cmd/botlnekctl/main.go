@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ENV_PREFIX = "BOTLNEK_"
+)
+
+// What a command has to work with.
+type env struct {
+	ctx    context.Context
+	client *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+type command struct {
+	// One or two words, like "domain create"
+	name string
+	// The positional arguments, for usage
+	args    string
+	summary string
+	// Whether the command runs until interrupted, rather than
+	// within the timeout
+	streaming bool
+	run       func(e *env, fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{name: "domain create", args: "KEY [ATTR=VALUE...]", summary: "Register a domain", run: domainCreate},
+	{name: "domain get", args: "KEY", summary: "Show a domain", run: domainGet},
+	{name: "domain list", summary: "List the domains", run: domainList},
+	{name: "source add", args: "DOMAIN [AGGREGATE] TOKEN", summary: "Append a source given by -key and -attr, or as JSON on stdin; without AGGREGATE, to those given by -into or the domain's key rule", run: sourceAdd},
+	{name: "source search", args: "DOMAIN", summary: "List the domain's sources with the keys and attrs given by -key and -attr", run: sourceSearch},
+	{name: "aggregate get", args: "DOMAIN AGGREGATE", summary: "Show an aggregate", run: aggregateGet},
+	{name: "aggregate list", args: "DOMAIN", summary: "List a domain's aggregates, or those meeting -filter", run: aggregateList},
+	{name: "aggregate history", args: "DOMAIN AGGREGATE", summary: "Show an aggregate's versions and the sources each added", run: aggregateHistory},
+	{name: "aggregate diff", args: "DOMAIN AGGREGATE FROM [TO]", summary: "Show the sources added between two versions", run: aggregateDiff},
+	{name: "watch", summary: "Print aggregates as they change", streaming: true, run: watch},
+	{name: "export", args: "[DOMAIN...]", summary: "Write domains and their aggregates as JSON lines", run: export},
+	{name: "import", summary: "Register the domains and sources of export output on stdin", run: importRecords},
+}
+
+// Given for mistakes in the command line; exits with status 2.
+type usageError struct {
+	message string
+}
+
+func (e usageError) Error() string {
+	return e.message
+}
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+// Ensures the command got between min and max positional
+// arguments; a negative max means any number.
+func nargs(args []string, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		return usagef("Unexpected arguments: %q", args)
+	}
+	return nil
+}
+
+func usage(w io.Writer, global *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage: %s [flags] COMMAND [flags] [ARGS]\n\nCommands:\n", global.Name())
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-42s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+	fmt.Fprintf(w, "\nFlags (also given by %s* environment variables):\n", ENV_PREFIX)
+	global.SetOutput(w)
+	global.PrintDefaults()
+	fmt.Fprintf(w, "\nEach command takes -h for its own flags.  The exit status is 1 if the command fails, and 2 for usage errors.\n")
+}
+
+// Finds the command named by the leading arguments, and gives
+// the arguments that follow its name.
+func findCommand(args []string) (*command, []string) {
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == commands[i].name {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, nil
+}
+
+func run(ctx context.Context, name string, args []string, getenv func(string) string, stdin io.Reader, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet(name, flag.ContinueOnError)
+	global.SetOutput(stderr)
+	server := global.String("server", "localhost:8080", "address of the botlnek server")
+	token := global.String("token", "", "API token, if the server requires one")
+	publisher := global.String("publisher", "", "publisher to record with appended sources")
+	timeout := global.Duration("timeout", time.Minute, "time allowed for the command (0 for none); watch ignores it")
+	global.Usage = func() { usage(stderr, global) }
+	if err := setFromEnv(global, getenv); err != nil {
+		fmt.Fprintf(stderr, "%s: %s\n", name, err)
+		return 2
+	}
+	if err := global.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	cmd, rest := findCommand(global.Args())
+	if cmd == nil {
+		if global.NArg() > 0 {
+			fmt.Fprintf(stderr, "%s: unknown command %q\n", name, strings.Join(global.Args(), " "))
+		}
+		usage(stderr, global)
+		return 2
+	}
+
+	fs := flag.NewFlagSet(name+" "+cmd.name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s %s [flags] %s\n\n%s.\n", name, cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+
+	c := client.New(*server)
+	c.Token = *token
+	c.Publisher = *publisher
+	c.UserAgent = "botlnekctl"
+	if *timeout > 0 && !cmd.streaming {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	e := &env{ctx: ctx, client: c, stdin: stdin, stdout: stdout, stderr: stderr}
+
+	err := cmd.run(e, fs, rest)
+	switch err.(type) {
+	case nil:
+		return 0
+	case usageError:
+		fmt.Fprintf(stderr, "%s %s: %s\n", name, cmd.name, err)
+		fs.Usage()
+		return 2
+	}
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if _, parsing := err.(flagError); parsing {
+		return 2
+	}
+	fmt.Fprintf(stderr, "%s %s: %s\n", name, cmd.name, err)
+	return 1
+}
+
+// Given when a command's flags don't parse; the flag package has
+// already said why.
+type flagError struct {
+	error
+}
+
+// Parses the command's flags, and ensures it got between min and max
+// positional arguments (any number if max is negative).
+func parse(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, flagError{err}
+	}
+	return fs.Args(), nargs(fs.Args(), min, max)
+}
+
+// Sets each flag given by a BOTLNEK_* environment variable, so
+// the command line can override it.
+func setFromEnv(fs *flag.FlagSet, getenv func(string) string) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := ENV_PREFIX + strings.ToUpper(f.Name)
+		if value := getenv(name); value != "" && err == nil {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("Invalid %s: %s", name, e)
+			}
+		}
+	})
+	return err
+}
+
+func (e *env) printJson(v interface{}) error {
+	encoder := json.NewEncoder(e.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// A repeatable KEY=VALUE flag.
+type kvFlag map[string]string
+
+func (f kvFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f kvFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return errors.New("expected KEY=VALUE")
+	}
+	f[s[:i]] = s[i+1:]
+	return nil
+}
+
+// A repeatable flag.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// A repeatable DOMAIN or DOMAIN:TOKEN,... flag.
+type mirrorFlag []model.Mirror
+
+func (f *mirrorFlag) String() string {
+	specs := make([]string, len(*f))
+	for i, m := range *f {
+		specs[i] = string(m.Domain)
+		if len(m.Tokens) > 0 {
+			specs[i] += ":" + strings.Join(m.Tokens, ",")
+		}
+	}
+	return strings.Join(specs, " ")
+}
+
+func (f *mirrorFlag) Set(s string) error {
+	m := model.Mirror{Domain: model.DomainKey(s)}
+	if i := strings.Index(s, ":"); i >= 0 {
+		m.Domain, m.Tokens = model.DomainKey(s[:i]), strings.Split(s[i+1:], ",")
+	}
+	if m.Domain == "" {
+		return errors.New("expected DOMAIN or DOMAIN:TOKEN,...")
+	}
+	*f = append(*f, m)
+	return nil
+}
+
+func main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	os.Exit(run(ctx, "botlnekctl", os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
+}
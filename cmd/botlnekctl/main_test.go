@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/rest"
+	"github.com/ethanrowe/botlnek/pkg/store/inmemory"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer() (string, func()) {
+	store := inmemory.NewInMemoryStore()
+	app := &rest.RestApplication{
+		DomainWriter:               store,
+		DomainReader:               store,
+		DomainLister:               store,
+		AggregateWriter:            store,
+		ConditionalAggregateWriter: store,
+		AttributedAggregateWriter:  store,
+		AggregateReader:            store,
+		ChangeFeedReader:           store,
+		SourceSearcher:             store,
+		AggregateLister:            store,
+		EventSource:                store,
+	}
+	server := httptest.NewServer(app.Handler())
+	return server.URL, func() {
+		app.Shutdown()
+		server.Close()
+		store.Stop()
+	}
+}
+
+type result struct {
+	status         int
+	stdout, stderr string
+}
+
+func ctl(ctx context.Context, server, stdin string, args ...string) result {
+	var stdout, stderr bytes.Buffer
+	args = append([]string{"-server", server}, args...)
+	status := run(ctx, "botlnekctl", args, func(string) string { return "" }, strings.NewReader(stdin), &stdout, &stderr)
+	return result{status, stdout.String(), stderr.String()}
+}
+
+func TestCommands(t *testing.T) {
+	server, stop := testServer()
+	defer stop()
+	ctx := context.Background()
+	expect := func(r result, status int, stdout string) {
+		t.Helper()
+		if r.status != status || !strings.Contains(r.stdout, stdout) {
+			t.Errorf("Expected status %d and output containing %q; got %d, %q (stderr %q)", status, stdout, r.status, r.stdout, r.stderr)
+		}
+	}
+
+	expect(ctl(ctx, server, "", "domain", "create", "d", "owner=ops"), 0, `"owner": "ops"`)
+	r := ctl(ctx, server, "", "domain", "create", "d")
+	expect(r, 0, `"owner": "ops"`)
+	if !strings.Contains(r.stderr, "already registered") {
+		t.Errorf("Expected a note about the duplicate; got %q", r.stderr)
+	}
+	expect(ctl(ctx, server, "", "domain", "get", "d"), 0, `"Key": "d"`)
+	expect(ctl(ctx, server, "", "domain", "get", "missing"), 1, "")
+	expect(ctl(ctx, server, "", "domain", "list"), 0, "d\n")
+
+	expect(ctl(ctx, server, "", "source", "add", "-key", "k=1", "-attr", "a=x", "d", "p", "t"), 0, `"New": true`)
+	expect(ctl(ctx, server, `{"Keys": {"k": "2"}}`, "source", "add", "d", "p", "u"), 0, `"VersionIdx": 1`)
+	expect(ctl(ctx, server, `{"Keys": {"k": "2"}}`, "source", "add", "d", "q", "u"), 0, `"New": true`)
+	expect(ctl(ctx, server, "", "source", "add", "-key", "k=3", "-version", "0", "d", "p", "t"), 1, "")
+	expect(ctl(ctx, server, "not json", "source", "add", "d", "p", "t"), 1, "")
+	expect(ctl(ctx, server, "", "domain", "create", "-time-key", "asof", "-truncate", "24h", "-layout", "20060102", "r"), 0, `"TimeKey": "asof"`)
+	expect(ctl(ctx, server, "", "source", "add", "-key", "asof=2019-07-10T11:28:10Z", "r", "t"), 0, `"Aggregate": "20190710"`)
+	expect(ctl(ctx, server, "", "source", "add", "-key", "k=1", "d", "t"), 1, "")
+	expect(ctl(ctx, server, "", "source", "add", "-key", "k=1", "-version", "0", "r", "t"), 2, "")
+	r = ctl(ctx, server, "", "source", "add", "-key", "k=1", "-into", "x", "-into", "y", "r", "t")
+	expect(r, 0, `"Aggregate": "y"`)
+	if !strings.Contains(r.stdout, `"Aggregate": "x"`) {
+		t.Errorf("Expected receipts for both aggregates; got %q", r.stdout)
+	}
+	expect(ctl(ctx, server, "", "source", "add", "-key", "k=1", "-into", "x", "r", "p", "t"), 2, "")
+
+	r = ctl(ctx, server, "", "source", "search", "-key", "k=2", "d")
+	expect(r, 0, "p  version 2  u  keys: k=2")
+	if !strings.Contains(r.stdout, "q  version 1  u  keys: k=2") {
+		t.Errorf("Expected both aggregates' sources; got %q", r.stdout)
+	}
+	expect(ctl(ctx, server, "", "source", "search", "-json", "-attr", "a=x", "-token", "t", "d"), 0, `"Aggregate": "p"`)
+	expect(ctl(ctx, server, "", "source", "search", "d"), 2, "")
+	expect(ctl(ctx, server, "", "aggregate", "get", "d", "p"), 0, `"Key": "p"`)
+	expect(ctl(ctx, server, "", "aggregate", "list", "d"), 0, "p\nq\n")
+	if r = ctl(ctx, server, "", "aggregate", "list", "-filter", `version == 2`, "d"); r.status != 0 || r.stdout != "p\n" {
+		t.Errorf("Expected only p to meet the filter; got %d %q %q", r.status, r.stdout, r.stderr)
+	}
+	if r = ctl(ctx, server, "", "source", "search", "-key", "k=2", "-filter", `any("t", attr.a == "x")`, "d"); r.status != 0 || strings.Contains(r.stdout, "q  ") || !strings.Contains(r.stdout, "p  version 2") {
+		t.Errorf("Expected only p's sources to meet the filter; got %d %q %q", r.status, r.stdout, r.stderr)
+	}
+	expect(ctl(ctx, server, "", "aggregate", "list", "-filter", "version", "d"), 2, "")
+	expect(ctl(ctx, server, "", "aggregate", "history", "d", "p"), 0, "version 2")
+	r = ctl(ctx, server, "", "aggregate", "diff", "d", "p", "1")
+	expect(r, 0, "+ u  keys: k=2")
+	if strings.Contains(r.stdout, "version 1 ") {
+		t.Errorf("Diff from version 1 should omit it; got %q", r.stdout)
+	}
+	expect(ctl(ctx, server, "", "aggregate", "diff", "d", "p", "2", "1"), 1, "")
+
+	// Usage errors
+	expect(ctl(ctx, server, "", "bogus"), 2, "")
+	expect(ctl(ctx, server, "", "domain", "get"), 2, "")
+	expect(ctl(ctx, server, "", "aggregate", "diff", "d", "p", "x"), 2, "")
+	expect(ctl(ctx, server, "", "domain", "list", "-nope"), 2, "")
+	expect(ctl(ctx, "127.0.0.1:1", "", "-timeout", "50ms", "domain", "list"), 1, "")
+
+	// Settings from the environment yield to flags.
+	var stdout, stderr bytes.Buffer
+	getenv := func(name string) string {
+		return map[string]string{"BOTLNEK_SERVER": server, "BOTLNEK_TIMEOUT": "bogus"}[name]
+	}
+	if status := run(ctx, "botlnekctl", []string{"domain", "list"}, getenv, nil, &stdout, &stderr); status != 2 {
+		t.Errorf("Expected an invalid BOTLNEK_TIMEOUT to be a usage error; got %d", status)
+	}
+	getenv = func(name string) string {
+		return map[string]string{"BOTLNEK_SERVER": "127.0.0.1:1"}[name]
+	}
+	if status := run(ctx, "botlnekctl", []string{"-server", server, "domain", "list"}, getenv, nil, &stdout, &stderr); status != 0 {
+		t.Errorf("Expected -server to override BOTLNEK_SERVER; got %d (%s)", status, stderr.String())
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	from, stop := testServer()
+	defer stop()
+	to, stopTo := testServer()
+	defer stopTo()
+	ctx := context.Background()
+
+	ctl(ctx, from, "", "domain", "create", "d", "owner=ops")
+	ctl(ctx, from, "", "source", "add", "-key", "k=1", "d", "p", "t")
+	ctl(ctx, from, "", "source", "add", "-key", "k=2", "d", "p", "u")
+	ctl(ctx, from, "", "source", "add", "-key", "k=1", "d", "q", "t")
+
+	exported := ctl(ctx, from, "", "export")
+	if exported.status != 0 || strings.Count(exported.stdout, "\n") != 3 {
+		t.Fatalf("Unexpected export: %d %q %q", exported.status, exported.stdout, exported.stderr)
+	}
+	for i := 0; i < 2; i++ {
+		r := ctl(ctx, to, exported.stdout, "import")
+		if r.status != 0 {
+			t.Fatalf("Import failed: %q", r.stderr)
+		}
+	}
+	if r := ctl(ctx, to, exported.stdout, "import"); !strings.Contains(r.stderr, "0 sources added, 3 already present") {
+		t.Errorf("Repeated import should add nothing; got %q", r.stderr)
+	}
+
+	// The copy matches, but for clocks and provenance.
+	history := func(server string) string {
+		var versions []struct{ Sources []tokenSource }
+		r := ctl(ctx, server, "", "aggregate", "history", "-json", "d", "p")
+		if err := json.Unmarshal([]byte(r.stdout), &versions); err != nil {
+			t.Fatalf("Invalid history %q: %s", r.stdout, err)
+		}
+		sources := make([]string, 0)
+		for _, v := range versions {
+			for _, s := range v.Sources {
+				sources = append(sources, s.Token+":"+s.Source.Keys["k"])
+			}
+		}
+		return strings.Join(sources, ",")
+	}
+	if a, b := history(from), history(to); a != b || a != "t:1,u:2" {
+		t.Errorf("Histories differ: %s and %s", a, b)
+	}
+	if r := ctl(ctx, to, "", "domain", "get", "d"); !strings.Contains(r.stdout, `"owner": "ops"`) {
+		t.Errorf("Domain attributes not imported: %q", r.stdout)
+	}
+}
+
+func TestMirrorExport(t *testing.T) {
+	from, stop := testServer()
+	defer stop()
+	to, stopTo := testServer()
+	defer stopTo()
+	ctx := context.Background()
+
+	if r := ctl(ctx, from, "", "domain", "create", "-mirror", "d", "c"); r.status == 0 {
+		t.Errorf("Expected mirroring a missing domain to fail; got %+v", r)
+	}
+	ctl(ctx, from, "", "domain", "create", "d")
+	if r := ctl(ctx, from, "", "domain", "create", "-mirror", "d:t", "c"); r.status != 0 || !strings.Contains(r.stdout, `"Tokens": [`) {
+		t.Fatalf("Unexpected result %+v", r)
+	}
+	ctl(ctx, from, "", "source", "add", "-key", "k=1", "d", "p", "t")
+	ctl(ctx, from, "", "source", "add", "-key", "k=2", "d", "p", "u")
+	if r := ctl(ctx, from, "", "aggregate", "get", "c", "p"); !strings.Contains(r.stdout, `"Origin"`) || strings.Contains(r.stdout, `"u"`) {
+		t.Errorf("Expected only token t mirrored; got %q", r.stdout)
+	}
+
+	// The upstream domain is exported first, though it sorts later.
+	exported := ctl(ctx, from, "", "export")
+	if i, j := strings.Index(exported.stdout, `{"Domain":{"Key":"d"`), strings.Index(exported.stdout, `{"Domain":{"Key":"c"`); i < 0 || j < i {
+		t.Fatalf("Expected d before c; got %q", exported.stdout)
+	}
+	if r := ctl(ctx, to, exported.stdout, "import"); r.status != 0 {
+		t.Fatalf("Import failed: %q", r.stderr)
+	}
+	if r := ctl(ctx, to, "", "aggregate", "get", "c", "p"); !strings.Contains(r.stdout, `"Origin"`) {
+		t.Errorf("Expected the import to mirror again; got %q", r.stdout)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	server, stop := testServer()
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctl(ctx, server, "", "domain", "create", "d")
+	ctl(ctx, server, "", "domain", "create", "e")
+
+	done := make(chan result)
+	go func() {
+		done <- ctl(ctx, server, "", "watch", "-domain", "d", "-aggregate", "p*", "-count", "1")
+	}()
+	// Keep appending until the watcher has subscribed and seen one.
+	for i := 0; ; i++ {
+		select {
+		case r := <-done:
+			if r.status != 0 || !strings.Contains(r.stdout, "d/p1  version") || strings.Contains(r.stdout, "e/") {
+				t.Fatalf("Unexpected watch output: %d %q %q", r.status, r.stdout, r.stderr)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+			ctl(ctx, server, "", "source", "add", "-key", "i="+strconv.Itoa(i), "e", "p1", "t")
+			ctl(ctx, server, "", "source", "add", "-key", "i="+strconv.Itoa(i), "d", "q", "t")
+			ctl(ctx, server, "", "source", "add", "-key", "i="+strconv.Itoa(i), "d", "p1", "t")
+		case <-ctx.Done():
+			t.Fatal("Timed out watching")
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"sort"
+)
+
+// A line of export output: a domain, or one of its aggregates
+// (which follow the domains).
+type record struct {
+	Domain    *model.Domain   `json:",omitempty"`
+	DomainKey model.DomainKey `json:",omitempty"`
+	// Decoded by the client, as the model can't decode
+	// clock entries itself
+	Aggregate json.RawMessage `json:",omitempty"`
+}
+
+// Writes each domain (every one, if none are given) and its
+// aggregates, with provenance, as lines of JSON.
+func export(e *env, fs *flag.FlagSet, args []string) error {
+	args, err := parse(fs, args, 0, -1)
+	if err != nil {
+		return err
+	}
+	keys := make([]model.DomainKey, len(args))
+	for i, arg := range args {
+		keys[i] = model.DomainKey(arg)
+	}
+	if len(keys) == 0 {
+		if keys, err = e.client.ListDomains(e.ctx); err != nil {
+			return err
+		}
+	}
+
+	domains := make([]*model.Domain, len(keys))
+	for i, key := range keys {
+		if domains[i], err = e.client.GetDomain(e.ctx, key); err != nil {
+			return err
+		}
+		if domains[i] == nil {
+			return fmt.Errorf("Cannot find domain %q", key)
+		}
+	}
+
+	// The domains come first, so that importing a domain's sources
+	// mirrors them into the domains that mirror it.
+	encoder := json.NewEncoder(e.stdout)
+	domains = upstreamFirst(domains)
+	for _, domain := range domains {
+		if err := encoder.Encode(record{Domain: domain}); err != nil {
+			return err
+		}
+	}
+	for _, domain := range domains {
+		key := domain.Key
+		aggregates, err := listAggregates(e, key, "")
+		if err != nil {
+			return err
+		}
+		for _, aggregate := range aggregates {
+			aggr, err := e.aggregate(string(key), string(aggregate), model.ProvenanceFilter{}, true)
+			if err != nil {
+				return err
+			}
+			raw, err := json.Marshal(aggr)
+			if err != nil {
+				return err
+			}
+			if err := encoder.Encode(record{DomainKey: key, Aggregate: raw}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The domains, each after those it mirrors, so they can be registered
+// in order.  Mirrors cannot form cycles.
+func upstreamFirst(domains []*model.Domain) []*model.Domain {
+	byKey := make(map[model.DomainKey]*model.Domain, len(domains))
+	for _, domain := range domains {
+		byKey[domain.Key] = domain
+	}
+	ordered := make([]*model.Domain, 0, len(domains))
+	added := make(map[model.DomainKey]bool, len(domains))
+	var add func(domain *model.Domain)
+	add = func(domain *model.Domain) {
+		if added[domain.Key] {
+			return
+		}
+		added[domain.Key] = true
+		for _, m := range domain.Mirrors {
+			if upstream, ok := byKey[m.Domain]; ok {
+				add(upstream)
+			}
+		}
+		ordered = append(ordered, domain)
+	}
+	for _, domain := range domains {
+		add(domain)
+	}
+	return ordered
+}
+
+// Registers the domains and sources of export output, each source
+// appended in the order of the version that added it.  Appends are
+// idempotent, so an interrupted import can simply be repeated.  The
+// sources get the importer's provenance, not their original.  Sources
+// a domain mirrors are mirrored again as their upstream's are imported.
+func importRecords(e *env, fs *flag.FlagSet, args []string) error {
+	if _, err := parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	var domains, added, present int
+	scanner := bufio.NewScanner(e.stdin)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("Line %d: %s", line, err)
+		}
+		switch {
+		case rec.Domain != nil:
+			if _, _, err := e.client.CreateDomain(e.ctx, *rec.Domain); err != nil {
+				return fmt.Errorf("Line %d: %s", line, err)
+			}
+			domains++
+		case rec.DomainKey != "" && rec.Aggregate != nil:
+			aggr, err := client.DecodeAggregate(rec.Aggregate)
+			if err != nil {
+				return fmt.Errorf("Line %d: %s", line, err)
+			}
+			for _, s := range sourcesInOrder(aggr) {
+				receipt, err := e.client.AppendSource(e.ctx, rec.DomainKey, aggr.Key, s.Token, s.Source)
+				if err != nil {
+					return fmt.Errorf("Line %d: %s", line, err)
+				}
+				if receipt.New {
+					added++
+				} else {
+					present++
+				}
+			}
+		default:
+			return fmt.Errorf("Line %d: expected a domain or an aggregate", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(e.stderr, "Imported %d domains; %d sources added, %d already present\n", domains, added, present)
+	return nil
+}
+
+func sourcesInOrder(aggr *model.Aggregate) []tokenSource {
+	sources := make([]tokenSource, 0)
+	for token, logs := range aggr.Sources {
+		for _, log := range logs {
+			sources = append(sources, tokenSource{token, log})
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].VersionIdx != sources[j].VersionIdx {
+			return sources[i].VersionIdx < sources[j].VersionIdx
+		}
+		return sources[i].Token < sources[j].Token
+	})
+	return sources
+}
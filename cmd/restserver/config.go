@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/auth"
+	"github.com/ethanrowe/botlnek/pkg/logging"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ENV_PREFIX = "BOTLNEK_"
+)
+
+type Config struct {
+	// Address on which to serve the API
+	Listen string
+	// Store backend; only "inmemory" for now
+	Store string
+	// Source of version sequence numbers: "aggregate" counts
+	// per aggregate, "hlc" uses a hybrid logical clock
+	Clock string
+	// Node ID for the hybrid logical clock
+	NodeID uint
+	// Notifications buffered by the store's notifier
+	NotifierQueue int
+	// Events buffered per /events subscriber
+	SubscriberBuffer int
+	ReadTimeout      time.Duration
+	WriteTimeout     time.Duration
+	IdleTimeout      time.Duration
+	// Upper bound on long-poll aggregate reads
+	MaxWait time.Duration
+	// Time allowed for in-flight requests and the store
+	// to finish when shutting down
+	ShutdownTimeout time.Duration
+	// Deadline for the store to answer /readyz
+	ReadyTimeout time.Duration
+	// Whether to record metrics and serve them at /metrics
+	Metrics   bool
+	LogLevel  string
+	LogFormat string
+	// Token grants for bearer-token authentication, as a JSON
+	// array, or in a JSON file; authentication is disabled if
+	// neither is given
+	AuthTokens     string
+	AuthTokensFile string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Listen:           "0.0.0.0:8080",
+		Store:            "inmemory",
+		Clock:            "aggregate",
+		NotifierQueue:    0,
+		SubscriberBuffer: 10,
+		ReadTimeout:      30 * time.Second,
+		// Responses include long polls and event streams,
+		// so writes aren't bounded by default.
+		WriteTimeout:    0,
+		IdleTimeout:     2 * time.Minute,
+		MaxWait:         5 * time.Minute,
+		ShutdownTimeout: 30 * time.Second,
+		ReadyTimeout:    2 * time.Second,
+		Metrics:         true,
+		LogLevel:        "info",
+		LogFormat:       "logfmt",
+	}
+}
+
+// Binds each setting to a flag; the flag names double as the keys
+// of the config file, and (upper-cased, with underscores) as the
+// suffixes of the BOTLNEK_* environment variables.
+func (c *Config) flagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address on which to serve the API")
+	fs.StringVar(&c.Store, "store", c.Store, "store backend (inmemory)")
+	fs.StringVar(&c.Clock, "clock", c.Clock, "version sequence numbers (aggregate, hlc)")
+	fs.UintVar(&c.NodeID, "node-id", c.NodeID, "node ID for the hlc clock")
+	fs.IntVar(&c.NotifierQueue, "notifier-queue", c.NotifierQueue, "notifications buffered by the store")
+	fs.IntVar(&c.SubscriberBuffer, "subscriber-buffer", c.SubscriberBuffer, "events buffered per subscriber")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "HTTP request read timeout (0 for none)")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "HTTP response write timeout (0 for none)")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "HTTP keep-alive idle timeout (0 for none)")
+	fs.DurationVar(&c.MaxWait, "max-wait", c.MaxWait, "upper bound on long-poll aggregate reads")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time allowed for a graceful shutdown")
+	fs.DurationVar(&c.ReadyTimeout, "ready-timeout", c.ReadyTimeout, "deadline for the store to answer /readyz")
+	fs.BoolVar(&c.Metrics, "metrics", c.Metrics, "record metrics and serve them at /metrics")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "log level (debug, info, warn, error)")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format (logfmt, json)")
+	fs.StringVar(&c.AuthTokens, "auth-tokens", c.AuthTokens, "JSON array of API token grants")
+	fs.StringVar(&c.AuthTokensFile, "auth-tokens-file", c.AuthTokensFile, "JSON file of API token grants")
+	return fs
+}
+
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// Builds the configuration from, in increasing order of precedence:
+// defaults, the config file (given by -config or BOTLNEK_CONFIG),
+// BOTLNEK_* environment variables, and command-line flags.
+func LoadConfig(name string, args []string, getenv func(string) string) (Config, error) {
+	c := DefaultConfig()
+	fs := c.flagSet(name)
+	path := fs.String("config", getenv(envName("config")), "optional JSON or YAML config file")
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+	if fs.NArg() > 0 {
+		return c, fmt.Errorf("Unexpected arguments: %q", fs.Args())
+	}
+
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	delete(explicit, "config")
+
+	if *path != "" {
+		settings, err := readConfigFile(*path)
+		if err != nil {
+			return c, err
+		}
+		for key, value := range settings {
+			if key == "config" || fs.Lookup(key) == nil {
+				return c, fmt.Errorf("Unknown setting %q in %s", key, *path)
+			}
+			if err := fs.Set(key, value); err != nil {
+				return c, fmt.Errorf("Invalid setting %q in %s: %s", key, *path, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		if value := getenv(envName(f.Name)); value != "" {
+			if e := fs.Set(f.Name, value); e != nil {
+				err = fmt.Errorf("Invalid %s: %s", envName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+
+	for key, value := range explicit {
+		fs.Set(key, value)
+	}
+	return c, c.Validate()
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		return readJsonConfig(f)
+	case ".yaml", ".yml":
+		return readYamlConfig(f)
+	default:
+		return nil, fmt.Errorf("Unsupported config file type %q (use .json, .yaml or .yml)", ext)
+	}
+}
+
+// A single JSON object of settings, with string, number, or
+// boolean values.
+func readJsonConfig(r io.Reader) (map[string]string, error) {
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			settings[key] = v
+		case json.Number:
+			settings[key] = v.String()
+		case bool:
+			settings[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("Setting %q must be a string, number, or boolean", key)
+		}
+	}
+	return settings, nil
+}
+
+// Only flat "key: value" mappings are supported, which is all the
+// configuration needs; values may be quoted, and "#" outside quotes
+// starts a comment.
+func readYamlConfig(r io.Reader) (map[string]string, error) {
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripYamlComment(scanner.Text()))
+		if line == "" || line == "---" {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("Line %d: expected \"key: value\"", lineNo)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		settings[key] = value
+	}
+	return settings, scanner.Err()
+}
+
+// The line up to any comment: a "#" starting the line or following
+// whitespace, outside quotes.
+func stripYamlComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen: %s", err))
+	}
+	if c.Store != "inmemory" {
+		problems = append(problems, fmt.Sprintf("store: unknown backend %q", c.Store))
+	}
+	switch c.Clock {
+	case "aggregate":
+		if c.NodeID != 0 {
+			problems = append(problems, "node-id: only applies to the hlc clock")
+		}
+	case "hlc":
+		if c.NodeID > 0xffffffff {
+			problems = append(problems, fmt.Sprintf("node-id: %d exceeds 32 bits", c.NodeID))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("clock: unknown clock %q", c.Clock))
+	}
+	if c.NotifierQueue < 0 {
+		problems = append(problems, "notifier-queue: cannot be negative")
+	}
+	if c.SubscriberBuffer <= 0 {
+		problems = append(problems, "subscriber-buffer: must be positive")
+	}
+	if c.ReadTimeout < 0 {
+		problems = append(problems, "read-timeout: cannot be negative")
+	}
+	if c.WriteTimeout < 0 {
+		problems = append(problems, "write-timeout: cannot be negative")
+	}
+	if c.IdleTimeout < 0 {
+		problems = append(problems, "idle-timeout: cannot be negative")
+	}
+	if c.MaxWait <= 0 {
+		problems = append(problems, "max-wait: must be positive")
+	} else if c.WriteTimeout > 0 && c.MaxWait >= c.WriteTimeout {
+		problems = append(problems, "max-wait: must be less than write-timeout")
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown-timeout: must be positive")
+	}
+	if c.ReadyTimeout <= 0 {
+		problems = append(problems, "ready-timeout: must be positive")
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Sprintf("log-level: unknown level %q", c.LogLevel))
+	}
+	if _, err := logging.ParseFormat(c.LogFormat); err != nil {
+		problems = append(problems, fmt.Sprintf("log-format: unknown format %q", c.LogFormat))
+	}
+	if c.AuthTokens != "" && c.AuthTokensFile != "" {
+		problems = append(problems, "auth-tokens: cannot be given with auth-tokens-file")
+	} else if _, err := c.Authenticator(); err != nil {
+		problems = append(problems, fmt.Sprintf("auth-tokens: %s", strings.Replace(err.Error(), "\n\t", "\n\t\t", -1)))
+	}
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// The authenticator for the configured token grants, or nil if
+// authentication is disabled.
+func (c Config) Authenticator() (*auth.Authenticator, error) {
+	var grants []auth.Grant
+	var err error
+	switch {
+	case c.AuthTokens != "":
+		grants, err = auth.ReadGrants(strings.NewReader(c.AuthTokens))
+	case c.AuthTokensFile != "":
+		grants, err = auth.LoadGrants(c.AuthTokensFile)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewAuthenticator(grants)
+}
+
+// A logger writing to the given destination per the configuration,
+// which must be valid.
+func (c Config) Logger(out io.Writer) *logging.Logger {
+	level, _ := logging.ParseLevel(c.LogLevel)
+	format, _ := logging.ParseFormat(c.LogFormat)
+	return logging.New(out, level, format)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEnv(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func writeTestConfig(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "botlnek-config")
+	if err != nil {
+		t.Fatalf("Failed creating temp dir: %s", err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed writing config: %s", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := LoadConfig("test", nil, testEnv(nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if config != DefaultConfig() {
+		t.Errorf("Expected defaults %v; got %v", DefaultConfig(), config)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	for _, ext := range []string{".json", ".yaml"} {
+		var content string
+		if ext == ".json" {
+			content = `{"listen": "127.0.0.1:9000", "clock": "hlc", "node-id": 4, "max-wait": "1m", "log-level": "warn"}`
+		} else {
+			content = strings.Join([]string{
+				"# botlnek settings",
+				"listen: \"127.0.0.1:9000\"",
+				"clock: hlc",
+				"node-id: 4 # this node",
+				"max-wait: 1m",
+				"log-level: 'warn'",
+			}, "\n")
+		}
+		path, cleanup := writeTestConfig(t, "botlnek"+ext, content)
+		defer cleanup()
+
+		config, err := LoadConfig(
+			"test",
+			[]string{"-log-level", "debug"},
+			testEnv(map[string]string{
+				"BOTLNEK_CONFIG":    path,
+				"BOTLNEK_NODE_ID":   "5",
+				"BOTLNEK_LOG_LEVEL": "error",
+			}),
+		)
+		if err != nil {
+			t.Fatalf("Unexpected error loading %s: %s", ext, err)
+		}
+
+		expected := DefaultConfig()
+		expected.Listen = "127.0.0.1:9000"
+		expected.Clock = "hlc"
+		// The environment beats the file...
+		expected.NodeID = 5
+		expected.MaxWait = time.Minute
+		// ...and flags beat the environment.
+		expected.LogLevel = "debug"
+		if config != expected {
+			t.Errorf("Config mismatch from %s:\n\texpected: %v\n\treceived: %v", ext, expected, config)
+		}
+	}
+}
+
+func TestReadYamlConfig(t *testing.T) {
+	settings, err := readYamlConfig(strings.NewReader(strings.Join([]string{
+		"---",
+		"  # indented comment",
+		"auth-tokens-file: \"/etc/botlnek/a #1.json\" # quoted hash",
+		"listen: ':9000'#not a comment",
+		"clock: hlc\t# tab before comment",
+	}, "\n")))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := map[string]string{
+		"auth-tokens-file": "/etc/botlnek/a #1.json",
+		"listen":           "':9000'#not a comment",
+		"clock":            "hlc",
+	}
+	if len(settings) != len(expected) {
+		t.Errorf("Expected %v; got %v", expected, settings)
+	}
+	for key, value := range expected {
+		if settings[key] != value {
+			t.Errorf("%s: expected %q; got %q", key, value, settings[key])
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	_, err := LoadConfig(
+		"test",
+		[]string{"-listen", "nowhere", "-store", "postgres", "-node-id", "3", "-log-level", "loud", "-log-format", "xml"},
+		testEnv(nil),
+	)
+	if err == nil {
+		t.Fatal("Expected a validation error")
+	}
+	for _, problem := range []string{"listen:", "store:", "node-id:", "log-level:", "log-format:"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q problem to be reported in: %s", problem, err)
+		}
+	}
+
+	path, cleanup := writeTestConfig(t, "botlnek.json", `{"listne": "127.0.0.1:9000"}`)
+	defer cleanup()
+	if _, err = LoadConfig("test", []string{"-config", path}, testEnv(nil)); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+
+	if _, err = LoadConfig("test", nil, testEnv(map[string]string{"BOTLNEK_READ_TIMEOUT": "soon"})); err == nil {
+		t.Error("Expected an error for an invalid environment variable")
+	}
+}
+
+func TestLoadConfigAuthTokens(t *testing.T) {
+	grants := `[{"Principal": "p", "Token": "t", "Domains": ["*"], "Permissions": ["admin"]}]`
+	path, cleanup := writeTestConfig(t, "tokens.json", grants)
+	defer cleanup()
+
+	for _, args := range [][]string{{"-auth-tokens", grants}, {"-auth-tokens-file", path}} {
+		config, err := LoadConfig("test", args, testEnv(nil))
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", args, err)
+		}
+		authenticator, err := config.Authenticator()
+		if err != nil || authenticator == nil || authenticator.Authenticate("t") == nil {
+			t.Errorf("%q: expected the token to authenticate (error: %v)", args, err)
+		}
+	}
+
+	if authenticator, err := DefaultConfig().Authenticator(); authenticator != nil || err != nil {
+		t.Errorf("Authentication should be disabled by default (error: %v)", err)
+	}
+
+	for _, args := range [][]string{
+		{"-auth-tokens", `[{"Principal": "p"}]`},
+		{"-auth-tokens", grants, "-auth-tokens-file", path},
+		{"-auth-tokens-file", path + ".missing"},
+	} {
+		if _, err := LoadConfig("test", args, testEnv(nil)); err == nil || !strings.Contains(err.Error(), "auth-tokens:") {
+			t.Errorf("%q: expected an auth-tokens problem; got %v", args, err)
+		}
+	}
+}
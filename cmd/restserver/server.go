@@ -1,36 +1,144 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/logging"
+	"github.com/ethanrowe/botlnek/pkg/metrics"
 	"github.com/ethanrowe/botlnek/pkg/rest"
 	"github.com/ethanrowe/botlnek/pkg/store/inmemory"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+func NewStore(config Config, registry *metrics.Registry, logger *logging.Logger) *inmemory.InMemoryStore {
+	options := []inmemory.StoreOption{
+		inmemory.WithNotifierQueue(config.NotifierQueue),
+		inmemory.WithLogger(logger),
+	}
+	if registry != nil {
+		options = append(options, inmemory.WithMetrics(registry))
+	}
+	if config.Clock == "hlc" {
+		options = append(options, inmemory.WithHybridLogicalClock(uint32(config.NodeID)))
+	}
+	return inmemory.NewInMemoryStore(options...)
+}
+
 func main() {
-	mux := http.NewServeMux()
+	config, err := LoadConfig(os.Args[0], os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	logger := config.Logger(os.Stdout)
+	authenticator, err := config.Authenticator()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	if authenticator == nil {
+		logger.Warn("authentication disabled; anyone may use the API")
+	} else {
+		logger.Info("authentication enabled", "principals", strings.Join(authenticator.Principals(), ","))
+	}
 
-	store := inmemory.NewInMemoryStore()
+	var registry *metrics.Registry
+	if config.Metrics {
+		registry = metrics.NewRegistry()
+	}
+	store := NewStore(config, registry, logger)
 	app := &rest.RestApplication{
-		DomainWriter:    store,
-		DomainReader:    store,
-		AggregateWriter: store,
-		AggregateReader: store,
-		EventSource:     store,
+		DomainWriter:               store,
+		DomainReader:               store,
+		DomainLister:               store,
+		AggregateWriter:            store,
+		ConditionalAggregateWriter: store,
+		AttributedAggregateWriter:  store,
+		AggregateReader:            store,
+		AggregateWaiter:            store,
+		ChangeFeedReader:           store,
+		SourceSearcher:             store,
+		AggregateLister:            store,
+		EventSource:                store,
+		MaxWaitTimeout:             config.MaxWait,
+		SubscriberBuffer:           config.SubscriberBuffer,
+		Metrics:                    registry,
+		ReadinessChecker:           store,
+		ReadinessTimeout:           config.ReadyTimeout,
+		Logger:                     logger,
+		Authenticator:              authenticator,
 	}
-	app.ApplyRoutes(mux)
 
 	server := &http.Server{
-		Addr:    "0.0.0.0:8080",
-		Handler: mux,
+		Addr:         config.Listen,
+		Handler:      app.Handler(),
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
 	}
+	server.RegisterOnShutdown(app.Shutdown)
 
-	fmt.Println("Launching server on", server.Addr)
-	err := server.ListenAndServe()
-	if err != nil {
-		fmt.Println("Error running server:", err.Error())
-		os.Exit(255)
+	os.Exit(serve(config, server, store, logger))
+}
+
+// Serves until the server fails or a SIGINT/SIGTERM arrives, then
+// shuts down gracefully: in-flight requests drain, subscribers get
+// a final event, and the store and notifier stop.  Gives the exit code.
+func serve(config Config, server *http.Server, store *inmemory.InMemoryStore, logger *logging.Logger) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Info("shutting down", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	failed := make(chan error, 1)
+	go func() {
+		logger.Info("serving", "listen", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- err
+		}
+	}()
+
+	code := 0
+	select {
+	case err := <-failed:
+		logger.Error("server failed", "error", err)
+		code = 255
+	case <-ctx.Done():
+	}
+
+	shutdown, done := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer done()
+	if err := server.Shutdown(shutdown); err != nil {
+		logger.Error("draining requests failed", "error", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	if err := store.Shutdown(shutdown); err != nil {
+		logger.Error("stopping store failed", "error", err)
+		if code == 0 {
+			code = 1
+		}
 	}
-	fmt.Println("Done serving.")
+	logger.Info("stopped", "exit_code", code)
+	return code
 }
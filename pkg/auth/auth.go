@@ -0,0 +1,192 @@
+// API token authentication, with each token granting a principal
+// permissions on some or all domains.
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type Permission string
+
+const (
+	// Read domains, aggregates and change feeds.
+	Read Permission = "read"
+	// Append sources to aggregates.
+	Append Permission = "append"
+	// Subscribe to aggregate mutations.
+	Subscribe Permission = "subscribe"
+	// Register domains; implies the other permissions.
+	Admin Permission = "admin"
+)
+
+// Grants the permissions on every domain.
+const ANY_DOMAIN = "*"
+
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(s); p {
+	case Read, Append, Subscribe, Admin:
+		return p, nil
+	}
+	return "", fmt.Errorf("Unknown permission %q", s)
+}
+
+// A token and what it grants, as configured.  The token is given
+// either as is, or as the hex SHA-256 digest of the token so the
+// secret needn't be kept in the configuration.
+type Grant struct {
+	Principal   string
+	Token       string `json:",omitempty"`
+	TokenSHA256 string `json:",omitempty"`
+	// Domain keys, or ANY_DOMAIN
+	Domains     []string
+	Permissions []Permission
+}
+
+// Who a request is made on behalf of, and what they may do.
+type Principal struct {
+	Name        string
+	domains     map[model.DomainKey]bool
+	anyDomain   bool
+	permissions map[Permission]bool
+}
+
+func (p *Principal) has(perm Permission) bool {
+	return p.permissions[perm] || p.permissions[Admin]
+}
+
+// Whether the principal has the permission on the domain.
+func (p *Principal) Allows(perm Permission, domain model.DomainKey) bool {
+	return p != nil && p.has(perm) && (p.anyDomain || p.domains[domain])
+}
+
+// Whether the principal has the permission on at least one domain.
+func (p *Principal) AllowsSome(perm Permission) bool {
+	return p != nil && p.has(perm) && (p.anyDomain || len(p.domains) > 0)
+}
+
+// Whether the principal has the permission on every domain.
+func (p *Principal) AllowsAll(perm Permission) bool {
+	return p != nil && p.has(perm) && p.anyDomain
+}
+
+type Authenticator struct {
+	principals map[[sha256.Size]byte]*Principal
+}
+
+func NewAuthenticator(grants []Grant) (*Authenticator, error) {
+	a := &Authenticator{principals: make(map[[sha256.Size]byte]*Principal)}
+	problems := make([]string, 0)
+	for i, grant := range grants {
+		digest, err := grant.digest()
+		if err == nil && grant.Principal == "" {
+			err = fmt.Errorf("no principal")
+		}
+		if err == nil && len(grant.Domains) == 0 {
+			err = fmt.Errorf("no domains")
+		}
+		if err == nil && len(grant.Permissions) == 0 {
+			err = fmt.Errorf("no permissions")
+		}
+		if _, dup := a.principals[digest]; err == nil && dup {
+			err = fmt.Errorf("token already granted")
+		}
+		principal := &Principal{
+			Name:        grant.Principal,
+			domains:     make(map[model.DomainKey]bool),
+			permissions: make(map[Permission]bool),
+		}
+		for _, perm := range grant.Permissions {
+			if _, e := ParsePermission(string(perm)); e != nil && err == nil {
+				err = e
+			}
+			principal.permissions[perm] = true
+		}
+		for _, domain := range grant.Domains {
+			if domain == ANY_DOMAIN {
+				principal.anyDomain = true
+			} else {
+				principal.domains[model.DomainKey(domain)] = true
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("grant %d (%q): %s", i, grant.Principal, err))
+			continue
+		}
+		a.principals[digest] = principal
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid token grants:\n\t%s", strings.Join(problems, "\n\t"))
+	}
+	return a, nil
+}
+
+func (g Grant) digest() (digest [sha256.Size]byte, err error) {
+	switch {
+	case g.Token != "" && g.TokenSHA256 != "":
+		err = fmt.Errorf("give Token or TokenSHA256, not both")
+	case g.Token != "":
+		digest = sha256.Sum256([]byte(g.Token))
+	case g.TokenSHA256 != "":
+		var raw []byte
+		raw, err = hex.DecodeString(g.TokenSHA256)
+		if err == nil && len(raw) != sha256.Size {
+			err = fmt.Errorf("TokenSHA256 must be %d hex digits", 2*sha256.Size)
+		}
+		copy(digest[:], raw)
+	default:
+		err = fmt.Errorf("no token")
+	}
+	return
+}
+
+// The principal the token was granted to, or nil if it wasn't.
+// Tokens are looked up by digest, so the comparison doesn't leak
+// how much of a token matched.
+func (a *Authenticator) Authenticate(token string) *Principal {
+	if token == "" {
+		return nil
+	}
+	return a.principals[sha256.Sum256([]byte(token))]
+}
+
+// The names of the principals with grants, sorted.
+func (a *Authenticator) Principals() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(a.principals))
+	for _, p := range a.principals {
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			names = append(names, p.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reads a JSON array of grants.
+func ReadGrants(r io.Reader) ([]Grant, error) {
+	var grants []Grant
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&grants); err != nil {
+		return nil, fmt.Errorf("Invalid token grants: %s", err)
+	}
+	return grants, nil
+}
+
+func LoadGrants(path string) ([]Grant, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadGrants(f)
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testAuthenticator(t *testing.T) *Authenticator {
+	digest := sha256.Sum256([]byte("hashed-token"))
+	grants, err := ReadGrants(strings.NewReader(`[
+		{"Principal": "publisher", "Token": "pub-token", "Domains": ["a", "b"], "Permissions": ["read", "append"]},
+		{"Principal": "watcher", "TokenSHA256": "` + hex.EncodeToString(digest[:]) + `", "Domains": ["*"], "Permissions": ["subscribe"]},
+		{"Principal": "operator", "Token": "op-token", "Domains": ["*"], "Permissions": ["admin"]}
+	]`))
+	if err != nil {
+		t.Fatalf("Failed to read grants: %s", err)
+	}
+	a, err := NewAuthenticator(grants)
+	if err != nil {
+		t.Fatalf("Failed to build authenticator: %s", err)
+	}
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := testAuthenticator(t)
+	for token, name := range map[string]string{"pub-token": "publisher", "hashed-token": "watcher", "op-token": "operator"} {
+		if p := a.Authenticate(token); p == nil || p.Name != name {
+			t.Errorf("Token %q should authenticate %q; got %v", token, name, p)
+		}
+	}
+	for _, token := range []string{"", "pub-token ", "unknown", "PUB-TOKEN"} {
+		if p := a.Authenticate(token); p != nil {
+			t.Errorf("Token %q should not authenticate; got %v", token, p)
+		}
+	}
+	if names := a.Principals(); !reflect.DeepEqual(names, []string{"operator", "publisher", "watcher"}) {
+		t.Errorf("Unexpected principals %q", names)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	a := testAuthenticator(t)
+	publisher, watcher, operator := a.Authenticate("pub-token"), a.Authenticate("hashed-token"), a.Authenticate("op-token")
+	cases := []struct {
+		principal *Principal
+		perm      Permission
+		domain    model.DomainKey
+		allowed   bool
+	}{
+		{publisher, Read, "a", true},
+		{publisher, Append, "b", true},
+		{publisher, Append, "c", false},
+		{publisher, Subscribe, "a", false},
+		{publisher, Admin, "a", false},
+		{watcher, Subscribe, "anything", true},
+		{watcher, Read, "anything", false},
+		{operator, Read, "anything", true},
+		{operator, Admin, "anything", true},
+		{nil, Read, "a", false},
+	}
+	for _, c := range cases {
+		if got := c.principal.Allows(c.perm, c.domain); got != c.allowed {
+			t.Errorf("%v %s on %q: expected %t", c.principal, c.perm, c.domain, c.allowed)
+		}
+	}
+	if !publisher.AllowsSome(Read) || publisher.AllowsAll(Read) || publisher.AllowsSome(Subscribe) {
+		t.Error("Publisher has read on some domains only, and no subscribe")
+	}
+	if !watcher.AllowsAll(Subscribe) || !operator.AllowsAll(Append) {
+		t.Error("Wildcard grants should allow all domains")
+	}
+}
+
+func TestInvalidGrants(t *testing.T) {
+	_, err := NewAuthenticator([]Grant{
+		{Principal: "ok", Token: "t1", Domains: []string{"a"}, Permissions: []Permission{Read}},
+		{Principal: "no-token", Domains: []string{"a"}, Permissions: []Permission{Read}},
+		{Principal: "both", Token: "t2", TokenSHA256: "ab", Domains: []string{"a"}, Permissions: []Permission{Read}},
+		{Principal: "short-digest", TokenSHA256: "abcd", Domains: []string{"a"}, Permissions: []Permission{Read}},
+		{Principal: "no-domains", Token: "t3", Permissions: []Permission{Read}},
+		{Principal: "bad-permission", Token: "t4", Domains: []string{"a"}, Permissions: []Permission{"write"}},
+		{Principal: "duplicate", Token: "t1", Domains: []string{"a"}, Permissions: []Permission{Read}},
+	})
+	if err == nil {
+		t.Fatal("Expected invalid grants to be rejected")
+	}
+	for _, name := range []string{"no-token", "both", "short-digest", "no-domains", "bad-permission", "duplicate"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("Expected grant %q to be reported in: %s", name, err)
+		}
+	}
+	if strings.Contains(err.Error(), "\"ok\"") {
+		t.Errorf("Valid grant reported: %s", err)
+	}
+
+	if _, err := ReadGrants(strings.NewReader(`[{"Principal": "p", "Tokn": "t"}]`)); err == nil {
+		t.Error("Expected unknown fields to be rejected")
+	}
+}
@@ -0,0 +1,511 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The API version the client speaks; paths are under this prefix.
+	API_PREFIX = "/v1"
+	// Names the publisher of a source, for its provenance.
+	PUBLISHER_HEADER = "X-Botlnek-Publisher"
+	// Retries after a failed request when the client
+	// doesn't specify otherwise.
+	DefaultMaxRetries = 3
+	// Delay before the first retry when the client
+	// doesn't specify otherwise; it doubles with each retry.
+	DefaultBackoff = 250 * time.Millisecond
+	// Upper bound on the delay between retries when the
+	// client doesn't specify otherwise.
+	DefaultMaxBackoff = 10 * time.Second
+	// Long-poll timeout per request while waiting for
+	// an aggregate version.
+	DefaultWaitTimeout = 30 * time.Second
+)
+
+// Speaks the botlnek REST API.  Requests that fail with a network
+// error or a 5xx response are retried with exponential backoff.
+// Unconditional writes are idempotent, so this is safe for them as
+// well as reads.  A conditional append is not: if the first attempt
+// lands but its response is lost, the retry finds the aggregate moved
+// on, so AppendSourceAtVersion checks for its source before reporting
+// the mismatch.  The zero value of each field but BaseURL gives the
+// default.
+type Client struct {
+	// The server's address, like "http://localhost:8080".
+	BaseURL    string
+	HTTPClient *http.Client
+	// Sent as a bearer token, if given.
+	Token string
+	// Sent with appends, to record with their sources, if given.
+	Publisher string
+	UserAgent string
+	// Negative for no retries.
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// A client of the server at the base URL; "http://" is assumed
+// if the URL doesn't give a scheme.
+func New(baseURL string) *Client {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "http://" + baseURL
+	}
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// An error response from the server.  Its code, message, and details
+// are as the server gave them, so model.CodeOf tells what went wrong.
+type Error struct {
+	StatusCode int
+	Code       model.ErrorCode
+	Message    string
+	Details    map[string]interface{}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *Error) ErrorCode() model.ErrorCode {
+	return e.Code
+}
+
+func (e *Error) ErrorDetails() map[string]interface{} {
+	return e.Details
+}
+
+// Whether a request that failed with the error may succeed if retried.
+func Retryable(err error) bool {
+	switch e := err.(type) {
+	case nil:
+		return false
+	case *Error:
+		return e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented
+	case *url.Error:
+		// Network errors and the like
+		return true
+	}
+	return false
+}
+
+// Reads the server's error body, falling back on the status alone.
+func errorFromResponse(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	_ = json.Unmarshal(body, e)
+	e.StatusCode = resp.StatusCode
+	if e.Code == "" {
+		e.Code = model.CodeInternal
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			e.Code = model.CodeUnavailable
+		}
+	}
+	if e.Message == "" {
+		e.Message = resp.Status
+	}
+	return e
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// The delay before the given retry, counting from 1.
+func (c *Client) backoff(retry int) time.Duration {
+	delay, max := c.Backoff, c.MaxBackoff
+	if delay <= 0 {
+		delay = DefaultBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	for i := 1; i < retry && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Waits for the delay, or gives the context's error if it ends first.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// The URL of the API path built from the segments, each escaped.
+func (c *Client) url(query url.Values, segments ...string) string {
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	target := c.BaseURL + API_PREFIX + "/" + strings.Join(escaped, "/")
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	return target
+}
+
+func (c *Client) newRequest(ctx context.Context, method, target string, body []byte, header http.Header) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	return req, nil
+}
+
+// Sends the request, retrying as the client allows, and gives the
+// response for any status below 400; the caller closes its body.
+// Also tells whether the request was retried.
+func (c *Client) do(ctx context.Context, method, target string, body []byte, header http.Header) (*http.Response, bool, error) {
+	maxRetries := c.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		retried := attempt > 0
+		req, err := c.newRequest(ctx, method, target, body, header)
+		if err != nil {
+			return nil, retried, err
+		}
+		resp, err := c.httpClient().Do(req)
+		if err == nil && resp.StatusCode >= 400 {
+			err = errorFromResponse(resp)
+			resp.Body.Close()
+		}
+		if err == nil {
+			return resp, retried, nil
+		}
+		if ctx.Err() != nil {
+			return nil, retried, ctx.Err()
+		}
+		if !Retryable(err) || attempt >= maxRetries {
+			return nil, retried, err
+		}
+		if err := sleep(ctx, c.backoff(attempt+1)); err != nil {
+			return nil, retried, err
+		}
+	}
+}
+
+// Sends the request and decodes the response body into out, if given
+// and if the response has one.  Gives the response's status.
+func (c *Client) doJson(ctx context.Context, method, target string, in, out interface{}, header http.Header) (int, error) {
+	status, _, err := c.doJsonRetried(ctx, method, target, in, out, header)
+	return status, err
+}
+
+// As doJson, also telling whether the request was retried.
+func (c *Client) doJsonRetried(ctx context.Context, method, target string, in, out interface{}, header http.Header) (int, bool, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return 0, false, err
+		}
+	}
+	resp, retried, err := c.do(ctx, method, target, body, header)
+	if err != nil {
+		return 0, retried, err
+	}
+	defer resp.Body.Close()
+	if out == nil || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return resp.StatusCode, retried, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, retried, fmt.Errorf("Invalid response from %s %s: %s", method, target, err)
+	}
+	return resp.StatusCode, retried, nil
+}
+
+// Nil errors for not-found ones, as the model's readers give nil
+// rather than an error for a missing resource.
+func notFoundAsNil(err error) error {
+	if model.CodeOf(err) == model.CodeNotFound {
+		return nil
+	}
+	return err
+}
+
+// Registers the domain.  A duplicate gives the domain as first
+// registered, with created false.
+func (c *Client) CreateDomain(ctx context.Context, domain model.Domain) (result *model.Domain, created bool, err error) {
+	result = new(model.Domain)
+	status, err := c.doJson(ctx, http.MethodPost, c.url(nil, "domains"), domain, result, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	return result, status == http.StatusCreated, nil
+}
+
+// The domain, or nil if there's no such domain.
+func (c *Client) GetDomain(ctx context.Context, key model.DomainKey) (*model.Domain, error) {
+	domain := new(model.Domain)
+	if _, err := c.doJson(ctx, http.MethodGet, c.url(nil, "domains", string(key)), nil, domain, nil); err != nil {
+		return nil, notFoundAsNil(err)
+	}
+	return domain, nil
+}
+
+func (c *Client) ListDomains(ctx context.Context) ([]model.DomainKey, error) {
+	var list struct{ Domains []model.DomainKey }
+	if _, err := c.doJson(ctx, http.MethodGet, c.url(nil, "domains"), nil, &list, nil); err != nil {
+		return nil, err
+	}
+	return list.Domains, nil
+}
+
+// Up to limit changes to the domain's aggregates following the given
+// sequence number, and the sequence number to follow for the next
+// page.  A zero limit gives the server's default page size.
+func (c *Client) GetChanges(ctx context.Context, domain model.DomainKey, after model.ChangeSeq, limit int) ([]model.Change, model.ChangeSeq, error) {
+	query := url.Values{"after": {after.String()}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	var page struct {
+		Changes []model.Change
+		Next    model.ChangeSeq
+	}
+	if _, err := c.doJson(ctx, http.MethodGet, c.url(query, "domains", string(domain), "changes"), nil, &page, nil); err != nil {
+		return nil, after, err
+	}
+	return page.Changes, page.Next, nil
+}
+
+// Up to limit of the domain's sources matching the query, registered
+// by changes following the given sequence number, and the sequence
+// number to follow for the next page.  Provenance is included if
+// asked for.  A zero limit gives the server's default page size.
+func (c *Client) SearchSources(ctx context.Context, domain model.DomainKey, q model.SourceQuery, includeProvenance bool, after model.ChangeSeq, limit int) ([]model.SourceMatch, model.ChangeSeq, error) {
+	query := viewQuery(q.Provenance, includeProvenance)
+	query.Set("after", after.String())
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if q.Token != "" {
+		query.Set("token", q.Token)
+	}
+	if q.Filter != "" {
+		query.Set("filter", q.Filter)
+	}
+	for k, v := range q.Keys {
+		query.Set("key."+k, v)
+	}
+	for k, v := range q.Attrs {
+		query.Set("attr."+k, v)
+	}
+	var page struct {
+		Sources []model.SourceMatch
+		Next    model.ChangeSeq
+	}
+	if _, err := c.doJson(ctx, http.MethodGet, c.url(query, "domains", string(domain), "search"), nil, &page, nil); err != nil {
+		return nil, after, err
+	}
+	return page.Sources, page.Next, nil
+}
+
+// Up to limit of the domain's aggregate keys sorting after the given
+// key, in order, and the key to follow for the next page.  The filter,
+// if not empty, is an expression of package filter the aggregates must
+// meet.  A zero limit gives the server's default page size.
+func (c *Client) ListAggregates(ctx context.Context, domain model.DomainKey, filter string, after model.AggregateKey, limit int) ([]model.AggregateKey, model.AggregateKey, error) {
+	query := url.Values{}
+	if after != "" {
+		query.Set("after", string(after))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if filter != "" {
+		query.Set("filter", filter)
+	}
+	var page struct {
+		Aggregates []model.AggregateKey
+		Next       model.AggregateKey
+	}
+	if _, err := c.doJson(ctx, http.MethodGet, c.url(query, "domains", string(domain), "aggregates"), nil, &page, nil); err != nil {
+		return nil, after, err
+	}
+	return page.Aggregates, page.Next, nil
+}
+
+// Registers the source with the aggregate under the token.  The
+// receipt's New tells whether this append registered it, or it
+// was already registered.
+func (c *Client) AppendSource(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source) (*model.SourceReceipt, error) {
+	return c.AppendSourceAtVersion(ctx, domain, aggregate, token, source, model.AnyVersion)
+}
+
+// As AppendSource, but fails with a precondition-failed error unless
+// the aggregate is at the given version, which may be model.AnyVersion.
+// If a retry fails so, but the source was registered at that version,
+// an earlier attempt must have landed; its receipt is given, as a
+// duplicate.
+func (c *Client) AppendSourceAtVersion(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int) (*model.SourceReceipt, error) {
+	var receipt receiptJson
+	_, retried, err := c.doJsonRetried(ctx, http.MethodPost, c.url(nil, "aggregates", string(domain), string(aggregate), token), source, &receipt, c.appendHeader(version))
+	if err != nil && retried && model.CodeOf(err) == model.CodePreconditionFailed {
+		if landed, e := c.registeredAt(ctx, domain, aggregate, token, source, version); e != nil || landed != nil {
+			return landed, e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return receipt.model(), nil
+}
+
+// A receipt for the source if it's registered with the aggregate
+// under the token as of the given version, or nil if it isn't.
+func (c *Client) registeredAt(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int) (*model.SourceReceipt, error) {
+	aggr, err := c.GetAggregate(ctx, domain, aggregate)
+	if err != nil || aggr == nil {
+		return nil, err
+	}
+	keyHash := source.KeyHash()
+	for _, log := range aggr.Sources[token] {
+		if log.Key == keyHash && log.VersionIdx == version && version < len(aggr.Log) {
+			return &model.SourceReceipt{
+				Domain:     domain,
+				Aggregate:  aggregate,
+				Token:      token,
+				KeyHash:    keyHash,
+				VersionIdx: version,
+				ClockEntry: aggr.Log[version],
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Registers the source under the token with each of the aggregates,
+// or if none are given, with those the domain's key rule gives for
+// it.  There's a receipt for each aggregate, in order.
+func (c *Client) AppendDomainSource(ctx context.Context, domain model.DomainKey, token string, source model.Source, aggregates ...model.AggregateKey) ([]*model.SourceReceipt, error) {
+	query := make(url.Values)
+	for _, aggregate := range aggregates {
+		query.Add("aggregate", string(aggregate))
+	}
+	var result struct{ Receipts []receiptJson }
+	if _, err := c.doJson(ctx, http.MethodPost, c.url(query, "domains", string(domain), "sources", token), source, &result, c.appendHeader(model.AnyVersion)); err != nil {
+		return nil, err
+	}
+	receipts := make([]*model.SourceReceipt, len(result.Receipts))
+	for i, receipt := range result.Receipts {
+		receipts[i] = receipt.model()
+	}
+	return receipts, nil
+}
+
+// Headers for an append that requires the version, if any.
+func (c *Client) appendHeader(version int) http.Header {
+	header := make(http.Header)
+	if version != model.AnyVersion {
+		header.Set("If-Match", strconv.Itoa(version))
+	}
+	if c.Publisher != "" {
+		header.Set(PUBLISHER_HEADER, c.Publisher)
+	}
+	return header
+}
+
+// The aggregate, or nil if there's no such aggregate.
+func (c *Client) GetAggregate(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey) (*model.Aggregate, error) {
+	return c.GetAggregateView(ctx, domain, aggregate, model.ProvenanceFilter{}, false)
+}
+
+// The aggregate with only the sources the filter selects, and with
+// their provenance if it's to be included; nil if there's no such
+// aggregate.
+func (c *Client) GetAggregateView(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey, filter model.ProvenanceFilter, includeProvenance bool) (*model.Aggregate, error) {
+	query := viewQuery(filter, includeProvenance)
+	var result aggregateJson
+	if _, err := c.doJson(ctx, http.MethodGet, c.url(query, "aggregates", string(domain), string(aggregate)), nil, &result, nil); err != nil {
+		return nil, notFoundAsNil(err)
+	}
+	return result.model(), nil
+}
+
+// Blocks until the aggregate has more than the given number of
+// versions, and gives it; gives nil if the context ends first.
+func (c *Client) WaitForAggregate(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey, version int) (*model.Aggregate, error) {
+	query := url.Values{
+		"waitForVersion": {strconv.Itoa(version)},
+		"timeout":        {DefaultWaitTimeout.String()},
+	}
+	target := c.url(query, "aggregates", string(domain), string(aggregate))
+	for {
+		var result aggregateJson
+		status, err := c.doJson(ctx, http.MethodGet, target, nil, &result, nil)
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if status == http.StatusOK {
+			return result.model(), nil
+		}
+	}
+}
+
+func viewQuery(filter model.ProvenanceFilter, includeProvenance bool) url.Values {
+	query := make(url.Values)
+	if includeProvenance {
+		query.Set("provenance", "true")
+	}
+	for name, value := range map[string]string{
+		"principal":  filter.Principal,
+		"publisher":  filter.Publisher,
+		"remoteAddr": filter.RemoteAddr,
+		"userAgent":  filter.UserAgent,
+		"requestId":  filter.RequestID,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	return query
+}
@@ -0,0 +1,378 @@
+package client
+
+import (
+	"context"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"github.com/ethanrowe/botlnek/pkg/rest"
+	"github.com/ethanrowe/botlnek/pkg/store/inmemory"
+	"github.com/ethanrowe/botlnek/pkg/util"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testServer(wrap func(http.Handler) http.Handler) (*httptest.Server, *Client, func()) {
+	store := inmemory.NewInMemoryStore()
+	app := &rest.RestApplication{
+		DomainWriter:               store,
+		DomainReader:               store,
+		DomainLister:               store,
+		AggregateWriter:            store,
+		ConditionalAggregateWriter: store,
+		AttributedAggregateWriter:  store,
+		AggregateReader:            store,
+		AggregateWaiter:            store,
+		ChangeFeedReader:           store,
+		SourceSearcher:             store,
+		AggregateLister:            store,
+		EventSource:                store,
+	}
+	var h http.Handler = app.Handler()
+	if wrap != nil {
+		h = wrap(h)
+	}
+	server := httptest.NewServer(h)
+	c := New(server.URL)
+	c.Backoff = time.Millisecond
+	return server, c, func() {
+		app.Shutdown()
+		server.Close()
+		store.Stop()
+	}
+}
+
+func testSource(key string) model.Source {
+	return model.Source{Keys: map[string]string{"k": key}, Attrs: map[string]string{"a": "b"}}
+}
+
+func TestClientDomains(t *testing.T) {
+	_, c, stop := testServer(nil)
+	defer stop()
+	ctx := context.Background()
+
+	domain := model.Domain{Key: "a/b", Attrs: util.NewStringKVPairs(map[string]string{"x": "y"})}
+	created, isNew, err := c.CreateDomain(ctx, domain)
+	if err != nil || !isNew || !created.Equals(domain) {
+		t.Fatalf("Unexpected creation: %v, %v, %s", created, isNew, err)
+	}
+	created, isNew, err = c.CreateDomain(ctx, model.Domain{Key: "a/b"})
+	if err != nil || isNew || !created.Equals(domain) {
+		t.Fatalf("Unexpected duplicate creation: %v, %v, %s", created, isNew, err)
+	}
+
+	got, err := c.GetDomain(ctx, "a/b")
+	if err != nil || got == nil || !got.Equals(domain) {
+		t.Fatalf("Unexpected domain: %v, %s", got, err)
+	}
+	got, err = c.GetDomain(ctx, "missing")
+	if err != nil || got != nil {
+		t.Fatalf("Expected nil for a missing domain; got %v, %s", got, err)
+	}
+
+	keys, err := c.ListDomains(ctx)
+	if err != nil || keys == nil {
+		t.Fatalf("Unexpected domain list: %v, %s", keys, err)
+	}
+
+	_, _, err = c.CreateDomain(ctx, model.Domain{})
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusBadRequest || model.CodeOf(err) != model.CodeInvalid {
+		t.Fatalf("Expected an invalid error; got %#v", err)
+	}
+
+	// Sources posted to a domain with a key rule find their aggregate.
+	rule := model.KeyRule{TimeKey: "asof", Truncate: "24h", Layout: "20060102"}
+	if created, _, err := c.CreateDomain(ctx, model.Domain{Key: "ruled", KeyRule: rule}); err != nil || created.KeyRule != rule {
+		t.Fatalf("Unexpected creation: %v, %s", created, err)
+	}
+	source := model.Source{Keys: map[string]string{"asof": "2019-07-10T11:28:10Z"}}
+	receipts, err := c.AppendDomainSource(ctx, "ruled", "t", source)
+	if err != nil || len(receipts) != 1 || receipts[0].Aggregate != "20190710" || !receipts[0].New {
+		t.Fatalf("Unexpected receipts %v, %s", receipts, err)
+	}
+	// Or in the aggregates given.
+	receipts, err = c.AppendDomainSource(ctx, "ruled", "t", source, "20190710", "other")
+	if err != nil || len(receipts) != 2 || receipts[0].New || receipts[1].Aggregate != "other" || !receipts[1].New {
+		t.Fatalf("Unexpected receipts %v, %s", receipts, err)
+	}
+}
+
+func TestClientAggregates(t *testing.T) {
+	_, c, stop := testServer(nil)
+	defer stop()
+	c.Publisher = "tester"
+	ctx := context.Background()
+	if _, _, err := c.CreateDomain(ctx, model.Domain{Key: "d"}); err != nil {
+		t.Fatalf("Failed to create domain: %s", err)
+	}
+
+	receipt, err := c.AppendSource(ctx, "d", "p", "t", testSource("one"))
+	if err != nil || !receipt.New || receipt.VersionIdx != 0 || receipt.KeyHash != testSource("one").KeyHash() {
+		t.Fatalf("Unexpected receipt: %#v, %s", receipt, err)
+	}
+	again, err := c.AppendSource(ctx, "d", "p", "t", testSource("one"))
+	if err != nil || again.New || again.ClockEntry.SeqNum != receipt.ClockEntry.SeqNum {
+		t.Fatalf("Unexpected duplicate receipt: %#v, %s", again, err)
+	}
+
+	_, err = c.AppendSourceAtVersion(ctx, "d", "p", "t", testSource("two"), 0)
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusPreconditionFailed || model.CodeOf(err) != model.CodePreconditionFailed {
+		t.Fatalf("Expected a precondition failure; got %#v", err)
+	}
+	second, err := c.AppendSourceAtVersion(ctx, "d", "p", "t", testSource("two"), 1)
+	if err != nil || !second.New || second.VersionIdx != 1 {
+		t.Fatalf("Unexpected conditional receipt: %#v, %s", second, err)
+	}
+
+	aggregate, err := c.GetAggregate(ctx, "d", "p")
+	if err != nil || aggregate == nil || len(aggregate.Log) != 2 || len(aggregate.Sources["t"]) != 2 {
+		t.Fatalf("Unexpected aggregate: %#v, %s", aggregate, err)
+	}
+	entry := aggregate.Log[0]
+	if entry.SeqNum.Less(entry.SeqNum, aggregate.Log[1].SeqNum) != true || entry.ChangeSeq != 1 {
+		t.Fatalf("Unexpected clock entries: %#v", aggregate.Log)
+	}
+	if aggregate.Sources["t"][0].Provenance != nil {
+		t.Fatalf("Provenance given without being asked for")
+	}
+
+	view, err := c.GetAggregateView(ctx, "d", "p", model.ProvenanceFilter{Publisher: "tester"}, true)
+	if err != nil || len(view.Sources["t"]) != 2 || view.Sources["t"][0].Provenance.Publisher != "tester" {
+		t.Fatalf("Unexpected aggregate view: %#v, %s", view, err)
+	}
+
+	missing, err := c.GetAggregate(ctx, "d", "missing")
+	if err != nil || missing != nil {
+		t.Fatalf("Expected nil for a missing aggregate; got %v, %s", missing, err)
+	}
+
+	changes, next, err := c.GetChanges(ctx, "d", 0, 1)
+	if err != nil || len(changes) != 1 || next != 1 || changes[0].AggregateKey != "p" {
+		t.Fatalf("Unexpected changes: %v, %s, %s", changes, next, err)
+	}
+	changes, next, err = c.GetChanges(ctx, "d", next, 0)
+	if err != nil || len(changes) != 1 || next != 2 {
+		t.Fatalf("Unexpected changes: %v, %s, %s", changes, next, err)
+	}
+
+	query := model.SourceQuery{Keys: map[string]string{"k": "two"}, Attrs: map[string]string{"a": "b"}, Token: "t"}
+	matches, next, err := c.SearchSources(ctx, "d", query, true, 0, 0)
+	if err != nil || len(matches) != 1 || next != 2 || matches[0].Aggregate != "p" || matches[0].VersionIdx != 1 || matches[0].Provenance == nil {
+		t.Fatalf("Unexpected matches: %#v, %s, %s", matches, next, err)
+	}
+	matches, next, err = c.SearchSources(ctx, "d", query, false, next, 0)
+	if err != nil || len(matches) != 0 || next != 2 {
+		t.Fatalf("Unexpected matches: %#v, %s, %s", matches, next, err)
+	}
+	query.Filter = `version == 1`
+	if matches, _, err = c.SearchSources(ctx, "d", query, false, 0, 0); err != nil || len(matches) != 0 {
+		t.Fatalf("Unexpected filtered matches: %#v, %s", matches, err)
+	}
+
+	c.AppendSource(ctx, "d", "q", "t", testSource("one"))
+	keys, after, err := c.ListAggregates(ctx, "d", "", "", 1)
+	if err != nil || len(keys) != 1 || keys[0] != "p" || after != "p" {
+		t.Fatalf("Unexpected aggregates: %v, %s, %s", keys, after, err)
+	}
+	keys, after, err = c.ListAggregates(ctx, "d", "", after, 0)
+	if err != nil || len(keys) != 1 || keys[0] != "q" || after != "q" {
+		t.Fatalf("Unexpected aggregates: %v, %s, %s", keys, after, err)
+	}
+	keys, _, err = c.ListAggregates(ctx, "d", `version == 1`, "", 0)
+	if err != nil || len(keys) != 1 || keys[0] != "q" {
+		t.Fatalf("Unexpected filtered aggregates: %v, %s", keys, err)
+	}
+	if _, _, err = c.ListAggregates(ctx, "d", `version`, "", 0); model.CodeOf(err) != model.CodeInvalid {
+		t.Fatalf("Expected an invalid filter to be refused; got %v", err)
+	}
+}
+
+func TestClientWaitForAggregate(t *testing.T) {
+	_, c, stop := testServer(nil)
+	defer stop()
+	ctx := context.Background()
+	c.CreateDomain(ctx, model.Domain{Key: "d"})
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.AppendSource(ctx, "d", "p", "t", testSource("one"))
+	}()
+	aggregate, err := c.WaitForAggregate(ctx, "d", "p", 0)
+	if err != nil || aggregate == nil || len(aggregate.Log) != 1 {
+		t.Fatalf("Unexpected aggregate: %#v, %s", aggregate, err)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	aggregate, err = c.WaitForAggregate(short, "d", "p", 1)
+	if err != nil || aggregate != nil {
+		t.Fatalf("Expected nil once the context ends; got %#v, %s", aggregate, err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var failures, drops, attempts int32
+	_, c, stop := testServer(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			if atomic.AddInt32(&drops, -1) >= 0 {
+				// The request lands, but its response is lost.
+				h.ServeHTTP(httptest.NewRecorder(), r)
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	defer stop()
+	ctx := context.Background()
+
+	atomic.StoreInt32(&failures, 2)
+	if _, _, err := c.CreateDomain(ctx, model.Domain{Key: "d"}); err != nil {
+		t.Fatalf("Expected success after retries; got %s", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("Expected 3 attempts; got %d", attempts)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&failures, 10)
+	_, err := c.GetDomain(ctx, "d")
+	if model.CodeOf(err) != model.CodeUnavailable || attempts != DefaultMaxRetries+1 {
+		t.Fatalf("Expected to give up after %d attempts; got %d and %#v", DefaultMaxRetries+1, attempts, err)
+	}
+
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&failures, 0)
+	if _, err := c.AppendSourceAtVersion(ctx, "d", "p", "t", testSource("one"), 5); model.CodeOf(err) != model.CodePreconditionFailed || attempts != 1 {
+		t.Fatalf("Expected a single attempt for a client error; got %d and %#v", attempts, err)
+	}
+
+	// A conditional append whose response is lost moves the aggregate
+	// past the version its retry expects, but it did land; the client
+	// reads the aggregate to find it.
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&drops, 1)
+	receipt, err := c.AppendSourceAtVersion(ctx, "d", "p", "t", testSource("one"), 0)
+	if err != nil || receipt == nil || receipt.VersionIdx != 0 || receipt.KeyHash != testSource("one").KeyHash() || attempts != 3 {
+		t.Fatalf("Expected the lost append's receipt after a retry; got %d attempts and %+v, %v", attempts, receipt, err)
+	}
+
+	// A retried conditional append that never landed still fails.
+	atomic.StoreInt32(&attempts, 0)
+	atomic.StoreInt32(&failures, 1)
+	if _, err := c.AppendSourceAtVersion(ctx, "d", "p", "t", testSource("two"), 0); model.CodeOf(err) != model.CodePreconditionFailed || attempts != 3 {
+		t.Fatalf("Expected a precondition failure after a retry; got %d attempts and %#v", attempts, err)
+	}
+}
+
+func TestSubscription(t *testing.T) {
+	server, c, stop := testServer(nil)
+	defer stop()
+	ctx := context.Background()
+	c.CreateDomain(ctx, model.Domain{Key: "d"})
+	c.CreateDomain(ctx, model.Domain{Key: "other"})
+	c.AppendSource(ctx, "d", "before", "t", testSource("one"))
+
+	sub := c.Subscribe(ctx, SubscribeOptions{
+		Domains: []model.DomainKey{"d"},
+		Resume:  map[model.DomainKey]model.ChangeSeq{"d": 0},
+	})
+	messages := make(chan model.AggregateMessage)
+	go func() {
+		defer close(messages)
+		for sub.Next() {
+			messages <- sub.Message()
+		}
+	}()
+	next := func() model.AggregateMessage {
+		select {
+		case message := <-messages:
+			return message
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a message")
+		}
+		return model.AggregateMessage{}
+	}
+
+	// Caught up from the change feed
+	if message := next(); message.DomainKey != "d" || message.Aggregate.Key != "before" {
+		t.Fatalf("Unexpected catch-up message: %#v", message)
+	}
+
+	c.AppendSource(ctx, "other", "p", "t", testSource("one"))
+	c.AppendSource(ctx, "d", "during", "t", testSource("one"))
+	if message := next(); message.Aggregate.Key != "during" || len(message.Aggregate.Log) != 1 {
+		t.Fatalf("Unexpected message: %#v", message)
+	}
+
+	// Whatever happens while disconnected is caught up on reconnecting.
+	server.CloseClientConnections()
+	c.AppendSource(ctx, "d", "after", "t", testSource("one"))
+	if message := next(); message.Aggregate.Key != "after" {
+		t.Fatalf("Unexpected message after reconnecting: %#v", message)
+	}
+
+	sub.Close()
+	for range messages {
+	}
+	if err := sub.Err(); err != nil {
+		t.Fatalf("Expected no error once closed; got %s", err)
+	}
+	if positions := sub.Positions(); positions["d"] != 3 || len(positions) != 1 {
+		t.Fatalf("Unexpected positions: %v", positions)
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	_, c, stop := testServer(nil)
+	defer stop()
+	ctx := context.Background()
+	c.CreateDomain(ctx, model.Domain{Key: "d"})
+	c.AppendSource(ctx, "d", "skipped", "t", testSource("two"))
+	c.AppendSource(ctx, "d", "before", "t", testSource("one"))
+
+	sub := c.Subscribe(ctx, SubscribeOptions{
+		Resume: map[model.DomainKey]model.ChangeSeq{"d": 0},
+		Filter: `any("t", key.k == "one")`,
+	})
+	defer sub.Close()
+	messages := make(chan model.AggregateMessage)
+	go func() {
+		defer close(messages)
+		for sub.Next() {
+			messages <- sub.Message()
+		}
+	}()
+	next := func() model.AggregateMessage {
+		select {
+		case message := <-messages:
+			return message
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for a message")
+		}
+		return model.AggregateMessage{}
+	}
+
+	// The filter applies to what's caught up on, and to the stream.
+	if message := next(); message.Aggregate.Key != "before" {
+		t.Fatalf("Unexpected catch-up message: %#v", message)
+	}
+	c.AppendSource(ctx, "d", "skipped", "t", testSource("three"))
+	c.AppendSource(ctx, "d", "during", "t", testSource("one"))
+	if message := next(); message.Aggregate.Key != "during" {
+		t.Fatalf("Unexpected message: %#v", message)
+	}
+
+	invalid := c.Subscribe(ctx, SubscribeOptions{Filter: `count("t")`})
+	defer invalid.Close()
+	if invalid.Next() || model.CodeOf(invalid.Err()) != model.CodeInvalid {
+		t.Fatalf("Expected an invalid filter to end the subscription; got %v", invalid.Err())
+	}
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"time"
+)
+
+// A clock entry's sequence number as the server renders it.  The
+// server's counters are store-specific, but render as fixed-width
+// strings that order as the counters do.
+type Counter string
+
+func (c Counter) Cmp(a, b model.Counter) int {
+	as, bs := a.(Counter), b.(Counter)
+	if as < bs {
+		return -1
+	} else if as > bs {
+		return 1
+	}
+	return 0
+}
+
+func (c Counter) Less(a, b model.Counter) bool {
+	return a.(Counter) < b.(Counter)
+}
+
+// The model's clock entries hold their sequence numbers as an
+// interface, so decoding goes through these.
+type clockEntryJson struct {
+	SeqNum      Counter
+	Approximate time.Time
+	ChangeSeq   model.ChangeSeq
+}
+
+func (e clockEntryJson) model() model.ClockEntry {
+	return model.ClockEntry{SeqNum: e.SeqNum, Approximate: e.Approximate, ChangeSeq: e.ChangeSeq}
+}
+
+type aggregateJson struct {
+	Key     model.AggregateKey
+	Attrs   map[string]string
+	Log     []clockEntryJson
+	Sources model.SourceLogMap
+}
+
+func (a aggregateJson) model() *model.Aggregate {
+	log := make([]model.ClockEntry, len(a.Log))
+	for i, entry := range a.Log {
+		log[i] = entry.model()
+	}
+	return &model.Aggregate{Key: a.Key, Attrs: a.Attrs, Log: log, Sources: a.Sources}
+}
+
+type receiptJson struct {
+	Domain     model.DomainKey
+	Aggregate  model.AggregateKey
+	Token      string
+	KeyHash    string
+	VersionIdx int
+	ClockEntry clockEntryJson
+	New        bool
+}
+
+func (r receiptJson) model() *model.SourceReceipt {
+	return &model.SourceReceipt{
+		Domain:     r.Domain,
+		Aggregate:  r.Aggregate,
+		Token:      r.Token,
+		KeyHash:    r.KeyHash,
+		VersionIdx: r.VersionIdx,
+		ClockEntry: r.ClockEntry.model(),
+		New:        r.New,
+	}
+}
+
+// A line of the event stream: an aggregate message, or
+// informational.
+type eventJson struct {
+	DomainKey *model.DomainKey
+	Aggregate aggregateJson
+	Info      string `json:"info"`
+}
+
+// Decodes an aggregate as the API renders it.
+func DecodeAggregate(data []byte) (*model.Aggregate, error) {
+	var a aggregateJson
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, err
+	}
+	return a.model(), nil
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/filter"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+// Which events a subscription delivers, and where it resumes from.
+type SubscribeOptions struct {
+	// Only events about these domains are delivered, if given.
+	Domains []model.DomainKey
+	// For each domain, the change sequence number of the last event
+	// already handled; the subscription first catches up on changes
+	// since then from the domain's change feed.
+	Resume map[model.DomainKey]model.ChangeSeq
+	// Only events about aggregates meeting this expression of
+	// package filter are delivered, if given.  The server applies it
+	// to the stream, and the subscription to what it catches up on.
+	Filter string
+}
+
+// Iterates over the aggregate messages of the server's event stream:
+//
+//	sub := c.Subscribe(ctx, opts)
+//	defer sub.Close()
+//	for sub.Next() {
+//		handle(sub.Message())
+//	}
+//	if err := sub.Err(); err != nil { ... }
+//
+// The subscription reconnects with backoff whenever the stream ends
+// or fails, and catches up on what it missed from the change feeds of
+// the domains it has seen, as far as the server supports them.  An
+// aggregate may be delivered more than once around a reconnect, but
+// each delivery is the aggregate as it stood at some version at
+// least as recent as the last.  Only Close is safe to call from
+// other goroutines.
+type Subscription struct {
+	client  *Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	domains map[model.DomainKey]bool
+	filter  *filter.Filter
+	// The last change handled, per domain
+	positions map[model.DomainKey]model.ChangeSeq
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	pending   []pendingMessage
+	message   model.AggregateMessage
+	failures  int
+	err       error
+	closed    int32
+}
+
+// A message caught up from a change feed, and the position in its
+// domain's feed that delivering it brings the subscription to.
+type pendingMessage struct {
+	message  model.AggregateMessage
+	position model.ChangeSeq
+}
+
+func (c *Client) Subscribe(ctx context.Context, opts SubscribeOptions) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Subscription{
+		client:    c,
+		ctx:       ctx,
+		cancel:    cancel,
+		positions: make(map[model.DomainKey]model.ChangeSeq),
+	}
+	if len(opts.Domains) > 0 {
+		s.domains = make(map[model.DomainKey]bool, len(opts.Domains))
+		for _, domain := range opts.Domains {
+			s.domains[domain] = true
+		}
+	}
+	for domain, seq := range opts.Resume {
+		if s.wants(domain) {
+			s.positions[domain] = seq
+		}
+	}
+	if opts.Filter != "" {
+		// An invalid filter ends the subscription before it starts.
+		s.filter, s.err = filter.Parse(opts.Filter)
+	}
+	return s
+}
+
+func (s *Subscription) wants(domain model.DomainKey) bool {
+	return s.domains == nil || s.domains[domain]
+}
+
+// Waits for the next message; false once the subscription is closed,
+// its context ends, or it fails for good.
+func (s *Subscription) Next() bool {
+	for {
+		if len(s.pending) > 0 {
+			next := s.pending[0]
+			s.pending = s.pending[1:]
+			if next.position > s.positions[next.message.DomainKey] {
+				s.positions[next.message.DomainKey] = next.position
+			}
+			if s.filter != nil && !s.filter.Matches(next.message.Aggregate) {
+				continue
+			}
+			s.message = next.message
+			return true
+		}
+		if s.err != nil {
+			return false
+		}
+		if err := s.ctx.Err(); err != nil {
+			s.fail(err)
+			continue
+		}
+		if s.body == nil {
+			s.connect()
+			continue
+		}
+		line, err := s.reader.ReadBytes('\n')
+		if message, ok := s.parse(line); ok && s.accept(message) {
+			s.message = message
+			return true
+		}
+		if err != nil {
+			s.disconnect()
+		}
+	}
+}
+
+// The message Next waited for.
+func (s *Subscription) Message() model.AggregateMessage {
+	return s.message
+}
+
+// Why Next gave false: the context's error, or the error that ended
+// the subscription; nil if the subscription was closed.
+func (s *Subscription) Err() error {
+	if atomic.LoadInt32(&s.closed) != 0 && s.err == context.Canceled {
+		return nil
+	}
+	return s.err
+}
+
+// For each domain seen, the change sequence number of the last event
+// delivered; suitable for SubscribeOptions.Resume.
+func (s *Subscription) Positions() map[model.DomainKey]model.ChangeSeq {
+	positions := make(map[model.DomainKey]model.ChangeSeq, len(s.positions))
+	for domain, seq := range s.positions {
+		positions[domain] = seq
+	}
+	return positions
+}
+
+// Ends the subscription; a Next in progress gives false.
+func (s *Subscription) Close() {
+	atomic.StoreInt32(&s.closed, 1)
+	s.cancel()
+}
+
+func (s *Subscription) disconnect() {
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+		s.reader = nil
+	}
+}
+
+// Opens the stream and catches up, or sets the subscription's error
+// if it can't be done.  Failures that may pass are retried after a
+// backoff.
+func (s *Subscription) connect() {
+	if s.failures > 0 {
+		if err := sleep(s.ctx, s.client.backoff(s.failures)); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+	err := s.open()
+	if err == nil {
+		err = s.catchUp()
+	}
+	switch {
+	case err == nil:
+		s.failures = 0
+	case s.ctx.Err() != nil:
+		s.fail(s.ctx.Err())
+	case Retryable(err):
+		s.disconnect()
+		s.failures++
+	default:
+		s.fail(err)
+	}
+}
+
+func (s *Subscription) fail(err error) {
+	s.disconnect()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *Subscription) open() error {
+	var query url.Values
+	if s.filter != nil {
+		query = url.Values{"filter": {s.filter.String()}}
+	}
+	req, err := s.client.newRequest(s.ctx, http.MethodGet, s.client.url(query, "events"), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return errorFromResponse(resp)
+	}
+	s.body = resp.Body
+	s.reader = bufio.NewReader(resp.Body)
+	return nil
+}
+
+// Queues the aggregates changed since the last event seen from each
+// domain, as they stand now.  Each brings the domain's position up to
+// just before the next one's first change, so the position never
+// passes a change whose aggregate is yet to be delivered.  Domains
+// whose change feeds can't be read are skipped; their missed events
+// are lost.
+func (s *Subscription) catchUp() error {
+	for domain, after := range s.positions {
+		for {
+			changes, next, err := s.client.GetChanges(s.ctx, domain, after, 0)
+			switch model.CodeOf(err) {
+			case model.CodeUnsupported, model.CodeNotFound, model.CodeForbidden:
+				changes = nil
+			default:
+				if err != nil {
+					return err
+				}
+			}
+			if len(changes) == 0 {
+				break
+			}
+			first := make([]model.Change, 0, len(changes))
+			seen := make(map[model.AggregateKey]bool)
+			for _, change := range changes {
+				if !seen[change.AggregateKey] {
+					seen[change.AggregateKey] = true
+					first = append(first, change)
+				}
+			}
+			for i, change := range first {
+				aggregate, err := s.client.GetAggregate(s.ctx, domain, change.AggregateKey)
+				if err != nil {
+					return err
+				}
+				position := next
+				if i+1 < len(first) {
+					position = first[i+1].Seq - 1
+				}
+				if aggregate != nil {
+					s.pending = append(s.pending, pendingMessage{model.AggregateMessage{DomainKey: domain, Aggregate: *aggregate}, position})
+				}
+			}
+			after = next
+		}
+	}
+	return nil
+}
+
+func (s *Subscription) parse(line []byte) (model.AggregateMessage, bool) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return model.AggregateMessage{}, false
+	}
+	var event eventJson
+	if err := json.Unmarshal(line, &event); err != nil || event.DomainKey == nil {
+		// Informational, or not for us to understand
+		return model.AggregateMessage{}, false
+	}
+	return model.AggregateMessage{DomainKey: *event.DomainKey, Aggregate: *event.Aggregate.model()}, true
+}
+
+// Whether the message is wanted and news, noting its position if so.
+func (s *Subscription) accept(message model.AggregateMessage) bool {
+	if !s.wants(message.DomainKey) {
+		return false
+	}
+	log := message.Aggregate.Log
+	if len(log) == 0 {
+		return true
+	}
+	seq := log[len(log)-1].ChangeSeq
+	if position, ok := s.positions[message.DomainKey]; ok && seq != 0 && seq <= position {
+		return false
+	}
+	if seq > s.positions[message.DomainKey] {
+		s.positions[message.DomainKey] = seq
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+// Package filter implements a small expression language for selecting
+// aggregates, as by the filter parameters of the API's list and search
+// routes and its event stream.  A filter is a condition over an
+// aggregate:
+//
+//	count("A") >= 2 and any("B", attr.status == "ok")
+//	version > 3 or since(modified) > duration("1h")
+//	any("*", key.asof == "2019-07-10T11:28:10Z" and time >= time("2019-07-10T12:00:00Z"))
+//
+// Conditions combine with and, or, and not, and parentheses.  Values
+// are numbers, "strings" (with Go escapes), times, and durations, and
+// compare with == != < <= > >=; each side must be of the same type.
+//
+// Of the aggregate, the names are:
+//
+//	aggregate   its key
+//	version     its version, the number of versions appended to it
+//	created     the time of its first version
+//	modified    the time of its latest version
+//	attr.NAME   its attribute NAME
+//
+// The functions any(TOKEN, COND) and all(TOKEN, COND) tell whether any
+// or all of the sources registered under the token meet the condition,
+// and count(TOKEN) and count(TOKEN, COND) count those sources, or those
+// meeting the condition.  The token "*" is every token.  Within the
+// condition, the names are of the source:
+//
+//	key.NAME    its key NAME
+//	attr.NAME   its attribute NAME
+//	token       the token it's registered under
+//	version     the version that registered it
+//	time        the time of that version
+//
+// with aggregate as before.  Names that aren't made of letters, digits,
+// underscores, dots, and dashes may be given as key["NAME"] and
+// attr["NAME"].  The other functions are:
+//
+//	time(STRING)        the RFC 3339 time
+//	duration(STRING)    the duration, like "90m"
+//	now()               the present time
+//	since(TIME)         the duration from the time to now
+//	glob(STRING, PATTERN)  whether the string matches the glob pattern
+//	exists(VALUE)       whether the value is present
+//
+// A key or attribute the source or aggregate lacks, or a time or
+// duration that doesn't parse, is missing.  Comparisons and functions
+// given a missing value are false (or missing), but for exists.
+package filter
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"time"
+)
+
+// A parsed filter expression.
+type Filter struct {
+	source string
+	eval   func(*env) value
+}
+
+// Parses the expression, giving a CodeInvalid error, with the offset
+// of the problem in its details, if it isn't a valid condition.
+func Parse(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, errorAt(tok.pos, "unexpected %q", tok.text)
+	}
+	if root.kind != kindBool {
+		return nil, errorAt(0, "a filter must be a condition; got a %s", root.kind)
+	}
+	return &Filter{source: expr, eval: root.eval}, nil
+}
+
+// The expression as given.
+func (f *Filter) String() string {
+	return f.source
+}
+
+// Whether the aggregate meets the filter now.
+func (f *Filter) Matches(a model.Aggregate) bool {
+	return f.MatchesAt(a, time.Now())
+}
+
+// Whether the aggregate meets the filter at the given time.
+func (f *Filter) MatchesAt(a model.Aggregate, now time.Time) bool {
+	return f.eval(&env{aggr: &a, now: now}).b
+}
+
+// What an expression is evaluated against.
+type env struct {
+	aggr *model.Aggregate
+	now  time.Time
+	// Within any, all, and count, the source in question
+	token string
+	log   *model.SourceLog
+}
+
+func errorAt(pos int, format string, args ...interface{}) error {
+	return model.Errorf(model.CodeInvalid, "Invalid filter at offset %d: "+format, append([]interface{}{pos}, args...)...).With("Offset", pos)
+}
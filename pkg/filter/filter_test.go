@@ -0,0 +1,124 @@
+package filter
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"testing"
+	"time"
+)
+
+func testAggregate() model.Aggregate {
+	at := func(s string) model.ClockEntry {
+		t, _ := time.Parse(time.RFC3339, s)
+		return model.ClockEntry{Approximate: t}
+	}
+	source := func(idx int, keys, attrs map[string]string) model.SourceLog {
+		return model.SourceLog{VersionIdx: idx, Source: model.Source{Keys: keys, Attrs: attrs}}
+	}
+	return model.Aggregate{
+		Key:   "20190710",
+		Attrs: map[string]string{"owner": "ops"},
+		Log:   []model.ClockEntry{at("2019-07-10T11:00:00Z"), at("2019-07-10T12:00:00Z"), at("2019-07-10T13:00:00Z")},
+		Sources: model.SourceLogMap{
+			"A": {
+				source(0, map[string]string{"asof": "2019-07-10T11:28:10Z"}, map[string]string{"status": "failed"}),
+				source(2, map[string]string{"asof": "2019-07-10T12:28:10Z"}, map[string]string{"status": "ok"}),
+			},
+			"B": {
+				source(1, map[string]string{"asof": "2019-07-10T11:28:10Z", "run:id": "7"}, map[string]string{"status": "ok"}),
+			},
+		},
+	}
+}
+
+func TestMatches(t *testing.T) {
+	aggr := testAggregate()
+	now, _ := time.Parse(time.RFC3339, "2019-07-10T14:30:00Z")
+	for expr, expected := range map[string]bool{
+		`count("A") >= 2 and any("B", attr.status == "ok")`:                                true,
+		`count("A") >= 3 or any("B", attr.status == "failed")`:                             false,
+		`count("A", attr.status == "ok") == 1`:                                             true,
+		`count("*") == 3 and count("C") == 0`:                                              true,
+		`all("A", attr.status == "ok")`:                                                    false,
+		`all("*", exists(key.asof))`:                                                       true,
+		`all("C", false)`:                                                                  true,
+		`any("*", token == "B" and version == 2 and time == time("2019-07-10T12:00:00Z"))`: true,
+		`any("*", key.missing == "x" or key.missing != "x")`:                               false,
+		`any("*", not exists(key.missing))`:                                                true,
+		`any("B", key["run:id"] == "7")`:                                                   true,
+		`version == 3 and version > 2.5 and aggregate == "20190710"`:                       true,
+		`attr.owner == "ops" and not (attr.owner < "ops")`:                                 true,
+		`attr.missing == ""`:                                                               false,
+		`glob(aggregate, "2019*") and not glob(aggregate, "2020*")`:                        true,
+		`modified == time("2019-07-10T13:00:00Z") and created < modified`:                  true,
+		`since(modified) > duration("1h") and since(modified) < duration("2h")`:            true,
+		`now() > modified`:                                                                 true,
+		`any("A", time(key.asof) > time("2019-07-10T12:00:00Z"))`:                          true,
+		`any("A", time(attr.status) > time("2019-07-10T12:00:00Z"))`:                       false,
+		`any("A", any(token, version == 1))`:                                               true,
+		`(true == (1 < 2)) != false`:                                                       true,
+	} {
+		f, err := Parse(expr)
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", expr, err)
+			continue
+		}
+		if matched := f.MatchesAt(aggr, now); matched != expected {
+			t.Errorf("%s: expected %v; got %v", expr, expected, matched)
+		}
+		if f.String() != expr {
+			t.Errorf("Expected %s; got %s", expr, f.String())
+		}
+	}
+
+	// An aggregate without versions has no times.
+	f, _ := Parse(`not exists(modified) and version == 0 and not any("*", true)`)
+	if !f.Matches(model.Aggregate{Key: "empty"}) {
+		t.Errorf("Expected an empty aggregate to match %s", f)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for expr, offset := range map[string]int{
+		``:                                0,
+		`count("A")`:                      0,
+		`count("A") >= "2"`:               11,
+		`count("A") >=`:                   13,
+		`count("A") = 2`:                  11,
+		`key.asof == "x"`:                 0,
+		`any("A")`:                        7,
+		`any("A", key.asof)`:              9,
+		`any(1, true)`:                    4,
+		`all("A", true`:                   13,
+		`nope()`:                          0,
+		`nope == 1`:                       0,
+		`attr == "x"`:                     0,
+		`version.x == 1`:                  0,
+		`time("yesterday") < now()`:       5,
+		`duration("soon") > since(now())`: 9,
+		`glob(aggregate) `:                0,
+		`true and 1`:                      9,
+		`not "x"`:                         4,
+		`"unterminated`:                   0,
+		`1 < 2 < 3`:                       6,
+		`true # false`:                    5,
+		`true < false`:                    5,
+		`any("*", key[1] == "x")`:         13,
+	} {
+		_, err := Parse(expr)
+		if model.CodeOf(err) != model.CodeInvalid {
+			t.Errorf("%s: expected an invalid error; got %v", expr, err)
+			continue
+		}
+		if actual := err.(*model.Error).Details["Offset"]; actual != offset {
+			t.Errorf("%s: expected offset %d; got %v (%s)", expr, offset, actual, err)
+		}
+	}
+
+	deep := ""
+	for i := 0; i < 100; i++ {
+		deep += "("
+	}
+	if _, err := Parse(deep + "true"); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected deep nesting to be invalid; got %v", err)
+	}
+}
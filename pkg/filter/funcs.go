@@ -0,0 +1,171 @@
+package filter
+
+import (
+	"path"
+	"time"
+)
+
+// A function of values of the given kinds.  Unless any is set, it
+// isn't called with missing values; the result is missing instead.
+type function struct {
+	args   []kind
+	any    bool
+	result kind
+	call   func(e *env, args []value) value
+}
+
+var functions = map[string]function{
+	"time": {args: []kind{kindString}, result: kindTime, call: func(e *env, args []value) value {
+		t, err := time.Parse(time.RFC3339Nano, args[0].s)
+		return value{ok: err == nil, t: t}
+	}},
+	"duration": {args: []kind{kindString}, result: kindDuration, call: func(e *env, args []value) value {
+		d, err := time.ParseDuration(args[0].s)
+		return value{ok: err == nil, d: d}
+	}},
+	"now": {result: kindTime, call: func(e *env, args []value) value {
+		return value{ok: true, t: e.now}
+	}},
+	"since": {args: []kind{kindTime}, result: kindDuration, call: func(e *env, args []value) value {
+		return value{ok: true, d: e.now.Sub(args[0].t)}
+	}},
+	"glob": {args: []kind{kindString, kindString}, result: kindBool, call: func(e *env, args []value) value {
+		matched, _ := path.Match(args[1].s, args[0].s)
+		return boolean(matched)
+	}},
+	"exists": {args: []kind{0}, any: true, result: kindBool, call: func(e *env, args []value) value {
+		return boolean(args[0].ok)
+	}},
+}
+
+// Parses a call's arguments, following its opening parenthesis.
+func (p *parser) parseCall(name token) (expr, error) {
+	switch name.text {
+	case "any", "all", "count":
+		return p.parseQuantifier(name)
+	}
+	f, ok := functions[name.text]
+	if !ok {
+		return expr{}, errorAt(name.pos, "unknown function %q", name.text)
+	}
+	args := make([]expr, 0, len(f.args))
+	for !p.accept(tokPunct, ")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return expr{}, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return arg, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) != len(f.args) {
+		return expr{}, errorAt(name.pos, "%s takes %d arguments; got %d", name.text, len(f.args), len(args))
+	}
+	for i, arg := range args {
+		if !f.any && arg.kind != f.args[i] {
+			return expr{}, errorAt(arg.pos, "%s needs a %s; got a %s", name.text, f.args[i], arg.kind)
+		}
+	}
+	evals := make([]func(*env) value, len(args))
+	for i, arg := range args {
+		evals[i] = arg.eval
+	}
+	call := func(e *env) value {
+		values := make([]value, len(evals))
+		for i, eval := range evals {
+			if values[i] = eval(e); !values[i].ok && !f.any {
+				if f.result == kindBool {
+					return boolean(false)
+				}
+				return missing
+			}
+		}
+		return f.call(e, values)
+	}
+	// Literal times and durations are checked now.
+	if (name.text == "time" || name.text == "duration") && args[0].literal {
+		if v := call(nil); !v.ok {
+			return expr{}, errorAt(args[0].pos, "invalid %s %q", name.text, args[0].eval(nil).s)
+		}
+	}
+	return expr{kind: f.result, pos: name.pos, eval: call}, nil
+}
+
+// Parses any(TOKEN, COND), all(TOKEN, COND), or count(TOKEN[, COND]),
+// whose condition is of each source under the token.
+func (p *parser) parseQuantifier(name token) (expr, error) {
+	token, err := p.parseOr()
+	if err != nil {
+		return token, err
+	}
+	if token.kind != kindString {
+		return token, errorAt(token.pos, "%s needs a token string; got a %s", name.text, token.kind)
+	}
+	var cond func(*env) value
+	if p.accept(tokPunct, ",") {
+		inSource := p.inSource
+		p.inSource = true
+		c, err := p.parseOr()
+		p.inSource = inSource
+		if err != nil {
+			return c, err
+		}
+		if err := p.condition(c, name.text); err != nil {
+			return c, err
+		}
+		cond = c.eval
+	} else if name.text != "count" {
+		return expr{}, errorAt(p.peek().pos, "%s needs a token and a condition", name.text)
+	}
+	if err := p.expect(")"); err != nil {
+		return expr{}, err
+	}
+
+	tokenEval := token.eval
+	// The number of sources under the token meeting the condition,
+	// stopping once stop says so.
+	count := func(e *env, stop func(met, unmet int) bool) (met, unmet int) {
+		tv := tokenEval(e)
+		if !tv.ok {
+			return
+		}
+		for t, logs := range e.aggr.Sources {
+			if tv.s != "*" && tv.s != t {
+				continue
+			}
+			for i := range logs {
+				if cond == nil || cond(&env{aggr: e.aggr, now: e.now, token: t, log: &logs[i]}).b {
+					met++
+				} else {
+					unmet++
+				}
+				if stop(met, unmet) {
+					return
+				}
+			}
+		}
+		return
+	}
+	e := expr{pos: name.pos}
+	switch name.text {
+	case "any":
+		e.kind, e.eval = kindBool, func(e *env) value {
+			met, _ := count(e, func(met, unmet int) bool { return met > 0 })
+			return boolean(met > 0)
+		}
+	case "all":
+		e.kind, e.eval = kindBool, func(e *env) value {
+			_, unmet := count(e, func(met, unmet int) bool { return unmet > 0 })
+			return boolean(unmet == 0)
+		}
+	default:
+		e.kind, e.eval = kindNumber, func(e *env) value {
+			met, _ := count(e, func(int, int) bool { return false })
+			return value{ok: true, n: float64(met)}
+		}
+	}
+	return e, nil
+}
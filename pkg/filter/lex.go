@@ -0,0 +1,98 @@
+package filter
+
+import (
+	"strconv"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	// A name, like count or key.asof
+	tokName
+	// A comparison operator
+	tokOp
+	// One of ( ) , [ ]
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// Byte offset in the expression
+	pos int
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// Splits the expression into tokens, ending with tokEOF.  Names may
+// hold dots and dashes after their first letter, so that key.asof and
+// attr.run-id are single names.
+func lex(src string) ([]token, error) {
+	tokens := make([]token, 0, len(src)/2)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',' || c == '[' || c == ']':
+			tokens = append(tokens, token{tokPunct, string(c), i})
+			i++
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			op := string(c)
+			if i+1 < len(src) && src[i+1] == '=' {
+				op += "="
+			}
+			if op == "=" || op == "!" {
+				return nil, errorAt(i, "unexpected %q; use == or !=", op)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		case c == '"':
+			j := i + 1
+			for j < len(src) && src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, errorAt(i, "unterminated string")
+			}
+			s, err := strconv.Unquote(src[i : j+1])
+			if err != nil {
+				return nil, errorAt(i, "invalid string %s", src[i:j+1])
+			}
+			tokens = append(tokens, token{tokString, s, i})
+			i = j + 1
+		case c == '-' || c == '.' || isDigit(c):
+			j := i + 1
+			for j < len(src) && (isDigit(src[j]) || src[j] == '.') {
+				j++
+			}
+			if _, err := strconv.ParseFloat(src[i:j], 64); err != nil {
+				return nil, errorAt(i, "invalid number %q", src[i:j])
+			}
+			tokens = append(tokens, token{tokNumber, src[i:j], i})
+			i = j
+		case isLetter(c):
+			j := i + 1
+			for j < len(src) && (isLetter(src[j]) || isDigit(src[j]) || src[j] == '.' || src[j] == '-') {
+				j++
+			}
+			tokens = append(tokens, token{tokName, src[i:j], i})
+			i = j
+		default:
+			return nil, errorAt(i, "unexpected %q", c)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
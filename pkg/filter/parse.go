@@ -0,0 +1,351 @@
+package filter
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How deeply expressions may nest.
+const maxDepth = 64
+
+type kind int
+
+const (
+	kindBool kind = iota
+	kindNumber
+	kindString
+	kindTime
+	kindDuration
+)
+
+func (k kind) String() string {
+	return [...]string{"condition", "number", "string", "time", "duration"}[k]
+}
+
+// A value of an expression's kind; ok is false for a missing value.
+// Conditions are never missing, but false instead.
+type value struct {
+	ok bool
+	b  bool
+	n  float64
+	s  string
+	t  time.Time
+	d  time.Duration
+}
+
+var missing = value{}
+
+func boolean(b bool) value {
+	return value{ok: true, b: b}
+}
+
+// A parsed expression, and where it began.
+type expr struct {
+	kind kind
+	eval func(*env) value
+	pos  int
+	// Whether it's a string literal
+	literal bool
+}
+
+type parser struct {
+	tokens []token
+	i      int
+	depth  int
+	// Whether names refer to a source, within any, all, and count
+	inSource bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.i]
+	if tok.kind != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+// Consumes the next token if it's the given punctuation or word.
+func (p *parser) accept(kind tokenKind, text string) bool {
+	if tok := p.peek(); tok.kind == kind && tok.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(tokPunct, text) {
+		tok := p.peek()
+		if tok.kind == tokEOF {
+			return errorAt(tok.pos, "expected %q; got the end", text)
+		}
+		return errorAt(tok.pos, "expected %q; got %q", text, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) condition(e expr, what string) error {
+	if e.kind != kindBool {
+		return errorAt(e.pos, "%s needs a condition; got a %s", what, e.kind)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (expr, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return expr{}, errorAt(p.peek().pos, "nested too deeply")
+	}
+	left, err := p.parseAnd()
+	if err != nil {
+		return left, err
+	}
+	for p.accept(tokName, "or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return right, err
+		}
+		if err := p.condition(left, "or"); err != nil {
+			return left, err
+		}
+		if err := p.condition(right, "or"); err != nil {
+			return right, err
+		}
+		l, r := left.eval, right.eval
+		left = expr{kind: kindBool, pos: left.pos, eval: func(e *env) value {
+			return boolean(l(e).b || r(e).b)
+		}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return left, err
+	}
+	for p.accept(tokName, "and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return right, err
+		}
+		if err := p.condition(left, "and"); err != nil {
+			return left, err
+		}
+		if err := p.condition(right, "and"); err != nil {
+			return right, err
+		}
+		l, r := left.eval, right.eval
+		left = expr{kind: kindBool, pos: left.pos, eval: func(e *env) value {
+			return boolean(l(e).b && r(e).b)
+		}}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	pos := p.peek().pos
+	if !p.accept(tokName, "not") {
+		return p.parseComparison()
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxDepth {
+		return expr{}, errorAt(pos, "nested too deeply")
+	}
+	operand, err := p.parseNot()
+	if err != nil {
+		return operand, err
+	}
+	if err := p.condition(operand, "not"); err != nil {
+		return operand, err
+	}
+	eval := operand.eval
+	return expr{kind: kindBool, pos: pos, eval: func(e *env) value {
+		return boolean(!eval(e).b)
+	}}, nil
+}
+
+func (p *parser) parseComparison() (expr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return left, err
+	}
+	tok := p.peek()
+	if tok.kind != tokOp {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseOperand()
+	if err != nil {
+		return right, err
+	}
+	if left.kind != right.kind {
+		return left, errorAt(tok.pos, "cannot compare a %s with a %s", left.kind, right.kind)
+	}
+	if left.kind == kindBool && tok.text != "==" && tok.text != "!=" {
+		return left, errorAt(tok.pos, "conditions can only be compared with == and !=")
+	}
+	var test func(int) bool
+	switch tok.text {
+	case "==":
+		test = func(c int) bool { return c == 0 }
+	case "!=":
+		test = func(c int) bool { return c != 0 }
+	case "<":
+		test = func(c int) bool { return c < 0 }
+	case "<=":
+		test = func(c int) bool { return c <= 0 }
+	case ">":
+		test = func(c int) bool { return c > 0 }
+	case ">=":
+		test = func(c int) bool { return c >= 0 }
+	}
+	k, l, r := left.kind, left.eval, right.eval
+	return expr{kind: kindBool, pos: left.pos, eval: func(e *env) value {
+		lv, rv := l(e), r(e)
+		if !lv.ok || !rv.ok {
+			return boolean(false)
+		}
+		return boolean(test(compare(k, lv, rv)))
+	}}, nil
+}
+
+func compare(k kind, a, b value) int {
+	switch k {
+	case kindBool:
+		if a.b == b.b {
+			return 0
+		}
+		return 1
+	case kindNumber:
+		return sign(a.n < b.n, a.n > b.n)
+	case kindString:
+		return strings.Compare(a.s, b.s)
+	case kindTime:
+		return sign(a.t.Before(b.t), a.t.After(b.t))
+	default:
+		return sign(a.d < b.d, a.d > b.d)
+	}
+}
+
+func sign(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func (p *parser) parseOperand() (expr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		n, _ := strconv.ParseFloat(tok.text, 64)
+		return expr{kind: kindNumber, pos: tok.pos, eval: func(*env) value { return value{ok: true, n: n} }}, nil
+	case tokString:
+		s := tok.text
+		return expr{kind: kindString, pos: tok.pos, literal: true, eval: func(*env) value { return value{ok: true, s: s} }}, nil
+	case tokName:
+		if p.accept(tokPunct, "(") {
+			return p.parseCall(tok)
+		}
+		return p.parseName(tok)
+	case tokPunct:
+		if tok.text == "(" {
+			inner, err := p.parseOr()
+			if err != nil {
+				return inner, err
+			}
+			return inner, p.expect(")")
+		}
+	case tokEOF:
+		return expr{}, errorAt(tok.pos, "unexpected end")
+	}
+	return expr{}, errorAt(tok.pos, "unexpected %q", tok.text)
+}
+
+func (p *parser) parseName(tok token) (expr, error) {
+	name, field, hasField := tok.text, "", false
+	if i := strings.Index(name, "."); i >= 0 {
+		name, field, hasField = name[:i], name[i+1:], true
+		if field == "" {
+			return expr{}, errorAt(tok.pos, "%s. needs a name", name)
+		}
+	} else if p.accept(tokPunct, "[") {
+		s := p.next()
+		if s.kind != tokString {
+			return expr{}, errorAt(s.pos, "%s[...] needs a string", name)
+		}
+		if err := p.expect("]"); err != nil {
+			return expr{}, err
+		}
+		field, hasField = s.text, true
+	}
+	if hasField != (name == "key" || name == "attr") {
+		if hasField {
+			return expr{}, errorAt(tok.pos, "unknown name %q", tok.text)
+		}
+		return expr{}, errorAt(tok.pos, "%s needs a name, like %s.NAME", name, name)
+	}
+	if !p.inSource && (name == "key" || name == "token" || name == "time") {
+		return expr{}, errorAt(tok.pos, "%s is only known within any, all, and count", name)
+	}
+
+	e := expr{pos: tok.pos}
+	switch name {
+	case "true", "false":
+		b := name == "true"
+		e.kind, e.eval = kindBool, func(*env) value { return boolean(b) }
+	case "key":
+		e.kind, e.eval = kindString, func(e *env) value { return lookup(e.log.Source.Keys, field) }
+	case "attr":
+		e.kind = kindString
+		if p.inSource {
+			e.eval = func(e *env) value { return lookup(e.log.Source.Attrs, field) }
+		} else {
+			e.eval = func(e *env) value { return lookup(e.aggr.Attrs, field) }
+		}
+	case "aggregate":
+		e.kind, e.eval = kindString, func(e *env) value { return value{ok: true, s: string(e.aggr.Key)} }
+	case "token":
+		e.kind, e.eval = kindString, func(e *env) value { return value{ok: true, s: e.token} }
+	case "version":
+		e.kind = kindNumber
+		if p.inSource {
+			e.eval = func(e *env) value { return value{ok: true, n: float64(e.log.VersionIdx + 1)} }
+		} else {
+			e.eval = func(e *env) value { return value{ok: true, n: float64(len(e.aggr.Log))} }
+		}
+	case "time":
+		e.kind, e.eval = kindTime, func(e *env) value { return versionTime(e.aggr, e.log.VersionIdx) }
+	case "created":
+		e.kind, e.eval = kindTime, func(e *env) value { return versionTime(e.aggr, 0) }
+	case "modified":
+		e.kind, e.eval = kindTime, func(e *env) value { return versionTime(e.aggr, len(e.aggr.Log)-1) }
+	default:
+		return e, errorAt(tok.pos, "unknown name %q", name)
+	}
+	return e, nil
+}
+
+func lookup(m map[string]string, name string) value {
+	s, ok := m[name]
+	return value{ok: ok, s: s}
+}
+
+func versionTime(a *model.Aggregate, idx int) value {
+	if idx < 0 || idx >= len(a.Log) {
+		return missing
+	}
+	return value{ok: true, t: a.Log[idx].Approximate}
+}
@@ -0,0 +1,189 @@
+// Leveled, structured logging as logfmt or JSON lines.  Logger
+// methods are no-ops on a nil Logger, so logging can be left out.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return Debug, fmt.Errorf("Unknown log level %q", s)
+}
+
+type Format string
+
+const (
+	Logfmt Format = "logfmt"
+	JSON   Format = "json"
+)
+
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case Logfmt, JSON:
+		return f, nil
+	}
+	return Logfmt, fmt.Errorf("Unknown log format %q", s)
+}
+
+// Each entry is a single line with "ts", "level", and "msg" fields,
+// followed by the logger's fields and then the entry's own.
+type Logger struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	level  Level
+	format Format
+	fields []interface{}
+	now    func() time.Time
+}
+
+func New(out io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out:    out,
+		mutex:  &sync.Mutex{},
+		level:  level,
+		format: format,
+		now:    time.Now,
+	}
+}
+
+// A logger that adds the given key/value pairs to every entry.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	child := *l
+	child.fields = append(append([]interface{}(nil), l.fields...), keyvals...)
+	return &child
+}
+
+// Whether entries at the given level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.Log(Debug, msg, keyvals...)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.Log(Info, msg, keyvals...)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.Log(Warn, msg, keyvals...)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.Log(Error, msg, keyvals...)
+}
+
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	all := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	all = append(all, "ts", l.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	all = append(all, l.fields...)
+	all = append(all, keyvals...)
+	if len(all)%2 != 0 {
+		all = append(all, "(MISSING)")
+	}
+
+	var line []byte
+	if l.format == JSON {
+		line = encodeJSON(all)
+	} else {
+		line = encodeLogfmt(all)
+	}
+	l.mutex.Lock()
+	l.out.Write(line)
+	l.mutex.Unlock()
+}
+
+func stringify(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	case time.Duration:
+		return x.String()
+	}
+	return fmt.Sprint(v)
+}
+
+func encodeLogfmt(keyvals []interface{}) []byte {
+	var buff bytes.Buffer
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buff.WriteByte(' ')
+		}
+		buff.WriteString(stringify(keyvals[i]))
+		buff.WriteByte('=')
+		value := stringify(keyvals[i+1])
+		if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buff.WriteString(value)
+	}
+	buff.WriteByte('\n')
+	return buff.Bytes()
+}
+
+func encodeJSON(keyvals []interface{}) []byte {
+	var buff bytes.Buffer
+	buff.WriteByte('{')
+	for i := 0; i < len(keyvals); i += 2 {
+		if i > 0 {
+			buff.WriteByte(',')
+		}
+		key, _ := json.Marshal(stringify(keyvals[i]))
+		buff.Write(key)
+		buff.WriteByte(':')
+		var value []byte
+		var err error
+		switch v := keyvals[i+1].(type) {
+		case error, fmt.Stringer, time.Duration:
+			value, err = json.Marshal(stringify(v))
+		default:
+			value, err = json.Marshal(v)
+		}
+		if err != nil {
+			value, _ = json.Marshal(stringify(keyvals[i+1]))
+		}
+		buff.Write(value)
+	}
+	buff.WriteString("}\n")
+	return buff.Bytes()
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogger(format Format, level Level) (*Logger, *bytes.Buffer) {
+	var buff bytes.Buffer
+	l := New(&buff, level, format)
+	l.now = func() time.Time {
+		return time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	}
+	return l, &buff
+}
+
+func TestLogfmt(t *testing.T) {
+	l, buff := testLogger(Logfmt, Info)
+	l.With("component", "store").Info("appended source", "domain", "some domain", "count", 3, "error", errors.New("oops"), "empty", "")
+	expected := `ts=2019-03-04T05:06:07Z level=info msg="appended source" component=store domain="some domain" count=3 error=oops empty=""` + "\n"
+	if got := buff.String(); got != expected {
+		t.Errorf("Output mismatch:\n\texpected %s\treceived %s", expected, got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	l, buff := testLogger(JSON, Info)
+	l.With("component", "store").Warn("slow", "took", 1500*time.Millisecond, "count", 3, "odd")
+	expected := `{"ts":"2019-03-04T05:06:07Z","level":"warn","msg":"slow","component":"store","took":"1.5s","count":3,"odd":"(MISSING)"}` + "\n"
+	if got := buff.String(); got != expected {
+		t.Errorf("Output mismatch:\n\texpected %s\treceived %s", expected, got)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	l, buff := testLogger(Logfmt, Warn)
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error")
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "msg=warn") || !strings.Contains(lines[1], "msg=error") {
+		t.Errorf("Expected only warn and error entries; got:\n%s", buff.String())
+	}
+	if l.Enabled(Info) || !l.Enabled(Error) {
+		t.Error("Enabled does not reflect the level")
+	}
+
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil || level.String() != name {
+			t.Errorf("Failed to round-trip level %q: %v %v", name, level, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestWithDoesNotShareFields(t *testing.T) {
+	l, buff := testLogger(Logfmt, Info)
+	parent := l.With("a", 1)
+	parent.With("b", 2).Info("child")
+	parent.With("c", 3).Info("sibling")
+	if !strings.Contains(buff.String(), "msg=sibling a=1 c=3\n") {
+		t.Errorf("Sibling logger picked up another's fields:\n%s", buff.String())
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	// Disabled logging is a nil logger; using it is harmless.
+	var l *Logger
+	l.With("a", 1).Info("nothing")
+	l.Error("nothing")
+	if l.Enabled(Error) {
+		t.Error("A nil logger should not be enabled")
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryTextFormat(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("test_requests_total", "Requests.\nBy route.", "route", "status")
+	active := r.Gauge("test_active", "Active things.")
+	latency := r.Histogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+
+	requests.Inc("/b", "200")
+	requests.Add(2, "/a", "500")
+	requests.Inc("/a", "500")
+	requests.Inc("/quote\"d\\", "200")
+	active.Set(3)
+	active.Add(-1)
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(5, "/a")
+
+	var buff bytes.Buffer
+	n, err := r.WriteTo(&buff)
+	if err != nil {
+		t.Fatalf("Failed writing metrics: %s", err)
+	}
+	if n != int64(buff.Len()) {
+		t.Errorf("Reported %d bytes written; wrote %d", n, buff.Len())
+	}
+
+	expected := strings.Join([]string{
+		"# HELP test_requests_total Requests.\\nBy route.",
+		"# TYPE test_requests_total counter",
+		"test_requests_total{route=\"/a\",status=\"500\"} 3",
+		"test_requests_total{route=\"/b\",status=\"200\"} 1",
+		"test_requests_total{route=\"/quote\\\"d\\\\\",status=\"200\"} 1",
+		"# HELP test_active Active things.",
+		"# TYPE test_active gauge",
+		"test_active 2",
+		"# HELP test_latency_seconds Latency.",
+		"# TYPE test_latency_seconds histogram",
+		"test_latency_seconds_bucket{route=\"/a\",le=\"0.1\"} 1",
+		"test_latency_seconds_bucket{route=\"/a\",le=\"1\"} 2",
+		"test_latency_seconds_bucket{route=\"/a\",le=\"+Inf\"} 3",
+		"test_latency_seconds_sum{route=\"/a\"} 5.55",
+		"test_latency_seconds_count{route=\"/a\"} 3",
+		"",
+	}, "\n")
+	if got := buff.String(); got != expected {
+		t.Errorf("Output mismatch:\n--- expected\n%s--- received\n%s", expected, got)
+	}
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := recorder.Header().Get("Content-Type"); ct != TEXT_CONTENT_TYPE {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if recorder.Body.String() != expected {
+		t.Errorf("Served output does not match written output")
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	// Disabled metrics are nil; using them is harmless.
+	var c *Counter
+	var g *Gauge
+	var h *Histogram
+	c.Inc("a")
+	c.Add(2, "a")
+	g.Set(1)
+	g.Add(1)
+	h.Observe(1)
+}
+
+func TestLabelArityChecked(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for the wrong number of label values")
+		}
+	}()
+	NewRegistry().Counter("test_total", "Test.", "a", "b").Inc("just a")
+}
@@ -1,5 +1,9 @@
 package model
 
+import (
+	"context"
+)
+
 type DomainKey string
 type AggregateKey string
 
@@ -12,14 +16,73 @@ type DomainReader interface {
 	GetDomain(DomainKey) (*Domain, error)
 }
 
+type DomainLister interface {
+	// The keys of every domain, sorted.
+	ListDomains() ([]DomainKey, error)
+}
+
 type AggregateWriter interface {
 	AppendNewSource(DomainKey, AggregateKey, string, Source) (*Source, error)
 }
 
+// The version count to pass to a conditional write when
+// the caller has no expectation of the aggregate's state.
+const AnyVersion = -1
+
+// An aggregate's version is the length of its Log; an aggregate
+// that doesn't exist yet is at version 0.  The write succeeds only
+// if the aggregate is at the expected version when it is applied.
+type ConditionalAggregateWriter interface {
+	AppendNewSourceAtVersion(DomainKey, AggregateKey, string, Source, int) (*Source, error)
+}
+
+// Records the provenance of the source with its registration; a
+// duplicate keeps the provenance of the original.  The version is
+// as for ConditionalAggregateWriter, and may be AnyVersion.  Gives
+// the receipt for where the source landed, whose New tells whether
+// this append registered it.
+type AttributedAggregateWriter interface {
+	AppendAttributedSource(DomainKey, AggregateKey, string, Source, int, Provenance) (*SourceReceipt, error)
+}
+
 type AggregateReader interface {
 	GetAggregate(DomainKey, AggregateKey) (*Aggregate, error)
 }
 
+type ChangeFeedReader interface {
+	// Gives up to the given number of changes to the domain's
+	// aggregates that follow the given sequence number, in order.
+	GetChanges(DomainKey, ChangeSeq, int) ([]Change, error)
+}
+
+type SourceSearcher interface {
+	// Gives up to the given number of the domain's sources matching
+	// the query that were registered by changes following the given
+	// sequence number, in the order they were registered.
+	SearchSources(DomainKey, SourceQuery, ChangeSeq, int) ([]SourceMatch, error)
+}
+
+type AggregateLister interface {
+	// Gives up to the given number of the domain's aggregate keys
+	// that sort after the given key, in order.  The filter, if not
+	// empty, is an expression in the language of package filter
+	// that each aggregate must meet.
+	ListAggregates(DomainKey, AggregateKey, int, string) ([]AggregateKey, error)
+}
+
+type AggregateWaiter interface {
+	// Blocks until the aggregate has more than the given number of
+	// versions, and gives it.  If the context ends or the store stops
+	// first, gives the aggregate as it stands instead, or nil if there
+	// is no such aggregate; its version count tells which happened.
+	WaitForAggregate(context.Context, DomainKey, AggregateKey, int) (*Aggregate, error)
+}
+
+type ReadinessChecker interface {
+	// Gives nil if ready to serve requests, or why not.
+	CheckReady(context.Context) error
+}
+
 type MutationNotifier interface {
 	SubscribeToMutations(chan []byte) chan interface{}
 	NotifyMutationSubscribers(interface{}) error
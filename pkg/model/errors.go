@@ -0,0 +1,135 @@
+package model
+
+import (
+	"fmt"
+)
+
+// Classifies an error by what the caller can do about it, so
+// each layer can respond appropriately without knowing where
+// the error came from.
+type ErrorCode string
+
+const (
+	// The domain, aggregate, or other resource doesn't exist.
+	CodeNotFound ErrorCode = "not_found"
+	// The request contradicts what is already stored.
+	CodeConflict ErrorCode = "conflict"
+	// A conditional write's expectation of the stored
+	// state doesn't hold.
+	CodePreconditionFailed ErrorCode = "precondition_failed"
+	// The request itself is malformed or incomplete.
+	CodeInvalid ErrorCode = "invalid"
+	// The resource no longer accepts writes.
+	CodeSealed ErrorCode = "sealed"
+	// The store can't serve requests at the moment; retrying
+	// later may succeed.
+	CodeUnavailable ErrorCode = "unavailable"
+	// The operation isn't supported by this store.
+	CodeUnsupported ErrorCode = "unsupported"
+	// The caller didn't identify themselves acceptably.
+	CodeUnauthenticated ErrorCode = "unauthenticated"
+	// The caller may not do what they asked.
+	CodeForbidden ErrorCode = "forbidden"
+	// Anything else; the fault lies with the server.
+	CodeInternal ErrorCode = "internal"
+)
+
+// An error that can tell its code, and details for the caller.
+type CodedError interface {
+	error
+	ErrorCode() ErrorCode
+	// May be nil.
+	ErrorDetails() map[string]interface{}
+}
+
+// The code of the first error in the chain that has one, or
+// CodeInternal if none does.
+func CodeOf(err error) ErrorCode {
+	if coded := AsCodedError(err); coded != nil {
+		return coded.ErrorCode()
+	}
+	return CodeInternal
+}
+
+// The first error with a code in the chain that Unwrap methods
+// give, starting with the error itself; nil if none has a code.
+func AsCodedError(err error) CodedError {
+	for err != nil {
+		if coded, ok := err.(CodedError); ok {
+			return coded
+		}
+		wrapper, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = wrapper.Unwrap()
+	}
+	return nil
+}
+
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]interface{}
+}
+
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+// A copy of the error with the key/value pairs added to its details.
+func (e *Error) With(keyvals ...interface{}) *Error {
+	details := make(map[string]interface{}, len(e.Details)+len(keyvals)/2)
+	for k, v := range e.Details {
+		details[k] = v
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		details[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	return &Error{Code: e.Code, Message: e.Message, Details: details}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) ErrorCode() ErrorCode {
+	return e.Code
+}
+
+func (e *Error) ErrorDetails() map[string]interface{} {
+	return e.Details
+}
+
+// Returned by conditional writes when the aggregate has moved
+// past (or not yet reached) the version the caller expected.
+type VersionMismatchError struct {
+	Domain    DomainKey
+	Aggregate AggregateKey
+	Expected  int
+	Actual    int
+}
+
+func (e VersionMismatchError) Error() string {
+	return fmt.Sprintf(
+		"Domain %q aggregate %q is at version %d; expected %d",
+		e.Domain, e.Aggregate, e.Actual, e.Expected,
+	)
+}
+
+func (e VersionMismatchError) ErrorCode() ErrorCode {
+	return CodePreconditionFailed
+}
+
+func (e VersionMismatchError) ErrorDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"Domain":    e.Domain,
+		"Aggregate": e.Aggregate,
+		"Expected":  e.Expected,
+		"Actual":    e.Actual,
+	}
+}
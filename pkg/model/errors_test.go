@@ -0,0 +1,57 @@
+package model
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	err := Errorf(CodeNotFound, "Cannot find %q", "thing")
+	if err.Error() != "Cannot find \"thing\"" || CodeOf(err) != CodeNotFound || err.ErrorDetails() != nil {
+		t.Errorf("Unexpected error: %#v", err)
+	}
+	if CodeOf(errors.New("plain")) != CodeInternal {
+		t.Error("Errors without a code should be internal")
+	}
+	if CodeOf(VersionMismatchError{Expected: 1, Actual: 2}) != CodePreconditionFailed {
+		t.Error("Version mismatches should be failed preconditions")
+	}
+	if CodeOf(wrappedError{"reading", err}) != CodeNotFound {
+		t.Error("Wrapped errors should keep their code")
+	}
+	if CodeOf(wrappedError{"reading", errors.New("plain")}) != CodeInternal {
+		t.Error("Wrapped errors without a code should be internal")
+	}
+}
+
+type wrappedError struct {
+	message string
+	err     error
+}
+
+func (e wrappedError) Error() string {
+	return e.message + ": " + e.err.Error()
+}
+
+func (e wrappedError) Unwrap() error {
+	return e.err
+}
+
+func TestErrorWith(t *testing.T) {
+	base := NewError(CodeInvalid, "bad")
+	first := base.With("a", 1)
+	second := first.With("b", "two", "a", 3)
+	if base.Details != nil {
+		t.Errorf("With modified the original: %v", base.Details)
+	}
+	if !reflect.DeepEqual(first.Details, map[string]interface{}{"a": 1}) {
+		t.Errorf("Unexpected details %v", first.Details)
+	}
+	if !reflect.DeepEqual(second.Details, map[string]interface{}{"a": 3, "b": "two"}) {
+		t.Errorf("Unexpected details %v", second.Details)
+	}
+	if second.Code != CodeInvalid || second.Message != "bad" {
+		t.Errorf("With lost the code or message: %#v", second)
+	}
+}
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The most aggregates one source may be registered with at once.
+const MaxFanOut = 100
+
+// How a domain derives the aggregate keys for a source, so the
+// publishers to the domain needn't agree among themselves on its key
+// scheme.  Either TimeKey names a source key holding an RFC 3339 time,
+// which is truncated and laid out as given, or Template is a
+// text/template over the source's Keys and Attrs, with the functions
+// in KeyRuleFuncs:
+//
+//	{"TimeKey": "asof", "Truncate": "24h", "Layout": "20060102"}
+//	{"Template": "{{.Keys.region}}-{{.Keys.asof | truncate \"1h\"}}"}
+//
+// A rule may give several keys, so that a source is registered with
+// each of those aggregates.  With Hop, a time rule gives every window
+// of the Truncate duration, starting at a multiple of Hop, that holds
+// the time: hopping windows, or sliding windows with a small hop.  A
+// template gives a key per line of its output.  Truncating, whether
+// by Truncate, Hop, or the truncate function, is to a multiple of the
+// duration since the Unix epoch, so weekly windows start on Thursdays.
+//
+//	{"TimeKey": "asof", "Truncate": "48h", "Hop": "24h", "Layout": "20060102"}
+//	{"Template": "{{.Keys.asof | format \"20060102\"}}\n{{.Keys.asof | shift \"24h\" | format \"20060102\"}}"}
+type KeyRule struct {
+	TimeKey string `json:",omitempty"`
+	// A duration, like "24h"; the time is used as is if not given
+	Truncate string `json:",omitempty"`
+	// A duration dividing the windows' starts; requires Truncate,
+	// and may be no longer
+	Hop string `json:",omitempty"`
+	// A time layout, like "20060102"; RFC 3339 if not given
+	Layout   string `json:",omitempty"`
+	Template string `json:",omitempty"`
+}
+
+func (r KeyRule) IsZero() bool {
+	return r == KeyRule{}
+}
+
+// Functions for key templates.  Each takes a time.Time, or a string
+// holding an RFC 3339 time.
+var KeyRuleFuncs = template.FuncMap{
+	// The time truncated to a multiple of the duration, in RFC 3339
+	"truncate": func(d string, t interface{}) (string, error) {
+		duration, err := parseDuration("truncation", d)
+		if err != nil {
+			return "", err
+		}
+		tm, err := toTime(t)
+		if err != nil {
+			return "", err
+		}
+		return truncate(tm, duration).Format(time.RFC3339), nil
+	},
+	// The time moved by the duration, which may be negative, in RFC 3339
+	"shift": func(d string, t interface{}) (string, error) {
+		duration, err := time.ParseDuration(d)
+		if err != nil {
+			return "", fmt.Errorf("Invalid shift %q", d)
+		}
+		tm, err := toTime(t)
+		if err != nil {
+			return "", err
+		}
+		return tm.Add(duration).Format(time.RFC3339Nano), nil
+	},
+	// The time in the given layout
+	"format": func(layout string, t interface{}) (string, error) {
+		tm, err := toTime(t)
+		if err != nil {
+			return "", err
+		}
+		return tm.Format(layout), nil
+	},
+}
+
+// The time truncated to a multiple of the duration since the Unix
+// epoch.  time.Time's own Truncate counts from the zero time instead,
+// which only agrees for durations dividing a day.
+func truncate(t time.Time, d time.Duration) time.Time {
+	epoch := time.Unix(0, 0).UTC()
+	offset := epoch.Sub(epoch.Truncate(d))
+	return t.Add(-offset).Truncate(d).Add(offset)
+}
+
+// A positive duration.
+func parseDuration(what, d string) (time.Duration, error) {
+	duration, err := time.ParseDuration(d)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("Invalid %s %q", what, d)
+	}
+	return duration, nil
+}
+
+// The time in UTC.
+func toTime(t interface{}) (time.Time, error) {
+	switch t := t.(type) {
+	case time.Time:
+		return t.UTC(), nil
+	case string:
+		tm, err := time.Parse(time.RFC3339Nano, t)
+		if err != nil {
+			return tm, fmt.Errorf("Invalid time %q", t)
+		}
+		return tm.UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("Expected a time; got %v", t)
+}
+
+func (r KeyRule) template() (*template.Template, error) {
+	return template.New("key").Option("missingkey=error").Funcs(KeyRuleFuncs).Parse(r.Template)
+}
+
+// Gives a CodeInvalid error unless the rule is usable.
+func (r KeyRule) Validate() error {
+	switch {
+	case (r.TimeKey == "") == (r.Template == ""):
+		return NewError(CodeInvalid, "A key rule needs either a TimeKey or a Template")
+	case r.Template != "" && (r.Truncate != "" || r.Hop != "" || r.Layout != ""):
+		return NewError(CodeInvalid, "A key rule's Truncate, Hop, and Layout only apply with a TimeKey")
+	case r.Template != "":
+		if _, err := r.template(); err != nil {
+			return Errorf(CodeInvalid, "Invalid key template: %s", err)
+		}
+		return nil
+	case r.Hop != "" && r.Truncate == "":
+		return NewError(CodeInvalid, "A key rule's Hop requires a Truncate")
+	}
+	if r.Truncate == "" {
+		return nil
+	}
+	size, err := parseDuration("truncation", r.Truncate)
+	if err != nil {
+		return NewError(CodeInvalid, err.Error())
+	}
+	if r.Hop == "" {
+		return nil
+	}
+	hop, err := parseDuration("hop", r.Hop)
+	if err != nil {
+		return NewError(CodeInvalid, err.Error())
+	}
+	if hop > size {
+		return Errorf(CodeInvalid, "A key rule's Hop %s exceeds its Truncate %s", r.Hop, r.Truncate)
+	}
+	if int64((size+hop-1)/hop) > MaxFanOut {
+		return Errorf(CodeInvalid, "A key rule may give at most %d aggregates; Truncate %s and Hop %s give more", MaxFanOut, r.Truncate, r.Hop)
+	}
+	return nil
+}
+
+// The aggregate keys the rule gives for the source, without
+// duplicates, or a CodeInvalid error if the source lacks what the
+// rule needs.
+func (r KeyRule) Keys(s Source) ([]AggregateKey, error) {
+	return r.keys(s, s)
+}
+
+// As Keys, executing a template with the given data.
+func (r KeyRule) keys(s Source, data interface{}) ([]AggregateKey, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	if r.Template != "" {
+		return r.templateKeys(data)
+	}
+
+	value, ok := s.Keys[r.TimeKey]
+	if !ok {
+		return nil, Errorf(CodeInvalid, "Cannot derive the source's aggregate key without key %q", r.TimeKey).With("Key", r.TimeKey)
+	}
+	t, err := toTime(value)
+	if err != nil {
+		return nil, Errorf(CodeInvalid, "Cannot derive the source's aggregate key: key %q: %s", r.TimeKey, err).With("Key", r.TimeKey)
+	}
+	layout := r.Layout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	if r.Truncate == "" {
+		return []AggregateKey{AggregateKey(t.Format(layout))}, nil
+	}
+	size, _ := parseDuration("truncation", r.Truncate)
+	hop := size
+	if r.Hop != "" {
+		hop, _ = parseDuration("hop", r.Hop)
+	}
+	// The windows holding the time start after t - size, and no
+	// later than t.
+	first := truncate(t, hop)
+	for first.Add(-hop).After(t.Add(-size)) {
+		first = first.Add(-hop)
+	}
+	keys := make([]AggregateKey, 0, (size+hop-1)/hop)
+	for start := first; !start.After(t); start = start.Add(hop) {
+		keys = appendKey(keys, AggregateKey(start.Format(layout)))
+	}
+	return keys, nil
+}
+
+func (r KeyRule) templateKeys(data interface{}) ([]AggregateKey, error) {
+	tmpl, _ := r.template()
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, Errorf(CodeInvalid, "Cannot derive the source's aggregate key: %s", err)
+	}
+	keys := make([]AggregateKey, 0, 1)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			keys = appendKey(keys, AggregateKey(line))
+		}
+	}
+	if len(keys) == 0 {
+		return nil, NewError(CodeInvalid, "The key template gives no aggregate key for the source")
+	}
+	if len(keys) > MaxFanOut {
+		return nil, Errorf(CodeInvalid, "The key template gives %d aggregate keys for the source; at most %d are allowed", len(keys), MaxFanOut)
+	}
+	return keys, nil
+}
+
+// Adds the key unless it's already there.
+func appendKey(keys []AggregateKey, key AggregateKey) []AggregateKey {
+	for _, k := range keys {
+		if k == key {
+			return keys
+		}
+	}
+	return append(keys, key)
+}
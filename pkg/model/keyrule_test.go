@@ -0,0 +1,72 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeyRule(t *testing.T) {
+	source := Source{Keys: map[string]string{"asof": "2019-07-10T11:28:10-04:00", "region": "eu"}}
+	for _, c := range []struct {
+		rule     KeyRule
+		expected []AggregateKey
+	}{
+		{KeyRule{TimeKey: "asof"}, []AggregateKey{"2019-07-10T15:28:10Z"}},
+		{KeyRule{TimeKey: "asof", Truncate: "24h", Layout: "20060102"}, []AggregateKey{"20190710"}},
+		{KeyRule{TimeKey: "asof", Truncate: "1h"}, []AggregateKey{"2019-07-10T15:00:00Z"}},
+		{KeyRule{Template: `{{.Keys.region}}-{{.Keys.asof | truncate "24h" | format "20060102"}}`}, []AggregateKey{"eu-20190710"}},
+		// Fanned out
+		{KeyRule{TimeKey: "asof", Truncate: "48h", Hop: "24h", Layout: "20060102"}, []AggregateKey{"20190709", "20190710"}},
+		{KeyRule{TimeKey: "asof", Truncate: "1h", Hop: "20m", Layout: "1504"}, []AggregateKey{"1440", "1500", "1520"}},
+		{KeyRule{TimeKey: "asof", Truncate: "24h", Hop: "24h", Layout: "20060102"}, []AggregateKey{"20190710"}},
+		{KeyRule{TimeKey: "asof", Truncate: "90m", Hop: "1h", Layout: "1504"}, []AggregateKey{"1400", "1500"}},
+		// Weeks since the Unix epoch start on Thursdays
+		{KeyRule{TimeKey: "asof", Truncate: "168h", Layout: "20060102"}, []AggregateKey{"20190704"}},
+		{KeyRule{Template: `{{.Keys.asof | truncate "168h" | format "20060102"}}`}, []AggregateKey{"20190704"}},
+		{KeyRule{Template: "{{.Keys.asof | format \"0102\"}}\n{{.Keys.asof | shift \"24h\" | format \"0102\"}}\n\n0710"}, []AggregateKey{"0710", "0711"}},
+	} {
+		if keys, err := c.rule.Keys(source); !reflect.DeepEqual(keys, c.expected) || err != nil {
+			t.Errorf("Rule %+v: expected %q; got %q, %v", c.rule, c.expected, keys, err)
+		}
+	}
+
+	for _, rule := range []KeyRule{
+		{},
+		{TimeKey: "asof", Template: "x"},
+		{TimeKey: "asof", Truncate: "daily"},
+		{Template: "x", Layout: "20060102"},
+		{Template: "{{.Keys"},
+		{TimeKey: "asof", Hop: "1h"},
+		{TimeKey: "asof", Truncate: "1h", Hop: "2h"},
+		{TimeKey: "asof", Truncate: "24h", Hop: "1m"},
+		{TimeKey: "asof", Truncate: "100500ms", Hop: "1s"},
+		{Template: "x", Hop: "1h"},
+	} {
+		if err := rule.Validate(); CodeOf(err) != CodeInvalid {
+			t.Errorf("Rule %+v: expected an invalid error; got %v", rule, err)
+		}
+	}
+
+	for _, rule := range []KeyRule{
+		{TimeKey: "missing"},
+		{TimeKey: "region"},
+		{Template: "{{.Keys.missing}}"},
+		{Template: "{{.Keys.region | truncate \"1h\"}}"},
+		{Template: "{{if false}}x{{end}}"},
+	} {
+		if _, err := rule.Keys(source); CodeOf(err) != CodeInvalid {
+			t.Errorf("Rule %+v: expected an invalid error; got %v", rule, err)
+		}
+	}
+}
+
+func TestDomainKeyRule(t *testing.T) {
+	plain := Domain{Key: "d"}
+	ruled := Domain{Key: "d", KeyRule: KeyRule{TimeKey: "asof"}}
+	if plain.Equals(ruled) || plain.ETag() == ruled.ETag() {
+		t.Errorf("Domains differing in their key rules should differ")
+	}
+	if !ruled.Equals(Domain{Key: "d", KeyRule: KeyRule{TimeKey: "asof"}}) {
+		t.Errorf("Domains with equal key rules should be equal")
+	}
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"encoding/json"
+)
+
+// A domain's subscription to another domain's sources, so that
+// artifacts published upstream needn't be published again.  Each
+// source newly registered upstream under one of the Tokens (or any
+// token, if none are given) is registered with the dependent domain
+// too: under Token, if given, or else the same token, and with the
+// aggregates the KeyRule gives, or else the aggregate of the same key.
+// A mirror's key templates may refer to the upstream aggregate's key
+// as .Aggregate, besides the source's .Keys and .Attrs:
+//
+//	{"Domain": "team-a", "Tokens": ["model"], "KeyRule": {"Template": "a-{{.Aggregate}}"}}
+//
+// The upstream domain must exist when the dependent domain is created,
+// so mirrors cannot form a cycle.
+type Mirror struct {
+	Domain DomainKey
+	Tokens []string
+	Token  string
+	// Optional (the zero rule keeps the upstream aggregate's key)
+	KeyRule KeyRule
+}
+
+// Where a mirrored source was registered upstream: the registration
+// is that of the aggregate's version VersionIdx.
+type SourceOrigin struct {
+	Domain     DomainKey
+	Aggregate  AggregateKey
+	Token      string
+	VersionIdx int
+}
+
+// Gives a CodeInvalid error unless the mirror is usable by the
+// given dependent domain.
+func (m Mirror) Validate(dependent DomainKey) error {
+	if m.Domain == "" {
+		return NewError(CodeInvalid, "A mirror needs a Domain")
+	}
+	if m.Domain == dependent {
+		return Errorf(CodeInvalid, "Domain %q cannot mirror itself", dependent).With("Domain", string(m.Domain))
+	}
+	for _, token := range m.Tokens {
+		if token == "" {
+			return NewError(CodeInvalid, "A mirror's Tokens cannot be empty")
+		}
+	}
+	if !m.KeyRule.IsZero() {
+		return m.KeyRule.Validate()
+	}
+	return nil
+}
+
+// Whether the mirror takes sources registered upstream under the token.
+func (m Mirror) Matches(token string) bool {
+	if len(m.Tokens) == 0 {
+		return true
+	}
+	for _, t := range m.Tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// The token the mirrored source is registered under.
+func (m Mirror) MirroredToken(token string) string {
+	if m.Token != "" {
+		return m.Token
+	}
+	return token
+}
+
+// The data for a mirror's key templates.
+type mirrorKeyData struct {
+	Keys      map[string]string
+	Attrs     map[string]string
+	Aggregate AggregateKey
+}
+
+// The dependent domain's aggregate keys for the source registered
+// upstream, or a CodeInvalid error if the source lacks what the key
+// rule needs.
+func (m Mirror) Keys(origin SourceOrigin, s Source) ([]AggregateKey, error) {
+	if m.KeyRule.IsZero() {
+		return []AggregateKey{origin.Aggregate}, nil
+	}
+	return m.KeyRule.keys(s, mirrorKeyData{s.Keys, s.Attrs, origin.Aggregate})
+}
+
+// Helper type for json conversion
+type mirrorJson struct {
+	Domain  DomainKey
+	Tokens  []string `json:",omitempty"`
+	Token   string   `json:",omitempty"`
+	KeyRule *KeyRule `json:",omitempty"`
+}
+
+func (m Mirror) MarshalJSON() ([]byte, error) {
+	j := mirrorJson{Domain: m.Domain, Tokens: m.Tokens, Token: m.Token}
+	if !m.KeyRule.IsZero() {
+		j.KeyRule = &m.KeyRule
+	}
+	return json.Marshal(j)
+}
+
+func (m *Mirror) UnmarshalJSON(data []byte) error {
+	var intermediary mirrorJson
+	err := json.Unmarshal(data, &intermediary)
+	if err == nil {
+		m.Domain = intermediary.Domain
+		m.Tokens = intermediary.Tokens
+		m.Token = intermediary.Token
+		m.KeyRule = KeyRule{}
+		if intermediary.KeyRule != nil {
+			m.KeyRule = *intermediary.KeyRule
+		}
+	}
+	return err
+}
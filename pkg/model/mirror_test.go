@@ -0,0 +1,65 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	origin := SourceOrigin{Domain: "up", Aggregate: "20190710", Token: "model", VersionIdx: 2}
+	source := Source{Keys: map[string]string{"asof": "2019-07-10T11:28:10Z", "region": "eu"}}
+	for _, c := range []struct {
+		mirror   Mirror
+		expected []AggregateKey
+	}{
+		{Mirror{Domain: "up"}, []AggregateKey{"20190710"}},
+		{Mirror{Domain: "up", KeyRule: KeyRule{Template: "{{.Keys.region}}-{{.Aggregate}}"}}, []AggregateKey{"eu-20190710"}},
+		{Mirror{Domain: "up", KeyRule: KeyRule{TimeKey: "asof", Truncate: "1h", Layout: "15"}}, []AggregateKey{"11"}},
+	} {
+		if keys, err := c.mirror.Keys(origin, source); !reflect.DeepEqual(keys, c.expected) || err != nil {
+			t.Errorf("Mirror %+v: expected %q; got %q, %v", c.mirror, c.expected, keys, err)
+		}
+	}
+
+	mirror := Mirror{Domain: "up", Tokens: []string{"model", "data"}, Token: "upstream"}
+	if !mirror.Matches("data") || mirror.Matches("other") || !(Mirror{Domain: "up"}).Matches("other") {
+		t.Errorf("Unexpected token matching for %+v", mirror)
+	}
+	if token := mirror.MirroredToken("data"); token != "upstream" {
+		t.Errorf("Expected the mirrored token to be renamed; got %q", token)
+	}
+	if token := (Mirror{Domain: "up"}).MirroredToken("data"); token != "data" {
+		t.Errorf("Expected the mirrored token to be kept; got %q", token)
+	}
+
+	for _, m := range []Mirror{
+		{},
+		{Domain: "down"},
+		{Domain: "up", Tokens: []string{""}},
+		{Domain: "up", KeyRule: KeyRule{Truncate: "1h"}},
+	} {
+		if err := m.Validate("down"); CodeOf(err) != CodeInvalid {
+			t.Errorf("Mirror %+v: expected an invalid error; got %v", m, err)
+		}
+	}
+}
+
+func TestDomainMirrors(t *testing.T) {
+	plain := Domain{Key: "d"}
+	mirrored := Domain{Key: "d", Mirrors: []Mirror{{Domain: "up", Tokens: []string{"model"}}}}
+	if plain.Equals(mirrored) || plain.ETag() == mirrored.ETag() {
+		t.Errorf("Domains differing in their mirrors should differ")
+	}
+	data, err := json.Marshal(mirrored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"Key":"d","Attrs":{},"Mirrors":[{"Domain":"up","Tokens":["model"]}]}`; string(data) != expected {
+		t.Errorf("Expected %s; got %s", expected, data)
+	}
+	var decoded Domain
+	if err := json.Unmarshal(data, &decoded); err != nil || !decoded.Equals(mirrored) {
+		t.Errorf("Expected %+v to round trip; got %+v, %v", mirrored, decoded, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/ethanrowe/botlnek/pkg/util"
+	"strconv"
 	"time"
 )
 
@@ -27,6 +28,51 @@ type Counter interface {
 type ClockEntry struct {
 	SeqNum      Counter
 	Approximate time.Time
+	// Position of the version in its domain's change feed.
+	ChangeSeq ChangeSeq `json:",omitempty"`
+}
+
+// Sequence numbers are assigned to versions across all the
+// aggregates of a domain, starting from 1, so a consumer can
+// follow every change in the domain.  Zero precedes all changes.
+type ChangeSeq uint64
+
+const (
+	CHANGE_SEQ_FORMAT_STRING = "%016x"
+)
+
+func ParseChangeSeq(s string) (ChangeSeq, error) {
+	x, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, Errorf(CodeInvalid, "Invalid change sequence number %q", s)
+	}
+	return ChangeSeq(x), nil
+}
+
+func (c ChangeSeq) String() string {
+	return fmt.Sprintf(CHANGE_SEQ_FORMAT_STRING, uint64(c))
+}
+
+func (c ChangeSeq) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *ChangeSeq) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	*c, err = ParseChangeSeq(s)
+	return err
+}
+
+// An entry in a domain's change feed: a version appended
+// to one of the domain's aggregates.
+type Change struct {
+	Seq          ChangeSeq
+	AggregateKey AggregateKey
+	VersionIdx   int
 }
 
 type Source struct {
@@ -51,10 +97,72 @@ type SourceLog struct {
 	VersionIdx int
 	Key        string
 	Source     Source
+	// Who registered the source, if known.
+	Provenance *Provenance `json:",omitempty"`
+	// Where the source was registered upstream, if it's mirrored.
+	Origin *SourceOrigin `json:",omitempty"`
+}
+
+// Describes who registered a source.
+type Provenance struct {
+	// The authenticated principal
+	Principal string `json:",omitempty"`
+	// The client's address, as seen by the server
+	RemoteAddr string `json:",omitempty"`
+	UserAgent  string `json:",omitempty"`
+	// The ID of the request that registered the source
+	RequestID string `json:",omitempty"`
+	// The publisher the client claims to be; unverified
+	Publisher string `json:",omitempty"`
+}
+
+func (p Provenance) IsZero() bool {
+	return p == Provenance{}
+}
+
+// Selects sources by provenance: each non-empty field must equal
+// the provenance's.  The zero filter selects every source.
+type ProvenanceFilter Provenance
+
+func (f ProvenanceFilter) IsZero() bool {
+	return Provenance(f).IsZero()
+}
+
+func (f ProvenanceFilter) Matches(p *Provenance) bool {
+	if f.IsZero() {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	for _, pair := range [][2]string{
+		{f.Principal, p.Principal},
+		{f.RemoteAddr, p.RemoteAddr},
+		{f.UserAgent, p.UserAgent},
+		{f.RequestID, p.RequestID},
+		{f.Publisher, p.Publisher},
+	} {
+		if pair[0] != "" && pair[0] != pair[1] {
+			return false
+		}
+	}
+	return true
 }
 
 type SourceLogMap map[string][]SourceLog
 
+// Where a source is registered in an aggregate, and whether the
+// append that produced the receipt was the one to register it.
+type SourceReceipt struct {
+	Domain     DomainKey
+	Aggregate  AggregateKey
+	Token      string
+	KeyHash    string
+	VersionIdx int
+	ClockEntry ClockEntry
+	New        bool
+}
+
 type Aggregate struct {
 	Key     AggregateKey
 	Attrs   map[string]string
@@ -62,6 +170,75 @@ type Aggregate struct {
 	Sources SourceLogMap
 }
 
+// The time of the aggregate's latest version, or the zero time
+// for an aggregate without versions.
+func (p Aggregate) LastModified() time.Time {
+	if len(p.Log) == 0 {
+		return time.Time{}
+	}
+	return p.Log[len(p.Log)-1].Approximate
+}
+
+// A strong entity tag for the aggregate's current version, derived
+// from the version count and the latest clock entry.  Since aggregates
+// are append-only, this changes exactly when the version does.
+// Gives an empty string for an aggregate without versions.
+func (p Aggregate) ETag() string {
+	if len(p.Log) == 0 {
+		return ""
+	}
+	last, err := json.Marshal(p.Log[len(p.Log)-1])
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(last)
+	return fmt.Sprintf("\"%d-%x\"", len(p.Log), hash[:12])
+}
+
+// The receipt for the source registered under the token with the
+// given key hash, or nil if there is none.  Registrations never change
+// once made, so this describes the original append.
+func (p Aggregate) Receipt(domain DomainKey, token, keyHash string) *SourceReceipt {
+	for _, reg := range p.Sources[token] {
+		if reg.Key != keyHash || reg.VersionIdx < 0 || reg.VersionIdx >= len(p.Log) {
+			continue
+		}
+		return &SourceReceipt{
+			Domain:     domain,
+			Aggregate:  p.Key,
+			Token:      token,
+			KeyHash:    keyHash,
+			VersionIdx: reg.VersionIdx,
+			ClockEntry: p.Log[reg.VersionIdx],
+		}
+	}
+	return nil
+}
+
+// A copy of the aggregate with only the sources the filter selects,
+// and with their provenance only if it's to be included.  The
+// versions are unchanged.
+func (p Aggregate) View(filter ProvenanceFilter, includeProvenance bool) Aggregate {
+	view := p
+	view.Sources = make(SourceLogMap, len(p.Sources))
+	for token, logs := range p.Sources {
+		selected := make([]SourceLog, 0, len(logs))
+		for _, log := range logs {
+			if !filter.Matches(log.Provenance) {
+				continue
+			}
+			if !includeProvenance {
+				log.Provenance = nil
+			}
+			selected = append(selected, log)
+		}
+		if len(selected) > 0 {
+			view.Sources[token] = selected
+		}
+	}
+	return view
+}
+
 func (p Aggregate) MarshalJSON() ([]byte, error) {
 	return json.Marshal(
 		struct {
@@ -81,6 +258,11 @@ func (p Aggregate) MarshalJSON() ([]byte, error) {
 type Domain struct {
 	Key   DomainKey
 	Attrs util.StringKVPairs
+	// Optional (the zero rule is none); derives aggregate keys for sources posted to the
+	// domain rather than to an aggregate.
+	KeyRule KeyRule
+	// Optional; other domains' sources to mirror into the domain.
+	Mirrors []Mirror
 	// Aggregates map[string]Aggregate
 }
 
@@ -88,22 +270,57 @@ func (d Domain) Equals(other Domain) bool {
 	if d.Key != other.Key {
 		return false
 	}
+	if d.KeyRule != other.KeyRule {
+		return false
+	}
+	if d.mirrorsJson() != other.mirrorsJson() {
+		return false
+	}
 	return hashKVPairs(d.Attrs) == hashKVPairs(other.Attrs)
 }
 
+// A strong entity tag for the domain's content.
+func (d Domain) ETag() string {
+	pairs := util.StringKVPairs{
+		{Key: string(d.Key), Value: hashKVPairs(d.Attrs)},
+	}
+	if !d.KeyRule.IsZero() {
+		rule, _ := json.Marshal(d.KeyRule)
+		pairs = append(pairs, util.StringKVPair{Key: "KeyRule", Value: string(rule)})
+	}
+	if len(d.Mirrors) > 0 {
+		pairs = append(pairs, util.StringKVPair{Key: "Mirrors", Value: d.mirrorsJson()})
+	}
+	return fmt.Sprintf("\"%s\"", hashKVPairs(pairs))
+}
+
+// The mirrors as JSON, for comparison.
+func (d Domain) mirrorsJson() string {
+	if len(d.Mirrors) == 0 {
+		return ""
+	}
+	mirrors, _ := json.Marshal(d.Mirrors)
+	return string(mirrors)
+}
+
 // Helper type for json conversion
 type domainJson struct {
-	Key   DomainKey
-	Attrs map[string]string
+	Key     DomainKey
+	Attrs   map[string]string
+	KeyRule *KeyRule `json:",omitempty"`
+	Mirrors []Mirror `json:",omitempty"`
 }
 
 func (d Domain) MarshalJSON() ([]byte, error) {
-	return json.Marshal(
-		domainJson{
-			Key:   d.Key,
-			Attrs: d.Attrs.ToMap(),
-		},
-	)
+	j := domainJson{
+		Key:     d.Key,
+		Attrs:   d.Attrs.ToMap(),
+		Mirrors: d.Mirrors,
+	}
+	if !d.KeyRule.IsZero() {
+		j.KeyRule = &d.KeyRule
+	}
+	return json.Marshal(j)
 }
 
 func (d *Domain) UnmarshalJSON(data []byte) error {
@@ -112,6 +329,11 @@ func (d *Domain) UnmarshalJSON(data []byte) error {
 	if err == nil {
 		d.Key = intermediary.Key
 		d.Attrs = util.NewStringKVPairs(intermediary.Attrs)
+		d.KeyRule = KeyRule{}
+		if intermediary.KeyRule != nil {
+			d.KeyRule = *intermediary.KeyRule
+		}
+		d.Mirrors = intermediary.Mirrors
 	}
 	return err
 }
@@ -171,7 +171,7 @@ func exampleSourceReg(seqnum string) (SourceRegistration, testJsonSourceReg) {
 	attrs[fmt.Sprintf("%s-attr", seqnum)] = fmt.Sprintf("%s-value", seqnum)
 	attrs[fmt.Sprintf("attr-%s", seqnum)] = fmt.Sprintf("value-%s", seqnum)
 	t := SourceRegistration{
-		ClockEntry{testCounter(seqnum), time.Now()},
+		ClockEntry{SeqNum: testCounter(seqnum), Approximate: time.Now()},
 		Source{keys, attrs},
 	}
 	return t, testJsonSourceReg{
@@ -203,7 +203,7 @@ type testJsonVersion struct {
 
 func (v testJsonVersion) ClockEntry() ClockEntry {
 	t, _ := time.Parse(time.RFC3339Nano, v.Approximate)
-	return ClockEntry{testCounter(v.SeqNum), t}
+	return ClockEntry{SeqNum: testCounter(v.SeqNum), Approximate: t}
 }
 
 func exampleSourceLogEntry(prefix string, count int) (SourceLog, testJsonSourceLogEntry, testJsonVersion) {
@@ -352,3 +352,134 @@ func TestAggregateJsonMarshaling(t *testing.T) {
 		t.Errorf("Aggregate-based JSON structure doesn't match expectation (\n\tgot: %q\n\texpected: %q)", fromAggrData, fromSpecData)
 	}
 }
+
+func TestAggregateETag(t *testing.T) {
+	sources := exampleSourceRegs("aggr-etag")
+	aggr := Aggregate{Key: AggregateKey("etag-aggregate")}
+
+	if tag := aggr.ETag(); tag != "" {
+		t.Errorf("Expected empty tag for aggregate without versions; got %s", tag)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		aggr.Log = append(aggr.Log, (<-sources).Version.ClockEntry())
+		tag := aggr.ETag()
+		if !strings.HasPrefix(tag, "\"") || !strings.HasSuffix(tag, "\"") {
+			t.Errorf("Tag is not quoted: %s", tag)
+		}
+		if seen[tag] {
+			t.Errorf("Tag %s repeated at version %d", tag, len(aggr.Log))
+		}
+		seen[tag] = true
+		if again := aggr.ETag(); again != tag {
+			t.Errorf("Tag unstable for same version (%s != %s)", tag, again)
+		}
+		if modified := aggr.LastModified(); !modified.Equal(aggr.Log[i].Approximate) {
+			t.Errorf("LastModified %s does not match latest version %s", modified, aggr.Log[i].Approximate)
+		}
+	}
+}
+
+func TestAggregateReceipt(t *testing.T) {
+	sources := exampleSourceRegs("aggr-receipt")
+	aggr := Aggregate{Key: AggregateKey("receipt-aggregate"), Sources: make(SourceLogMap)}
+	triples := make([]testSourceTriple, 3)
+	for i := range triples {
+		triples[i] = <-sources
+		aggr.Log = append(aggr.Log, triples[i].Version.ClockEntry())
+	}
+	aggr.Sources["a"] = []SourceLog{triples[0].Entry, triples[2].Entry}
+	aggr.Sources["b"] = []SourceLog{triples[1].Entry}
+
+	receipt := aggr.Receipt(DomainKey("d"), "a", triples[2].Entry.Key)
+	expected := SourceReceipt{
+		Domain:     DomainKey("d"),
+		Aggregate:  aggr.Key,
+		Token:      "a",
+		KeyHash:    triples[2].Entry.Key,
+		VersionIdx: 2,
+		ClockEntry: aggr.Log[2],
+	}
+	if receipt == nil || !reflect.DeepEqual(*receipt, expected) {
+		t.Errorf("Unexpected receipt:\n\texpected %v\n\treceived %v", expected, receipt)
+	}
+	if receipt := aggr.Receipt(DomainKey("d"), "b", triples[2].Entry.Key); receipt != nil {
+		t.Errorf("Expected no receipt for a source under another token; got %v", receipt)
+	}
+	if receipt := aggr.Receipt(DomainKey("d"), "c", triples[0].Entry.Key); receipt != nil {
+		t.Errorf("Expected no receipt for an unknown token; got %v", receipt)
+	}
+}
+
+func TestAggregateView(t *testing.T) {
+	sources := exampleSourceRegs("aggr-view")
+	aggr := Aggregate{Key: AggregateKey("view-aggregate"), Sources: make(SourceLogMap)}
+	provenances := []*Provenance{
+		{Principal: "alice", Publisher: "etl"},
+		{Principal: "bob", Publisher: "etl"},
+		nil,
+	}
+	for i, provenance := range provenances {
+		triple := <-sources
+		aggr.Log = append(aggr.Log, triple.Version.ClockEntry())
+		triple.Entry.Provenance = provenance
+		token := "a"
+		if i == 1 {
+			token = "b"
+		}
+		aggr.Sources[token] = append(aggr.Sources[token], triple.Entry)
+	}
+
+	full := aggr.View(ProvenanceFilter{}, true)
+	if !reflect.DeepEqual(full, aggr) {
+		t.Errorf("Unfiltered view with provenance should match the aggregate")
+	}
+	stripped := aggr.View(ProvenanceFilter{}, false)
+	for token, logs := range stripped.Sources {
+		for _, log := range logs {
+			if log.Provenance != nil {
+				t.Errorf("Token %s source %d kept its provenance", token, log.VersionIdx)
+			}
+		}
+	}
+	if aggr.Sources["a"][0].Provenance == nil {
+		t.Error("View modified the aggregate's sources")
+	}
+
+	etl := aggr.View(ProvenanceFilter{Publisher: "etl"}, true)
+	if len(etl.Sources["a"]) != 1 || len(etl.Sources["b"]) != 1 || !reflect.DeepEqual(etl.Log, aggr.Log) {
+		t.Errorf("Unexpected view of the etl publisher's sources: %v", etl)
+	}
+	bob := aggr.View(ProvenanceFilter{Principal: "bob", Publisher: "etl"}, false)
+	if _, ok := bob.Sources["a"]; ok || len(bob.Sources["b"]) != 1 || bob.Sources["b"][0].VersionIdx != 1 {
+		t.Errorf("Unexpected view of bob's sources: %v", bob.Sources)
+	}
+	if nobody := aggr.View(ProvenanceFilter{Principal: "carol"}, false); len(nobody.Sources) != 0 {
+		t.Errorf("Expected no sources for carol; got %v", nobody.Sources)
+	}
+}
+
+func TestDomainETag(t *testing.T) {
+	a := Domain{
+		Key:   DomainKey("etag-domain"),
+		Attrs: util.NewStringKVPairs(map[string]string{"foo": "Foo"}),
+	}
+	b := Domain{
+		Key:   a.Key,
+		Attrs: util.NewStringKVPairs(map[string]string{"foo": "Foo"}),
+	}
+	if a.ETag() != b.ETag() {
+		t.Errorf("Equal domains have different tags (%s != %s)", a.ETag(), b.ETag())
+	}
+
+	b.Attrs = util.NewStringKVPairs(map[string]string{"foo": "Bar"})
+	if a.ETag() == b.ETag() {
+		t.Errorf("Domains with different attrs share tag %s", a.ETag())
+	}
+
+	b.Attrs, b.Key = a.Attrs, DomainKey("other-etag-domain")
+	if a.ETag() == b.ETag() {
+		t.Errorf("Domains with different keys share tag %s", a.ETag())
+	}
+}
@@ -0,0 +1,52 @@
+package model
+
+// Selects a domain's sources: each of the given keys and attrs must
+// have the given value, and the token and provenance must match, if
+// given.  A query needs at least one key or attr.  The Filter, if
+// given, is an expression in the language of package filter that the
+// source's aggregate must meet; Matches leaves it to the store.
+type SourceQuery struct {
+	Keys       map[string]string
+	Attrs      map[string]string
+	Token      string
+	Provenance ProvenanceFilter
+	Filter     string
+}
+
+// Gives a CodeInvalid error unless the query selects by a key or attr.
+func (q SourceQuery) Validate() error {
+	if len(q.Keys) == 0 && len(q.Attrs) == 0 {
+		return NewError(CodeInvalid, "A search needs at least one key or attr")
+	}
+	return nil
+}
+
+func (q SourceQuery) Matches(token string, log SourceLog) bool {
+	if q.Token != "" && q.Token != token {
+		return false
+	}
+	if !q.Provenance.Matches(log.Provenance) {
+		return false
+	}
+	s := log.Source
+	for k, v := range q.Keys {
+		if actual, ok := s.Keys[k]; !ok || actual != v {
+			return false
+		}
+	}
+	for k, v := range q.Attrs {
+		if actual, ok := s.Attrs[k]; !ok || actual != v {
+			return false
+		}
+	}
+	return true
+}
+
+// A source found by a search, with where it's registered: under the
+// token in the aggregate, by the change ChangeSeq to the domain.
+type SourceMatch struct {
+	Aggregate AggregateKey
+	Token     string
+	ChangeSeq ChangeSeq
+	SourceLog
+}
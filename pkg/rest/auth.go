@@ -0,0 +1,100 @@
+package rest
+
+import (
+	"context"
+	"github.com/ethanrowe/botlnek/pkg/auth"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"net/http"
+	"strings"
+)
+
+// What a route's permission applies to.
+type authScope int
+
+const (
+	// The domain given by the route's "domain" parameter
+	domainScope authScope = iota
+	// At least one domain; the handler checks further
+	someScope
+	// Every domain
+	allScope
+)
+
+// The principal the request was authenticated as, or nil if
+// authentication is disabled.
+func PrincipalFromRequest(r *http.Request) *auth.Principal {
+	p, _ := r.Context().Value(principalKey).(*auth.Principal)
+	return p
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Requires the request to carry a bearer token whose principal has
+// the permission in the given scope, if the application has an
+// Authenticator; otherwise, anything goes.
+func (app *RestApplication) require(perm auth.Permission, scope authScope, h http.Handler) http.Handler {
+	if app.Authenticator == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		principal := app.Authenticator.Authenticate(token)
+		if principal == nil {
+			challenge := "Bearer realm=\"botlnek\""
+			message := "A bearer token is required"
+			if token != "" {
+				challenge += ", error=\"invalid_token\""
+				message = "The bearer token is not recognized"
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			writeError(w, r, model.NewError(model.CodeUnauthenticated, message))
+			return
+		}
+		AnnotateRequest(r, "principal", principal.Name)
+
+		var allowed bool
+		switch scope {
+		case domainScope:
+			allowed = principal.Allows(perm, model.DomainKey(PathParam(r, "domain")))
+		case someScope:
+			allowed = principal.AllowsSome(perm)
+		case allScope:
+			allowed = principal.AllowsAll(perm)
+		}
+		if !allowed {
+			writeError(w, r, forbidden(principal, perm, model.DomainKey(PathParam(r, "domain"))))
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, principal)))
+	})
+}
+
+// Gives a forbidden error unless the request's principal (if any)
+// has the permission on the domain.
+func authorize(r *http.Request, perm auth.Permission, domain model.DomainKey) error {
+	principal := PrincipalFromRequest(r)
+	if principal == nil || principal.Allows(perm, domain) {
+		return nil
+	}
+	return forbidden(principal, perm, domain)
+}
+
+func forbidden(principal *auth.Principal, perm auth.Permission, domain model.DomainKey) error {
+	err := model.Errorf(model.CodeForbidden, "Principal %q lacks %s permission", principal.Name, perm).With("Permission", perm)
+	if domain != "" {
+		err = err.With("Domain", domain)
+	}
+	return err
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	NewJsonHandler(func(*http.Request) (JsonResponder, error) {
+		return nil, err
+	}).ServeHTTP(w, r)
+}
@@ -0,0 +1,132 @@
+package rest
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/auth"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testAuthApp(t *testing.T) (*RestApplication, func()) {
+	app, stop := testApp()
+	authenticator, err := auth.NewAuthenticator([]auth.Grant{
+		{Principal: "publisher", Token: "pub", Domains: []string{"d"}, Permissions: []auth.Permission{auth.Read, auth.Append}},
+		{Principal: "admin", Token: "adm", Domains: []string{"d"}, Permissions: []auth.Permission{auth.Admin}},
+		{Principal: "watcher", Token: "sub", Domains: []string{"d"}, Permissions: []auth.Permission{auth.Subscribe}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to build authenticator: %s", err)
+	}
+	app.Authenticator = authenticator
+	return app, stop
+}
+
+func authRequest(h http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestAuthentication(t *testing.T) {
+	app, stop := testAuthApp(t)
+	defer stop()
+	h := app.Handler()
+
+	recorder := authRequest(h, "GET", "/v1/domains/d", "", "")
+	if recorder.Code != http.StatusUnauthorized || recorder.Header().Get("WWW-Authenticate") != `Bearer realm="botlnek"` {
+		t.Errorf("Expected a 401 challenge without a token; got %d %q", recorder.Code, recorder.Header().Get("WWW-Authenticate"))
+	}
+	recorder = authRequest(h, "GET", "/v1/domains/d", "wrong", "")
+	if recorder.Code != http.StatusUnauthorized || !strings.Contains(recorder.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Errorf("Expected a 401 invalid_token challenge; got %d %q", recorder.Code, recorder.Header().Get("WWW-Authenticate"))
+	}
+	if body := recorder.Body.String(); body != `{"Code":"unauthenticated","Message":"The bearer token is not recognized"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+
+	// The probes and the spec are open.
+	for _, target := range []string{"/healthz", "/readyz", "/v1/openapi.json"} {
+		if recorder := authRequest(h, "GET", target, "", ""); recorder.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200 without a token; got %d", target, recorder.Code)
+		}
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	app, stop := testAuthApp(t)
+	defer stop()
+	h := app.Handler()
+
+	cases := []struct {
+		method, target, token, body string
+		status                      int
+	}{
+		{"POST", "/v1/domains", "pub", `{"Key": "d"}`, 403},
+		{"POST", "/v1/domains", "adm", `{"Key": "e"}`, 403},
+		{"POST", "/v1/domains", "adm", `{"Key": "d"}`, 201},
+		{"GET", "/v1/domains/d", "pub", "", 200},
+		{"GET", "/v1/domains/d", "sub", "", 403},
+		{"GET", "/v1/domains/e", "pub", "", 403},
+		{"POST", "/v1/aggregates/d/g/t", "pub", `{"Keys": {"k": "v"}}`, 201},
+		{"POST", "/v1/aggregates/d/g/t", "sub", `{"Keys": {"k": "w"}}`, 403},
+		{"POST", "/v1/aggregates/e/g/t", "pub", `{"Keys": {"k": "v"}}`, 403},
+		{"GET", "/v1/aggregates/d/g", "adm", "", 200},
+		{"GET", "/v1/domains/d/changes", "pub", "", 200},
+		{"GET", "/v1/events", "pub", "", 403},
+	}
+	for _, c := range cases {
+		recorder := authRequest(h, c.method, c.target, c.token, c.body)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s as %s: expected %d; got %d (%s)", c.method, c.target, c.token, c.status, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder := authRequest(h, "POST", "/v1/aggregates/d/g/t", "sub", `{"Keys": {"k": "w"}}`)
+	if body := recorder.Body.String(); body != `{"Code":"forbidden","Message":"Principal \"watcher\" lacks append permission","Details":{"Domain":"d","Permission":"append"}}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+
+	// Lists give only the domains the principal may read.
+	app.DomainWriter.AppendNewDomain(model.Domain{Key: "e"})
+	recorder = authRequest(h, "GET", "/v1/domains", "pub", "")
+	if body := recorder.Body.String(); body != `{"Domains":["d"]}` {
+		t.Errorf("Unexpected domain list %s", body)
+	}
+
+	// The publisher is recorded against its source.
+	aggr, _ := app.AggregateReader.GetAggregate("d", "g")
+	if aggr == nil || len(aggr.Sources["t"]) != 1 {
+		t.Fatalf("Expected one source; got %v", aggr)
+	}
+	if p := aggr.Sources["t"][0].Provenance; p == nil || p.Principal != "publisher" {
+		t.Errorf("Expected the publisher to be recorded; got %v", p)
+	}
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+	app, stop := testAuthApp(t)
+	defer stop()
+	watcher := app.Authenticator.Authenticate("sub")
+	visible := subscriptionFilter(watcher)
+	for event, expected := range map[string]bool{
+		`{"DomainKey": "d", "Aggregate": {}}`: true,
+		`{"DomainKey": "e", "Aggregate": {}}`: false,
+		`{"info": "subscription started"}`:    true,
+	} {
+		if visible([]byte(event)) != expected {
+			t.Errorf("Event %s should be visible: %t", event, expected)
+		}
+	}
+	if !subscriptionFilter(nil)([]byte(`{"DomainKey": "e"}`)) {
+		t.Error("Without authentication, every event is visible")
+	}
+}
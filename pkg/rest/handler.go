@@ -2,18 +2,24 @@ package rest
 
 import (
 	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/model"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type JsonResponder interface {
 	json.Marshaler
 	StatusCode() int
+	// Headers to set on the response, beyond those
+	// describing the JSON body.
+	Header() http.Header
 }
 
 type jsonResponse struct {
 	payload    interface{}
 	statusCode int
+	header     http.Header
 }
 
 func (j *jsonResponse) MarshalJSON() ([]byte, error) {
@@ -27,33 +33,96 @@ func (j *jsonResponse) StatusCode() int {
 	return j.statusCode
 }
 
+func (j *jsonResponse) Header() http.Header {
+	return j.header
+}
+
 func NewJsonResponse(code int, payload interface{}) JsonResponder {
-	return &jsonResponse{payload: payload, statusCode: code}
+	return &jsonResponse{payload: payload, statusCode: code, header: make(http.Header)}
+}
+
+// The status code for each error code; errors without
+// a code are internal server errors.
+var errorStatus = map[model.ErrorCode]int{
+	model.CodeNotFound:           http.StatusNotFound,
+	model.CodeConflict:           http.StatusConflict,
+	model.CodePreconditionFailed: http.StatusPreconditionFailed,
+	model.CodeInvalid:            http.StatusBadRequest,
+	model.CodeSealed:             http.StatusConflict,
+	model.CodeUnavailable:        http.StatusServiceUnavailable,
+	model.CodeUnsupported:        http.StatusNotImplemented,
+	model.CodeUnauthenticated:    http.StatusUnauthorized,
+	model.CodeForbidden:          http.StatusForbidden,
+	model.CodeInternal:           http.StatusInternalServerError,
+}
+
+// The error code for a status code, for errors given a status
+// but no code; derived from the status text for codes the
+// model doesn't define.
+func errorCodeForStatus(status int) model.ErrorCode {
+	for code, s := range errorStatus {
+		// Sealed shares its status with the more general conflict.
+		if s == status && code != model.CodeSealed {
+			return code
+		}
+	}
+	return model.ErrorCode(strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1)))
 }
 
 type jsonError struct {
-	err        error
+	code       model.ErrorCode
+	message    string
+	details    map[string]interface{}
 	statusCode int
+	header     http.Header
 }
 
-type errMsg struct {
-	Error string
+// The stable shape of every error response body.
+type errorBody struct {
+	Code    model.ErrorCode
+	Message string
+	Details map[string]interface{} `json:",omitempty"`
 }
 
 func (je jsonError) MarshalJSON() ([]byte, error) {
-	return json.Marshal(errMsg{Error: je.Error()})
+	return json.Marshal(errorBody{Code: je.code, Message: je.message, Details: je.details})
 }
 
 func (je jsonError) Error() string {
-	return je.err.Error()
+	return je.message
 }
 
 func (je jsonError) StatusCode() int {
 	return je.statusCode
 }
 
-func NewJsonErrorResponse(code int, err error) JsonResponder {
-	return &jsonError{err: err, statusCode: code}
+func (je jsonError) Header() http.Header {
+	return je.header
+}
+
+// An error response with the given status.  The error's own code
+// and details are kept if its code calls for that status; the
+// error may be nil, in which case the status text is the message.
+func NewJsonErrorResponse(status int, err error) JsonResponder {
+	je := &jsonError{
+		code:       errorCodeForStatus(status),
+		message:    http.StatusText(status),
+		statusCode: status,
+		header:     make(http.Header),
+	}
+	if err != nil {
+		je.message = err.Error()
+		if coded := model.AsCodedError(err); coded != nil && errorStatus[coded.ErrorCode()] == status {
+			je.code = coded.ErrorCode()
+			je.details = coded.ErrorDetails()
+		}
+	}
+	return je
+}
+
+// An error response with the status its code calls for.
+func ErrorResponse(err error) JsonResponder {
+	return NewJsonErrorResponse(errorStatus[model.CodeOf(err)], err)
 }
 
 type JsonHandler struct {
@@ -63,7 +132,8 @@ type JsonHandler struct {
 func (h JsonHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	result, err := h.jsonHandler(r)
 	if err != nil {
-		result = NewJsonErrorResponse(500, err)
+		AnnotateRequest(r, "error", err)
+		result = ErrorResponse(err)
 	}
 
 	body, err := result.MarshalJSON()
@@ -77,6 +147,9 @@ func (h JsonHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Set the headers first lest they become trailers
 	header := w.Header()
+	for k, v := range result.Header() {
+		header[k] = v
+	}
 	if body == nil {
 		header.Set("Content-Length", "0")
 	} else {
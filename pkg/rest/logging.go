@@ -0,0 +1,97 @@
+package rest
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/logging"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+	// Longest client-supplied request ID we'll adopt
+	maxRequestIDLength = 128
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	accessEntryKey
+	paramsKey
+	principalKey
+)
+
+// Fields gathered over the course of a request for its access
+// log entry.
+type accessEntry struct {
+	mutex  sync.Mutex
+	fields []interface{}
+}
+
+// Adds key/value pairs to the request's access log entry, for
+// details (like the domain or aggregate) that only the handler knows.
+func AnnotateRequest(r *http.Request, keyvals ...interface{}) {
+	if entry, ok := r.Context().Value(accessEntryKey).(*accessEntry); ok {
+		entry.mutex.Lock()
+		entry.fields = append(entry.fields, keyvals...)
+		entry.mutex.Unlock()
+	}
+}
+
+// The ID assigned to the request by the access log, if any.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// Assigns each request an ID (adopting the client's X-Request-ID if
+// it sends a reasonable one), echoes it in the response, and logs one
+// entry per request on completion.
+func accessLog(logger *logging.Logger, route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+
+		entry := &accessEntry{}
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, accessEntryKey, entry)
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		level := logging.Info
+		if recorder.status >= 500 {
+			level = logging.Error
+		}
+		entry.mutex.Lock()
+		fields := append([]interface{}{
+			"request_id", id,
+			"method", r.Method,
+			"route", route,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration", time.Since(start),
+		}, entry.fields...)
+		entry.mutex.Unlock()
+		logger.Log(level, "request", fields...)
+	})
+}
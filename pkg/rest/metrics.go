@@ -0,0 +1,76 @@
+package rest
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The zero value records nothing.
+type httpMetrics struct {
+	requests *metrics.Counter
+	latency  *metrics.Histogram
+}
+
+func newHttpMetrics(registry *metrics.Registry) httpMetrics {
+	if registry == nil {
+		return httpMetrics{}
+	}
+	return httpMetrics{
+		requests: registry.Counter(
+			"botlnek_http_requests_total",
+			"HTTP requests, by route, method and status code.",
+			"route", "method", "status",
+		),
+		latency: registry.Histogram(
+			"botlnek_http_request_duration_seconds",
+			"HTTP request latency, by route and method.",
+			metrics.LatencyBuckets,
+			"route", "method",
+		),
+	}
+}
+
+// Records the status code while passing everything through,
+// including flushes for event streams.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (m httpMetrics) instrument(route string, h http.Handler) http.Handler {
+	if m.requests == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		m.requests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		m.latency.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
@@ -0,0 +1,622 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Serves the OpenAPI description of the API.
+func OpenAPIRoute(r *http.Request) (JsonResponder, error) {
+	return NewJsonResponse(http.StatusOK, json.RawMessage(OPENAPI_SPEC)), nil
+}
+
+// The OpenAPI 3 description of the API, maintained by hand alongside
+// the routes; the tests check that every route is described.
+const OPENAPI_SPEC = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "botlnek",
+    "version": "1",
+    "description": "Append-only aggregation of data sources into versioned aggregates, organized by domain.  API paths are also served without the /v1 prefix, for compatibility."
+  },
+  "security": [{"bearer": []}],
+  "paths": {
+    "/healthz": {
+      "get": {
+        "summary": "Liveness probe",
+        "operationId": "health",
+        "security": [],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Status"}
+        }
+      }
+    },
+    "/readyz": {
+      "get": {
+        "summary": "Readiness probe; ready once the store answers in good time",
+        "operationId": "ready",
+        "security": [],
+        "responses": {
+          "200": {"$ref": "#/components/responses/Status"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/metrics": {
+      "get": {
+        "summary": "Metrics in the Prometheus text format, if enabled",
+        "operationId": "metrics",
+        "responses": {
+          "200": {
+            "description": "Metrics",
+            "content": {"text/plain": {"schema": {"type": "string"}}}
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/openapi.json": {
+      "get": {
+        "summary": "This document",
+        "operationId": "openapi",
+        "security": [],
+        "responses": {
+          "200": {
+            "description": "The OpenAPI description of the API",
+            "content": {"application/json": {"schema": {"type": "object"}}}
+          }
+        }
+      }
+    },
+    "/v1/domains": {
+      "get": {
+        "summary": "List the domains the caller may read",
+        "operationId": "listDomains",
+        "responses": {
+          "200": {
+            "description": "Domain keys",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "Domains": {"type": "array", "items": {"type": "string"}}
+                  }
+                }
+              }
+            }
+          },
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Register a domain",
+        "description": "Registering a domain whose key is taken is a no-op that gives the domain as first registered.",
+        "operationId": "createDomain",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Domain"}}}
+        },
+        "responses": {
+          "201": {"$ref": "#/components/responses/DomainRegistered"},
+          "202": {"$ref": "#/components/responses/DomainRegistered"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/domains/{domain}": {
+      "parameters": [{"$ref": "#/components/parameters/Domain"}],
+      "get": {
+        "summary": "Get a domain",
+        "operationId": "getDomain",
+        "parameters": [{"$ref": "#/components/parameters/IfNoneMatch"}],
+        "responses": {
+          "200": {
+            "description": "The domain",
+            "headers": {"ETag": {"$ref": "#/components/headers/ETag"}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Domain"}}}
+          },
+          "304": {"description": "The client's copy is current"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/domains/{domain}/changes": {
+      "parameters": [{"$ref": "#/components/parameters/Domain"}],
+      "get": {
+        "summary": "Page through the versions appended to the domain's aggregates, in order",
+        "operationId": "getDomainChanges",
+        "parameters": [
+          {
+            "name": "after",
+            "in": "query",
+            "description": "Change sequence number to follow; from the beginning if absent",
+            "schema": {"$ref": "#/components/schemas/ChangeSeq"}
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "description": "Page size; at most 1000",
+            "schema": {"type": "integer", "minimum": 1, "default": 100}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of changes",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ChangeFeed"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/domains/{domain}/aggregates": {
+      "parameters": [{"$ref": "#/components/parameters/Domain"}],
+      "get": {
+        "summary": "List the domain's aggregate keys, in order",
+        "operationId": "listAggregates",
+        "parameters": [
+          {"$ref": "#/components/parameters/Filter"},
+          {"name": "after", "in": "query", "description": "Aggregate key to follow; from the first if absent", "schema": {"type": "string"}},
+          {
+            "name": "limit",
+            "in": "query",
+            "description": "Page size; at most 1000",
+            "schema": {"type": "integer", "minimum": 1, "default": 100}
+          }
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of aggregate keys",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AggregateList"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/domains/{domain}/search": {
+      "parameters": [{"$ref": "#/components/parameters/Domain"}],
+      "get": {
+        "summary": "Find the domain's sources by their keys and attrs",
+        "description": "Each key.NAME parameter, like key.asof=2019-07-10T11:28:10Z, gives the value the sources' key NAME must have, and each attr.NAME parameter, like attr.series=foo-series, the value of attr NAME.  At least one is required.  Matches are paged by the change that registered them, in order.",
+        "operationId": "searchSources",
+        "parameters": [
+          {"name": "token", "in": "query", "description": "Only sources registered under this token", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/Filter"},
+          {
+            "name": "after",
+            "in": "query",
+            "description": "Change sequence number to follow; from the beginning if absent",
+            "schema": {"$ref": "#/components/schemas/ChangeSeq"}
+          },
+          {
+            "name": "limit",
+            "in": "query",
+            "description": "Page size; at most 1000",
+            "schema": {"type": "integer", "minimum": 1, "default": 100}
+          },
+          {
+            "name": "provenance",
+            "in": "query",
+            "description": "Whether to include each source's provenance",
+            "schema": {"type": "boolean", "default": false}
+          },
+          {"name": "principal", "in": "query", "description": "Only sources registered by this principal", "schema": {"type": "string"}},
+          {"name": "publisher", "in": "query", "description": "Only sources from this publisher", "schema": {"type": "string"}},
+          {"name": "remoteAddr", "in": "query", "description": "Only sources from this client address", "schema": {"type": "string"}},
+          {"name": "userAgent", "in": "query", "description": "Only sources from this user agent", "schema": {"type": "string"}},
+          {"name": "requestId", "in": "query", "description": "Only sources registered by this request", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "A page of matching sources",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SearchResults"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/domains/{domain}/sources/{token}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Domain"},
+        {"$ref": "#/components/parameters/Token"}
+      ],
+      "post": {
+        "summary": "Append a source to the aggregates given, or those the domain's key rule gives, under a collection token",
+        "description": "As appendSource, for each aggregate in turn; each gets its own version.  A failed request may have registered the source with some of the aggregates, and is safe to retry.",
+        "operationId": "appendDomainSource",
+        "parameters": [
+          {
+            "name": "aggregate",
+            "in": "query",
+            "description": "An aggregate to append to, rather than those of the domain's key rule; repeatable, up to 100",
+            "schema": {"type": "array", "items": {"type": "string"}},
+            "explode": true
+          },
+          {
+            "name": "If-Match",
+            "in": "header",
+            "description": "The aggregate's entity tag, or its version count, that the append requires; only for a single aggregate",
+            "schema": {"type": "string"}
+          },
+          {
+            "name": "X-Botlnek-Publisher",
+            "in": "header",
+            "description": "The publisher to record in the source's provenance",
+            "schema": {"type": "string"}
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Source"}}}
+        },
+        "responses": {
+          "201": {"$ref": "#/components/responses/SourcesAppended"},
+          "202": {"$ref": "#/components/responses/SourcesAppended"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/aggregates/{domain}/{aggregate}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Domain"},
+        {"$ref": "#/components/parameters/Aggregate"}
+      ],
+      "get": {
+        "summary": "Get an aggregate, optionally waiting for a new version",
+        "operationId": "getAggregate",
+        "parameters": [
+          {"$ref": "#/components/parameters/IfNoneMatch"},
+          {
+            "name": "waitForVersion",
+            "in": "query",
+            "description": "Respond once the aggregate has more than this many versions",
+            "schema": {"type": "integer", "minimum": 0}
+          },
+          {
+            "name": "timeout",
+            "in": "query",
+            "description": "How long to wait for the version, as a duration like \"30s\"",
+            "schema": {"type": "string", "default": "30s"}
+          },
+          {
+            "name": "provenance",
+            "in": "query",
+            "description": "Whether to include each source's provenance",
+            "schema": {"type": "boolean", "default": false}
+          },
+          {"name": "principal", "in": "query", "description": "Only sources registered by this principal", "schema": {"type": "string"}},
+          {"name": "publisher", "in": "query", "description": "Only sources from this publisher", "schema": {"type": "string"}},
+          {"name": "remoteAddr", "in": "query", "description": "Only sources from this client address", "schema": {"type": "string"}},
+          {"name": "userAgent", "in": "query", "description": "Only sources from this user agent", "schema": {"type": "string"}},
+          {"name": "requestId", "in": "query", "description": "Only sources registered by this request", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The aggregate",
+            "headers": {
+              "ETag": {"$ref": "#/components/headers/ETag"},
+              "Last-Modified": {"$ref": "#/components/headers/LastModified"}
+            },
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Aggregate"}}}
+          },
+          "204": {"description": "The wait timed out and the aggregate doesn't exist"},
+          "304": {"description": "The client's copy is current, or the wait timed out"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/aggregates/{domain}/{aggregate}/{token}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/Domain"},
+        {"$ref": "#/components/parameters/Aggregate"},
+        {"$ref": "#/components/parameters/Token"}
+      ],
+      "post": {
+        "summary": "Append a source to an aggregate under a collection token",
+        "description": "A source already registered under the token is a no-op that gives the original registration.",
+        "operationId": "appendSource",
+        "parameters": [
+          {
+            "name": "If-Match",
+            "in": "header",
+            "description": "The aggregate's entity tag, or its version count, that the append requires",
+            "schema": {"type": "string"}
+          },
+          {
+            "name": "X-Botlnek-Publisher",
+            "in": "header",
+            "description": "The publisher to record in the source's provenance",
+            "schema": {"type": "string"}
+          }
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Source"}}}
+        },
+        "responses": {
+          "201": {"$ref": "#/components/responses/SourceAppended"},
+          "202": {"$ref": "#/components/responses/SourceAppended"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "412": {"$ref": "#/components/responses/Error"},
+          "501": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/events": {
+      "get": {
+        "summary": "Stream aggregate mutations as they happen",
+        "operationId": "events",
+        "parameters": [{"$ref": "#/components/parameters/Filter"}],
+        "responses": {
+          "200": {
+            "description": "One JSON AggregateMessage per line, after an informational event",
+            "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/AggregateMessage"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {
+        "type": "http",
+        "scheme": "bearer",
+        "description": "API tokens grant read, append, subscribe, or admin permissions on some or all domains; required only if the server has tokens configured"
+      }
+    },
+    "parameters": {
+      "Domain": {"name": "domain", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Aggregate": {"name": "aggregate", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Token": {"name": "token", "in": "path", "required": true, "schema": {"type": "string"}},
+      "IfNoneMatch": {"name": "If-None-Match", "in": "header", "schema": {"type": "string"}},
+      "Filter": {
+        "name": "filter",
+        "in": "query",
+        "description": "Only aggregates meeting this filter expression, like count(\"A\") >= 2 and any(\"B\", attr.status == \"ok\")",
+        "schema": {"type": "string"}
+      }
+    },
+    "headers": {
+      "ETag": {"schema": {"type": "string"}},
+      "LastModified": {"schema": {"type": "string"}},
+      "Location": {"description": "Path of the resource", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Status": {
+        "description": "Status",
+        "content": {
+          "application/json": {
+            "schema": {"type": "object", "properties": {"Status": {"type": "string"}}}
+          }
+        }
+      },
+      "Error": {
+        "description": "Error",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      },
+      "DomainRegistered": {
+        "description": "The domain as registered; 201 if new, 202 if already registered",
+        "headers": {"Location": {"$ref": "#/components/headers/Location"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Domain"}}}
+      },
+      "SourceAppended": {
+        "description": "Where the source is registered; 201 if new, 202 if already registered",
+        "headers": {"Location": {"$ref": "#/components/headers/Location"}},
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SourceReceipt"}}}
+      },
+      "SourcesAppended": {
+        "description": "Where the source is registered, in each aggregate; 201 if new to any, 202 if already registered with all.  Location is given for a single aggregate.",
+        "headers": {"Location": {"$ref": "#/components/headers/Location"}},
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "Receipts": {"type": "array", "items": {"$ref": "#/components/schemas/SourceReceipt"}}
+              }
+            }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "StringMap": {"type": "object", "additionalProperties": {"type": "string"}},
+      "ChangeSeq": {"type": "string", "description": "16 hex digits", "pattern": "^[0-9a-f]{16}$"},
+      "Domain": {
+        "type": "object",
+        "required": ["Key"],
+        "properties": {
+          "Key": {"type": "string"},
+          "Attrs": {"$ref": "#/components/schemas/StringMap"},
+          "KeyRule": {"$ref": "#/components/schemas/KeyRule"},
+          "Mirrors": {"type": "array", "items": {"$ref": "#/components/schemas/Mirror"}}
+        }
+      },
+      "Mirror": {
+        "type": "object",
+        "description": "Mirrors sources newly registered in another domain, which must exist, into this one",
+        "required": ["Domain"],
+        "properties": {
+          "Domain": {"type": "string", "description": "The upstream domain"},
+          "Tokens": {"type": "array", "items": {"type": "string"}, "description": "Upstream tokens to mirror; all if absent"},
+          "Token": {"type": "string", "description": "Token to register mirrored sources under; the upstream token if absent"},
+          "KeyRule": {"$ref": "#/components/schemas/KeyRule", "description": "Derives the aggregate keys; templates may also use the upstream aggregate key as .Aggregate.  The upstream aggregate key if absent"}
+        }
+      },
+      "KeyRule": {
+        "type": "object",
+        "description": "How aggregate keys are derived from sources posted to the domain: either TimeKey, with optional Truncate, Hop, and Layout, or Template.  A rule may give up to 100 keys.",
+        "properties": {
+          "TimeKey": {"type": "string", "description": "Source key holding an RFC 3339 time"},
+          "Truncate": {"type": "string", "description": "Duration to truncate the time to, counting from the Unix epoch, like \"24h\"; the window size, with Hop"},
+          "Hop": {"type": "string", "description": "Duration between window starts; each window holding the time gives a key"},
+          "Layout": {"type": "string", "description": "Go time layout for the key, like \"20060102\"; RFC 3339 if absent"},
+          "Template": {"type": "string", "description": "Go text/template over the source's .Keys and .Attrs, with functions truncate, shift, and format; each line of output is a key"}
+        }
+      },
+      "Source": {
+        "type": "object",
+        "properties": {
+          "Keys": {"$ref": "#/components/schemas/StringMap"},
+          "Attrs": {"$ref": "#/components/schemas/StringMap"}
+        }
+      },
+      "ClockEntry": {
+        "type": "object",
+        "properties": {
+          "SeqNum": {"type": "string", "description": "Version sequence number; its format depends on the store's clock"},
+          "Approximate": {"type": "string", "format": "date-time"},
+          "ChangeSeq": {"$ref": "#/components/schemas/ChangeSeq"}
+        }
+      },
+      "SourceLog": {
+        "type": "object",
+        "properties": {
+          "VersionIdx": {"type": "integer"},
+          "Key": {"type": "string", "description": "Hash of the source's keys"},
+          "Source": {"$ref": "#/components/schemas/Source"},
+          "Provenance": {"$ref": "#/components/schemas/Provenance"},
+          "Origin": {"$ref": "#/components/schemas/SourceOrigin"}
+        }
+      },
+      "SourceOrigin": {
+        "type": "object",
+        "description": "Where a mirrored source was registered upstream",
+        "properties": {
+          "Domain": {"type": "string"},
+          "Aggregate": {"type": "string"},
+          "Token": {"type": "string"},
+          "VersionIdx": {"type": "integer"}
+        }
+      },
+      "Provenance": {
+        "type": "object",
+        "description": "Who registered the source; included in aggregate reads on request",
+        "properties": {
+          "Principal": {"type": "string"},
+          "RemoteAddr": {"type": "string"},
+          "UserAgent": {"type": "string"},
+          "RequestID": {"type": "string"},
+          "Publisher": {"type": "string"}
+        }
+      },
+      "Aggregate": {
+        "type": "object",
+        "properties": {
+          "Key": {"type": "string"},
+          "Attrs": {"$ref": "#/components/schemas/StringMap"},
+          "Log": {"type": "array", "items": {"$ref": "#/components/schemas/ClockEntry"}},
+          "Sources": {
+            "type": "object",
+            "description": "Source registrations by collection token",
+            "additionalProperties": {"type": "array", "items": {"$ref": "#/components/schemas/SourceLog"}}
+          }
+        }
+      },
+      "AggregateMessage": {
+        "type": "object",
+        "properties": {
+          "DomainKey": {"type": "string"},
+          "Aggregate": {"$ref": "#/components/schemas/Aggregate"}
+        }
+      },
+      "SourceReceipt": {
+        "type": "object",
+        "properties": {
+          "Domain": {"type": "string"},
+          "Aggregate": {"type": "string"},
+          "Token": {"type": "string"},
+          "KeyHash": {"type": "string"},
+          "VersionIdx": {"type": "integer"},
+          "ClockEntry": {"$ref": "#/components/schemas/ClockEntry"},
+          "New": {"type": "boolean"}
+        }
+      },
+      "Change": {
+        "type": "object",
+        "properties": {
+          "Seq": {"$ref": "#/components/schemas/ChangeSeq"},
+          "AggregateKey": {"type": "string"},
+          "VersionIdx": {"type": "integer"}
+        }
+      },
+      "ChangeFeed": {
+        "type": "object",
+        "properties": {
+          "Changes": {"type": "array", "items": {"$ref": "#/components/schemas/Change"}},
+          "Next": {"$ref": "#/components/schemas/ChangeSeq"}
+        }
+      },
+      "AggregateList": {
+        "type": "object",
+        "properties": {
+          "Aggregates": {"type": "array", "items": {"type": "string"}},
+          "Next": {"type": "string", "description": "The page's last key, to follow for the next page"}
+        }
+      },
+      "SearchResults": {
+        "type": "object",
+        "properties": {
+          "Aggregates": {"type": "array", "items": {"type": "string"}, "description": "Keys of the aggregates the page's sources are registered with"},
+          "Sources": {"type": "array", "items": {"$ref": "#/components/schemas/SourceMatch"}},
+          "Next": {"$ref": "#/components/schemas/ChangeSeq"}
+        }
+      },
+      "SourceMatch": {
+        "type": "object",
+        "description": "A source found by a search, with its aggregate and token, and the change that registered it",
+        "allOf": [{"$ref": "#/components/schemas/SourceLog"}],
+        "properties": {
+          "Aggregate": {"type": "string"},
+          "Token": {"type": "string"},
+          "ChangeSeq": {"$ref": "#/components/schemas/ChangeSeq"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["Code", "Message"],
+        "properties": {
+          "Code": {
+            "type": "string",
+            "description": "not_found, conflict, precondition_failed, invalid, sealed, unavailable, unsupported, unauthenticated, forbidden, or internal; others derive from the HTTP status, like method_not_allowed"
+          },
+          "Message": {"type": "string"},
+          "Details": {"type": "object"}
+        }
+      }
+    }
+  }
+}
+`
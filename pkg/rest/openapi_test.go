@@ -0,0 +1,134 @@
+package rest
+
+import (
+	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage
+}
+
+func parseSpec(t *testing.T, data []byte) (openAPIDocument, interface{}) {
+	var doc openAPIDocument
+	var raw interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("Spec is not valid JSON: %s", err)
+	}
+	json.Unmarshal(data, &raw)
+	return doc, raw
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	app.Metrics = metrics.NewRegistry()
+	doc, _ := parseSpec(t, []byte(OPENAPI_SPEC))
+
+	described := make(map[string]bool)
+	for _, info := range app.routes().Routes() {
+		operations, ok := doc.Paths[info.Pattern]
+		if !ok {
+			t.Errorf("Route %s (%s) is not in the spec", info.Name, info.Pattern)
+			continue
+		}
+		described[info.Pattern] = true
+		for _, method := range info.Methods {
+			if method == http.MethodHead {
+				continue
+			}
+			if _, ok := operations[strings.ToLower(method)]; !ok {
+				t.Errorf("Route %s (%s) method %s is not in the spec", info.Name, info.Pattern, method)
+			}
+		}
+		for operation := range operations {
+			if operation == "parameters" {
+				continue
+			}
+			found := false
+			for _, method := range info.Methods {
+				found = found || strings.ToLower(method) == operation
+			}
+			if !found {
+				t.Errorf("Spec describes %s %s, which the route doesn't serve", operation, info.Pattern)
+			}
+		}
+	}
+	for path := range doc.Paths {
+		if !described[path] {
+			t.Errorf("Spec describes %s, which isn't routed", path)
+		}
+	}
+}
+
+// Every reference points at something in the document.
+func TestOpenAPIReferences(t *testing.T) {
+	_, raw := parseSpec(t, []byte(OPENAPI_SPEC))
+	var walk func(node interface{})
+	walk = func(node interface{}) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			if ref, ok := n["$ref"].(string); ok {
+				var target interface{} = raw
+				for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+					m, _ := target.(map[string]interface{})
+					target = m[part]
+				}
+				if target == nil {
+					t.Errorf("Unresolved reference %s", ref)
+				}
+			}
+			for _, child := range n {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range n {
+				walk(child)
+			}
+		}
+	}
+	walk(raw)
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	recorder := httptest.NewRecorder()
+	app.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response %d (%s)", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	doc, _ := parseSpec(t, recorder.Body.Bytes())
+	if len(doc.Paths) == 0 {
+		t.Error("Served spec describes no paths")
+	}
+}
+
+func TestUnversionedAliases(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	for _, target := range []string{"/domains", "/v1/domains"} {
+		if recorder := postJson(h, target, `{"Key": "d"}`); recorder.Code/100 != 2 || recorder.Header().Get("Location") != "/v1/domains/d" {
+			t.Errorf("POST %s: unexpected response %d (Location %q)", target, recorder.Code, recorder.Header().Get("Location"))
+		}
+	}
+	for _, target := range []string{"/domains/d", "/v1/domains/d", "/v1/domains/d/"} {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("GET %s: expected 200; got %d", target, recorder.Code)
+		}
+	}
+	for _, target := range []string{"/v1/healthz", "/openapi.json"} {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expected 404; got %d", target, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A route table matching request paths against patterns like
+// "/aggregates/{domain}/{aggregate}", where each "{name}" matches
+// a single non-empty path segment.  Segments are matched before
+// percent-decoding, so an encoded "/" stays within its parameter.
+// A trailing slash on the request path is ignored.  A route may
+// have aliases: further patterns it serves, but which reverse
+// routing doesn't give.
+type Router struct {
+	routes []*route
+	named  map[string]*route
+	wrap   func(pattern string, h http.Handler) http.Handler
+	// Serves requests matching no route.
+	NotFound http.Handler
+}
+
+type route struct {
+	name     string
+	pattern  string
+	segments []string
+	aliases  [][]string
+	methods  map[string]http.Handler
+	handler  http.Handler
+}
+
+// Describes a registered route.
+type RouteInfo struct {
+	Name    string
+	Pattern string
+	Aliases []string
+	// Sorted, with HEAD implied by GET.
+	Methods []string
+}
+
+// Each route's handler is passed through wrap (if given) along
+// with its pattern, so middleware sees the route rather than the
+// raw path; method mismatches are served through it as well.
+func NewRouter(wrap func(pattern string, h http.Handler) http.Handler) *Router {
+	if wrap == nil {
+		wrap = func(pattern string, h http.Handler) http.Handler {
+			return h
+		}
+	}
+	return &Router{
+		named:    make(map[string]*route),
+		wrap:     wrap,
+		NotFound: http.NotFoundHandler(),
+	}
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}' {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+// Registers the handler for the method on the named route.  A name
+// always refers to the same pattern; registering it under another
+// pattern, or the same method twice, panics.
+func (rt *Router) Handle(name, method, pattern string, h http.Handler) {
+	rte, ok := rt.named[name]
+	if !ok {
+		rte = &route{
+			name:     name,
+			pattern:  pattern,
+			segments: splitPath(pattern),
+			methods:  make(map[string]http.Handler),
+		}
+		rte.handler = rt.wrap(pattern, http.HandlerFunc(rte.dispatch))
+		rt.named[name] = rte
+		rt.routes = append(rt.routes, rte)
+	} else if rte.pattern != pattern {
+		panic(fmt.Sprintf("route %s registered with patterns %s and %s", name, rte.pattern, pattern))
+	}
+	if _, ok := rte.methods[method]; ok {
+		panic(fmt.Sprintf("route %s registered twice for %s", name, method))
+	}
+	rte.methods[method] = h
+}
+
+// Serves the named route at a further pattern, which must have the
+// same parameters in the same order.
+func (rt *Router) Alias(name, pattern string) {
+	rte, ok := rt.named[name]
+	if !ok {
+		panic(fmt.Sprintf("cannot alias unknown route %s", name))
+	}
+	segments := splitPath(pattern)
+	if !reflect.DeepEqual(paramNames(segments), paramNames(rte.segments)) {
+		panic(fmt.Sprintf("alias %s of route %s has different parameters", pattern, name))
+	}
+	rte.aliases = append(rte.aliases, segments)
+}
+
+func paramNames(segments []string) []string {
+	names := make([]string, 0)
+	for _, segment := range segments {
+		if name, isParam := paramName(segment); isParam {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// The registered routes, in registration order.
+func (rt *Router) Routes() []RouteInfo {
+	infos := make([]RouteInfo, len(rt.routes))
+	for i, rte := range rt.routes {
+		infos[i] = RouteInfo{Name: rte.name, Pattern: rte.pattern, Methods: rte.allowed()}
+		for _, alias := range rte.aliases {
+			infos[i].Aliases = append(infos[i].Aliases, "/"+strings.Join(alias, "/"))
+		}
+	}
+	return infos
+}
+
+func (rt *Router) HandleJson(name, method, pattern string, h func(*http.Request) (JsonResponder, error)) {
+	rt.Handle(name, method, pattern, NewJsonHandler(h))
+}
+
+// The parameter values if the escaped path matches the route
+// or one of its aliases.
+func (rte *route) match(segments []string) (map[string]string, bool) {
+	if params, ok := matchSegments(rte.segments, segments); ok {
+		return params, true
+	}
+	for _, alias := range rte.aliases {
+		if params, ok := matchSegments(alias, segments); ok {
+			return params, true
+		}
+	}
+	return nil, false
+}
+
+func matchSegments(pattern, segments []string) (map[string]string, bool) {
+	if len(segments) != len(pattern) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, want := range pattern {
+		name, isParam := paramName(want)
+		if !isParam {
+			if segments[i] != want {
+				return nil, false
+			}
+			continue
+		}
+		value, err := url.PathUnescape(segments[i])
+		if err != nil || value == "" {
+			return nil, false
+		}
+		params[name] = value
+	}
+	return params, true
+}
+
+// The methods the route supports, sorted, with HEAD implied by GET.
+func (rte *route) allowed() []string {
+	methods := make([]string, 0, len(rte.methods)+1)
+	for method := range rte.methods {
+		methods = append(methods, method)
+	}
+	if _, ok := rte.methods[http.MethodGet]; ok {
+		if _, ok := rte.methods[http.MethodHead]; !ok {
+			methods = append(methods, http.MethodHead)
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func (rte *route) dispatch(w http.ResponseWriter, r *http.Request) {
+	method := r.Method
+	if _, ok := rte.methods[method]; !ok && method == http.MethodHead {
+		method = http.MethodGet
+	}
+	h, ok := rte.methods[method]
+	if !ok {
+		allowed := rte.allowed()
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		NewJsonHandler(func(r *http.Request) (JsonResponder, error) {
+			return NewJsonErrorResponse(
+				http.StatusMethodNotAllowed,
+				fmt.Errorf("Method %s is not allowed; use %s", r.Method, strings.Join(allowed, ", ")),
+			), nil
+		}).ServeHTTP(w, r)
+		return
+	}
+	for _, segment := range rte.segments {
+		if name, isParam := paramName(segment); isParam {
+			AnnotateRequest(r, name, PathParam(r, name))
+		}
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := splitPath(r.URL.EscapedPath())
+	for _, rte := range rt.routes {
+		if params, ok := rte.match(segments); ok {
+			ctx := context.WithValue(r.Context(), paramsKey, params)
+			rte.handler.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+	}
+	rt.NotFound.ServeHTTP(w, r)
+}
+
+// The decoded value of the named path parameter of the request's
+// route, or "" if there is none.
+func PathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(paramsKey).(map[string]string)
+	return params[name]
+}
+
+// The escaped path of the named route with the given parameter
+// values, in the order they appear in its pattern.
+func (rt *Router) Path(name string, values ...string) (string, error) {
+	rte, ok := rt.named[name]
+	if !ok {
+		return "", fmt.Errorf("No route named %q", name)
+	}
+	segments := make([]string, len(rte.segments))
+	used := 0
+	for i, segment := range rte.segments {
+		if _, isParam := paramName(segment); !isParam {
+			segments[i] = segment
+			continue
+		}
+		if used >= len(values) {
+			return "", fmt.Errorf("Route %q needs more than %d values", name, len(values))
+		}
+		if values[used] == "" {
+			return "", errors.New("Path parameters cannot be empty")
+		}
+		segments[i] = url.PathEscape(values[used])
+		used++
+	}
+	if used != len(values) {
+		return "", fmt.Errorf("Route %q takes %d values; got %d", name, used, len(values))
+	}
+	return "/" + strings.Join(segments, "/"), nil
+}
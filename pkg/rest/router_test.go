@@ -0,0 +1,114 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testRouter() *Router {
+	rt := NewRouter(nil)
+	echo := func(r *http.Request) (JsonResponder, error) {
+		return NewJsonResponse(http.StatusOK, map[string]string{
+			"method":    r.Method,
+			"domain":    PathParam(r, "domain"),
+			"aggregate": PathParam(r, "aggregate"),
+		}), nil
+	}
+	rt.HandleJson("domains", http.MethodGet, "/domains", echo)
+	rt.HandleJson("domains", http.MethodPost, "/domains", echo)
+	rt.HandleJson("aggregate", http.MethodGet, "/aggregates/{domain}/{aggregate}", echo)
+	rt.HandleJson("aggregate", http.MethodPut, "/aggregates/{domain}/{aggregate}", echo)
+	return rt
+}
+
+func serveRequest(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+	return recorder
+}
+
+func TestRouterMatching(t *testing.T) {
+	rt := testRouter()
+	cases := []struct {
+		method, target string
+		status         int
+		body           string
+	}{
+		{"GET", "/domains", 200, `{"aggregate":"","domain":"","method":"GET"}`},
+		{"POST", "/domains/", 200, `{"aggregate":"","domain":"","method":"POST"}`},
+		{"GET", "/aggregates/d/a", 200, `{"aggregate":"a","domain":"d","method":"GET"}`},
+		{"GET", "/aggregates/d%2Fx/a%20b/", 200, `{"aggregate":"a b","domain":"d/x","method":"GET"}`},
+		{"GET", "/aggregates/d/x/a", 404, ""},
+		{"GET", "/aggregates//a", 404, ""},
+		{"GET", "/aggregates/d", 404, ""},
+		{"GET", "/nowhere", 404, ""},
+	}
+	for _, c := range cases {
+		recorder := serveRequest(rt, c.method, c.target)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s: expected status %d; got %d", c.method, c.target, c.status, recorder.Code)
+		}
+		if c.body != "" && recorder.Body.String() != c.body {
+			t.Errorf("%s %s: expected body %s; got %s", c.method, c.target, c.body, recorder.Body.String())
+		}
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	rt := testRouter()
+	recorder := serveRequest(rt, "DELETE", "/aggregates/d/a")
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405; got %d", recorder.Code)
+	}
+	if allow := recorder.Header().Get("Allow"); allow != "GET, HEAD, PUT" {
+		t.Errorf("Unexpected Allow header %q", allow)
+	}
+	if recorder := serveRequest(rt, "HEAD", "/aggregates/d/a"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected HEAD to be served by GET; got %d", recorder.Code)
+	}
+}
+
+func TestRouterPath(t *testing.T) {
+	rt := testRouter()
+	path, err := rt.Path("aggregate", "d/x", "a b")
+	if err != nil || path != "/aggregates/d%2Fx/a%20b" {
+		t.Errorf("Unexpected path %q (%v)", path, err)
+	}
+	if recorder := serveRequest(rt, "GET", path); recorder.Body.String() != `{"aggregate":"a b","domain":"d/x","method":"GET"}` {
+		t.Errorf("Reversed path does not route back: %s", recorder.Body.String())
+	}
+	if path, err := rt.Path("domains"); err != nil || path != "/domains" {
+		t.Errorf("Unexpected path %q (%v)", path, err)
+	}
+	for _, values := range [][]string{{"d"}, {"d", "a", "t"}, {"", "a"}} {
+		if _, err := rt.Path("aggregate", values...); err == nil {
+			t.Errorf("Expected an error for values %q", values)
+		}
+	}
+	if _, err := rt.Path("nothing"); err == nil {
+		t.Error("Expected an error for an unknown route")
+	}
+}
+
+func TestRouterAliases(t *testing.T) {
+	rt := testRouter()
+	rt.Alias("aggregate", "/old/{domain}/{aggregate}")
+	if recorder := serveRequest(rt, "GET", "/old/d/a"); recorder.Body.String() != `{"aggregate":"a","domain":"d","method":"GET"}` {
+		t.Errorf("Alias not routed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if path, _ := rt.Path("aggregate", "d", "a"); path != "/aggregates/d/a" {
+		t.Errorf("Reverse routing should ignore aliases; got %q", path)
+	}
+	infos := rt.Routes()
+	if len(infos) != 2 || infos[1].Name != "aggregate" || len(infos[1].Aliases) != 1 || infos[1].Aliases[0] != "/old/{domain}/{aggregate}" {
+		t.Errorf("Unexpected route info %v", infos)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for an alias with different parameters")
+		}
+	}()
+	rt.Alias("aggregate", "/old/{aggregate}/{domain}")
+}
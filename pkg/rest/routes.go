@@ -1,170 +1,729 @@
 package rest
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/auth"
+	"github.com/ethanrowe/botlnek/pkg/filter"
+	"github.com/ethanrowe/botlnek/pkg/logging"
+	"github.com/ethanrowe/botlnek/pkg/metrics"
 	"github.com/ethanrowe/botlnek/pkg/model"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
-func HelloWorldRoute(r *http.Request) (JsonResponder, error) {
-	result := struct {
-		HttpMethod string
-		RemoteAddr string
-		Path       string
-	}{
-		r.Method,
-		r.RemoteAddr,
-		r.URL.Path,
-	}
-	return NewJsonResponse(200, result), nil
+func NotFoundRoute(r *http.Request) (JsonResponder, error) {
+	return nil, model.Errorf(model.CodeNotFound, "No such resource: %s", r.URL.Path)
+}
+
+// The process is up and serving HTTP.
+func HealthRoute(r *http.Request) (JsonResponder, error) {
+	return NewJsonResponse(http.StatusOK, struct{ Status string }{"ok"}), nil
 }
 
 type RestApplication struct {
-	DomainWriter    model.DomainWriter
-	DomainReader    model.DomainReader
+	DomainWriter model.DomainWriter
+	DomainReader model.DomainReader
+	// Optional; domain lists are empty without it.
+	DomainLister    model.DomainLister
 	AggregateWriter model.AggregateWriter
-	AggregateReader model.AggregateReader
-	EventSource     model.MutationNotifier
+	// Optional; required for If-Match appends.
+	ConditionalAggregateWriter model.ConditionalAggregateWriter
+	// Optional; used for all appends if given, so sources
+	// record who registered them.
+	AttributedAggregateWriter model.AttributedAggregateWriter
+	AggregateReader           model.AggregateReader
+	// Optional; required for source searches.
+	SourceSearcher model.SourceSearcher
+	// Optional; required for aggregate lists.
+	AggregateLister model.AggregateLister
+	// Optional; required for waitForVersion reads.
+	AggregateWaiter model.AggregateWaiter
+	// Optional; required for domain change feeds.
+	ChangeFeedReader model.ChangeFeedReader
+	EventSource      model.MutationNotifier
+	// Upper bound on long-poll timeouts; DefaultMaxWaitTimeout if zero.
+	MaxWaitTimeout time.Duration
+	// Events buffered per subscriber; DefaultSubscriberBuffer if zero.
+	SubscriberBuffer int
+	// Optional; metrics are recorded and served at /metrics if given.
+	Metrics *metrics.Registry
+	// Optional; consulted by /readyz if given.
+	ReadinessChecker model.ReadinessChecker
+	// Deadline for readiness checks; DefaultReadinessTimeout if zero.
+	ReadinessTimeout time.Duration
+	// Optional; requests are logged here if given.
+	Logger *logging.Logger
+	// Optional; if given, every route but the probes and the
+	// OpenAPI description requires a bearer token it recognizes.
+	Authenticator *auth.Authenticator
+
+	closing     chan bool
+	closingOnce sync.Once
+	closeOnce   sync.Once
+	router      *Router
+	routerOnce  sync.Once
+}
+
+// Closed once Shutdown is called.
+func (app *RestApplication) shuttingDown() chan bool {
+	app.closingOnce.Do(func() {
+		app.closing = make(chan bool)
+	})
+	return app.closing
+}
+
+// Ends long-lived requests: event subscriptions get a final
+// event, and long polls respond as if they timed out.  Suitable
+// for http.Server.RegisterOnShutdown.
+func (app *RestApplication) Shutdown() {
+	closing := app.shuttingDown()
+	app.closeOnce.Do(func() {
+		close(closing)
+	})
 }
 
-func (app *RestApplication) DomainsCollectionRoute(r *http.Request) (JsonResponder, error) {
-	if r.Method == http.MethodGet {
-		// For now we'll always respond with an empty list.
-		return NewJsonResponse(200, struct{ Domains []string }{make([]string, 0)}), nil
+// Ready once the backing store can serve requests in good time.
+func (app *RestApplication) ReadinessRoute(r *http.Request) (JsonResponder, error) {
+	if app.ReadinessChecker != nil {
+		timeout := app.ReadinessTimeout
+		if timeout <= 0 {
+			timeout = DefaultReadinessTimeout
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if err := app.ReadinessChecker.CheckReady(ctx); err != nil {
+			return NewJsonErrorResponse(http.StatusServiceUnavailable, err), nil
+		}
 	}
-	if r.Method == http.MethodPost {
-		domain, err := DomainFromRequest(r)
+	return NewJsonResponse(http.StatusOK, struct{ Status string }{"ready"}), nil
+}
+
+// Lists the domains the principal (if any) may read.
+func (app *RestApplication) ListDomainsRoute(r *http.Request) (JsonResponder, error) {
+	keys := make([]model.DomainKey, 0)
+	if app.DomainLister != nil {
+		all, err := app.DomainLister.ListDomains()
 		if err != nil {
-			return NewJsonErrorResponse(http.StatusBadRequest, err), nil
+			return nil, err
+		}
+		principal := PrincipalFromRequest(r)
+		for _, key := range all {
+			if principal == nil || principal.Allows(auth.Read, key) {
+				keys = append(keys, key)
+			}
 		}
+	}
+	return NewJsonResponse(200, struct{ Domains []model.DomainKey }{keys}), nil
+}
+
+func (app *RestApplication) CreateDomainRoute(r *http.Request) (JsonResponder, error) {
+	domain, err := DomainFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorize(r, auth.Admin, domain.Key); err != nil {
+		return nil, err
+	}
+
+	result, err := app.DomainWriter.AppendNewDomain(domain)
+	if err != nil {
+		return nil, err
+	}
 
-		result, err := app.DomainWriter.AppendNewDomain(domain)
+	// A duplicate gives the domain as first registered, which
+	// may differ from this request's in its attributes.
+	statusCode := http.StatusCreated
+	if result == nil {
+		statusCode = http.StatusAccepted
+		result, err = app.DomainReader.GetDomain(domain.Key)
 		if err != nil {
 			return nil, err
 		}
-
-		var statusCode int
 		if result == nil {
-			statusCode = http.StatusAccepted
-		} else {
-			statusCode = http.StatusCreated
+			return nil, fmt.Errorf("Domain %q vanished after registration", domain.Key)
 		}
-		// Need to add a location header to the response,
-		// but I'll figure out the reverse routing later.
-		return NewJsonResponse(statusCode, nil), nil
 	}
-	return NewJsonErrorResponse(http.StatusMethodNotAllowed, errors.New("Only GET/POST are supported")), nil
+	resp := NewJsonResponse(statusCode, result)
+	if err := app.setLocation(resp, DOMAIN_ROUTE, string(domain.Key)); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 func (app *RestApplication) DomainRoute(r *http.Request) (JsonResponder, error) {
-	if r.Method == http.MethodGet {
-		key := model.DomainKey(strings.TrimPrefix(r.URL.Path, "/domains/"))
-		domain, err := app.DomainReader.GetDomain(key)
-		if err != nil {
-			return nil, err
+	key := model.DomainKey(PathParam(r, "domain"))
+	domain, err := app.getDomain(key)
+	if err != nil {
+		return nil, err
+	}
+	etag := domain.ETag()
+	var resp JsonResponder
+	if NoneMatch(r, etag) {
+		resp = NewJsonResponse(http.StatusNotModified, nil)
+	} else {
+		resp = NewJsonResponse(200, domain)
+	}
+	SetValidators(resp.Header(), etag, time.Time{})
+	return resp, nil
+}
+
+// Pages through the domain's change feed, following the change
+// sequence number given by the "after" parameter (or from the
+// beginning).  Next gives the "after" value for the following page.
+func (app *RestApplication) DomainChangesRoute(r *http.Request) (JsonResponder, error) {
+	if app.ChangeFeedReader == nil {
+		return nil, model.NewError(model.CodeUnsupported, "Change feeds are not supported")
+	}
+	key := model.DomainKey(PathParam(r, "domain"))
+	after, limit, err := ChangeParamsFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := app.getDomain(key); err != nil {
+		return nil, err
+	}
+	changes, err := app.ChangeFeedReader.GetChanges(key, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	next := after
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	return NewJsonResponse(http.StatusOK, struct {
+		Changes []model.Change
+		Next    model.ChangeSeq
+	}{changes, next}), nil
+}
+
+// Finds the domain's sources matching the query parameters, paging
+// through them as through the change feed: by the change sequence
+// number that registered them, following the "after" parameter.
+// Aggregates gives the keys of the aggregates the page's sources are
+// registered with.
+func (app *RestApplication) DomainSearchRoute(r *http.Request) (JsonResponder, error) {
+	if app.SourceSearcher == nil {
+		return nil, model.NewError(model.CodeUnsupported, "Source searches are not supported")
+	}
+	key := model.DomainKey(PathParam(r, "domain"))
+	query, err := SourceQueryFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	_, includeProvenance, err := AggregateViewFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	after, limit, err := ChangeParamsFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := app.getDomain(key); err != nil {
+		return nil, err
+	}
+	matches, err := app.SourceSearcher.SearchSources(key, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	aggregates := make([]model.AggregateKey, 0)
+	seen := make(map[model.AggregateKey]bool)
+	next := after
+	for i := range matches {
+		if !includeProvenance {
+			matches[i].Provenance = nil
 		}
-		if domain == nil {
-			return NewJsonErrorResponse(http.StatusNotFound, errors.New("Cannot find domain: "+string(key))), nil
+		if aggregate := matches[i].Aggregate; !seen[aggregate] {
+			seen[aggregate] = true
+			aggregates = append(aggregates, aggregate)
 		}
-		return NewJsonResponse(200, domain), nil
+		next = matches[i].ChangeSeq
 	}
-	return NewJsonErrorResponse(http.StatusMethodNotAllowed, errors.New("Only GET is supported")), nil
+	sort.Slice(aggregates, func(i, j int) bool { return aggregates[i] < aggregates[j] })
+	return NewJsonResponse(http.StatusOK, struct {
+		Aggregates []model.AggregateKey
+		Sources    []model.SourceMatch
+		Next       model.ChangeSeq
+	}{aggregates, matches, next}), nil
 }
 
-func (app *RestApplication) AggregatesRoute(r *http.Request) (JsonResponder, error) {
-	keys := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/aggregates/"), "/", 3)
-	fmt.Printf("AggregatesRoute path %q: %q\n", r.URL.Path, keys)
+// Lists the domain's aggregate keys in order, meeting the "filter"
+// parameter if given, a page at a time: Next is the last key of the
+// page, for the "after" parameter of the next.
+func (app *RestApplication) DomainAggregatesRoute(r *http.Request) (JsonResponder, error) {
+	if app.AggregateLister == nil {
+		return nil, model.NewError(model.CodeUnsupported, "Aggregate lists are not supported")
+	}
+	key := model.DomainKey(PathParam(r, "domain"))
+	after, limit, expr, err := AggregateListParamsFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := app.getDomain(key); err != nil {
+		return nil, err
+	}
+	keys, err := app.AggregateLister.ListAggregates(key, after, limit, expr)
+	if err != nil {
+		return nil, err
+	}
+	next := after
+	if len(keys) > 0 {
+		next = keys[len(keys)-1]
+	}
+	return NewJsonResponse(http.StatusOK, struct {
+		Aggregates []model.AggregateKey
+		Next       model.AggregateKey
+	}{keys, next}), nil
+}
 
-	switch r.Method {
-	case http.MethodGet:
-		if len(keys) == 2 {
-			p, e := app.AggregateReader.GetAggregate(model.DomainKey(keys[0]), model.AggregateKey(keys[1]))
-			if p != nil {
-				return NewJsonResponse(http.StatusOK, p), e
-			}
+func (app *RestApplication) AggregateRoute(r *http.Request) (JsonResponder, error) {
+	domain := model.DomainKey(PathParam(r, "domain"))
+	aggregate := model.AggregateKey(PathParam(r, "aggregate"))
+	filter, includeProvenance, err := AggregateViewFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.URL.Query().Get("waitForVersion") != "" {
+		return app.waitForAggregate(r, domain, aggregate, filter, includeProvenance)
+	}
+	p, err := app.AggregateReader.GetAggregate(domain, aggregate)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, aggregateNotFound(domain, aggregate)
+	}
+	etag := p.ETag()
+	var resp JsonResponder
+	if NoneMatch(r, etag) {
+		resp = NewJsonResponse(http.StatusNotModified, nil)
+	} else {
+		resp = NewJsonResponse(http.StatusOK, p.View(filter, includeProvenance))
+	}
+	SetValidators(resp.Header(), etag, p.LastModified())
+	return resp, nil
+}
+
+func (app *RestApplication) AppendSourceRoute(r *http.Request) (JsonResponder, error) {
+	domain := model.DomainKey(PathParam(r, "domain"))
+	aggregate := model.AggregateKey(PathParam(r, "aggregate"))
+	s, err := SourceFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := app.appendSource(r, domain, aggregate, PathParam(r, "token"), s)
+	if err != nil {
+		return nil, err
+	}
+	resp := NewJsonResponse(appendStatus(receipt.New), receipt)
+	if err := app.setLocation(resp, AGGREGATE_ROUTE, string(domain), string(aggregate)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Appends the source to each aggregate given by the "aggregate"
+// parameters, or else by the domain's key rule, in turn.  Each
+// aggregate gets its own version; an append failing partway leaves
+// the earlier ones, which a retry finds already registered.
+func (app *RestApplication) AppendDomainSourceRoute(r *http.Request) (JsonResponder, error) {
+	key := model.DomainKey(PathParam(r, "domain"))
+	s, err := SourceFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := app.getDomain(key)
+	if err != nil {
+		return nil, err
+	}
+	aggregates, err := AggregateKeysFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(aggregates) == 0 {
+		if domain.KeyRule.IsZero() {
+			return nil, model.Errorf(model.CodeInvalid, "Domain %q has no key rule; sources must be posted to an aggregate", key).With("Domain", key)
 		}
-		return NewJsonResponse(http.StatusNotFound, nil), nil
-	case http.MethodPost:
-		var e error
-		fmt.Println("POST case")
-		if len(keys) == 3 {
-			fmt.Println("Parsing source from body")
-			s, e := SourceFromRequest(r)
-			if e == nil {
-				fmt.Printf("Appending source: %q\n", s)
-				resp, e := app.AggregateWriter.AppendNewSource(
-					model.DomainKey(keys[0]),
-					model.AggregateKey(keys[1]),
-					keys[2],
-					s,
-				)
-				if e != nil {
-					fmt.Println("Error during append")
-					return nil, e
-				}
-				if resp == nil {
-					return NewJsonResponse(http.StatusAccepted, nil), nil
-				}
-				return NewJsonResponse(http.StatusCreated, nil), nil
-			}
-			fmt.Println("Error parsing:", e)
-			return nil, e
+		if aggregates, err = domain.KeyRule.Keys(s); err != nil {
+			return nil, err
+		}
+	}
+	if len(aggregates) > 1 && r.Header.Get("If-Match") != "" {
+		return nil, model.NewError(model.CodeInvalid, "If-Match applies only to a source registered with a single aggregate")
+	}
+
+	receipts := make([]*model.SourceReceipt, 0, len(aggregates))
+	isNew := false
+	for _, aggregate := range aggregates {
+		receipt, err := app.appendSource(r, key, aggregate, PathParam(r, "token"), s)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+		isNew = isNew || receipt.New
+	}
+	resp := NewJsonResponse(appendStatus(isNew), struct{ Receipts []*model.SourceReceipt }{receipts})
+	if len(aggregates) == 1 {
+		if err := app.setLocation(resp, AGGREGATE_ROUTE, string(key), string(aggregates[0])); err != nil {
+			return nil, err
 		}
-		return NewJsonErrorResponse(http.StatusNotFound, nil), e
+	}
+	return resp, nil
+}
+
+// Created if the append registered a source, and accepted if the
+// source was already registered.
+func appendStatus(isNew bool) int {
+	if isNew {
+		return http.StatusCreated
+	}
+	return http.StatusAccepted
+}
+
+// Registers the source, and gives the receipt for it.
+func (app *RestApplication) appendSource(r *http.Request, domain model.DomainKey, aggregate model.AggregateKey, token string, s model.Source) (*model.SourceReceipt, error) {
+	version, err := app.expectedVersion(r, domain, aggregate)
+	if err != nil {
+		return nil, err
+	}
+	app.Logger.Debug("appending source", "request_id", RequestID(r), "aggregate", aggregate, "key_hash", s.KeyHash(), "version", version)
+	if app.AttributedAggregateWriter != nil {
+		return app.AttributedAggregateWriter.AppendAttributedSource(domain, aggregate, token, s, version, provenanceFromRequest(r))
+	}
+	var result *model.Source
+	switch {
+	case version == model.AnyVersion:
+		result, err = app.AggregateWriter.AppendNewSource(domain, aggregate, token, s)
+	case app.ConditionalAggregateWriter == nil:
+		return nil, model.NewError(model.CodeUnsupported, "Conditional appends are not supported")
 	default:
-		return NewJsonErrorResponse(http.StatusMethodNotAllowed, errors.New("Only GET and POST supported")), nil
+		result, err = app.ConditionalAggregateWriter.AppendNewSourceAtVersion(domain, aggregate, token, s, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The plain writers don't give receipts, but registrations never
+	// change once made, so the aggregate as it stands tells where this
+	// source landed, new or not.
+	current, err := app.AggregateReader.GetAggregate(domain, aggregate)
+	if err != nil {
+		return nil, err
+	}
+	var receipt *model.SourceReceipt
+	if current != nil {
+		receipt = current.Receipt(domain, token, s.KeyHash())
+	}
+	if receipt == nil {
+		return nil, fmt.Errorf("Source %s vanished from domain %q aggregate %q after registration", s.KeyHash(), domain, aggregate)
+	}
+	receipt.New = result != nil
+	return receipt, nil
+}
+
+// Long-poll variant of the aggregate GET: responds once the aggregate
+// has more than waitForVersion versions, or with 304 (or 204 if the
+// aggregate doesn't exist yet) when the timeout lapses first.
+func (app *RestApplication) waitForAggregate(r *http.Request, domain model.DomainKey, aggregate model.AggregateKey, filter model.ProvenanceFilter, includeProvenance bool) (JsonResponder, error) {
+	if app.AggregateWaiter == nil {
+		return nil, model.NewError(model.CodeUnsupported, "Waiting for aggregate versions is not supported")
+	}
+	maxTimeout := app.MaxWaitTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = DefaultMaxWaitTimeout
+	}
+	version, timeout, err := WaitParamsFromRequest(r, maxTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-app.shuttingDown():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// A wait that ends without a new version, whether timed out or
+	// cut short by the store stopping, gives the aggregate as it
+	// stands, if any.
+	p, err := app.AggregateWaiter.WaitForAggregate(ctx, domain, aggregate, version)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return NewJsonResponse(http.StatusNoContent, nil), nil
+	}
+	if len(p.Log) > version {
+		resp := NewJsonResponse(http.StatusOK, p.View(filter, includeProvenance))
+		SetValidators(resp.Header(), p.ETag(), p.LastModified())
+		return resp, nil
+	}
+	resp := NewJsonResponse(http.StatusNotModified, nil)
+	SetValidators(resp.Header(), p.ETag(), p.LastModified())
+	return resp, nil
+}
+
+// Describes who is making the request, for recording with sources.
+func provenanceFromRequest(r *http.Request) model.Provenance {
+	p := model.Provenance{
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  truncate(r.UserAgent(), maxProvenanceLength),
+		RequestID:  RequestID(r),
+		Publisher:  truncate(r.Header.Get(PUBLISHER_HEADER), maxProvenanceLength),
+	}
+	if principal := PrincipalFromRequest(r); principal != nil {
+		p.Principal = principal.Name
 	}
+	return p
+}
+
+// Resolves the If-Match header of an append to the aggregate version
+// count it requires.  An entity tag is checked against the aggregate
+// as it stands; the resulting version count then makes the append
+// fail if the aggregate moves in the meantime.
+func (app *RestApplication) expectedVersion(r *http.Request, domain model.DomainKey, aggregate model.AggregateKey) (int, error) {
+	version, etag, err := IfMatchFromRequest(r)
+	if err != nil || etag == "" {
+		return version, err
+	}
+	current, err := app.AggregateReader.GetAggregate(domain, aggregate)
+	if err != nil {
+		return version, err
+	}
+	if current == nil || current.ETag() != etag {
+		return version, model.Errorf(
+			model.CodePreconditionFailed,
+			"Domain %q aggregate %q does not match entity tag %s", domain, aggregate, etag,
+		).With("Domain", domain, "Aggregate", aggregate, "ETag", etag)
+	}
+	return len(current.Log), nil
+}
+
+// The domain, or a not-found error if there's no such domain.
+func (app *RestApplication) getDomain(key model.DomainKey) (*model.Domain, error) {
+	domain, err := app.DomainReader.GetDomain(key)
+	if err == nil && domain == nil {
+		err = model.Errorf(model.CodeNotFound, "Cannot find domain %q", key).With("Domain", key)
+	}
+	return domain, err
+}
+
+func aggregateNotFound(domain model.DomainKey, aggregate model.AggregateKey) error {
+	return model.Errorf(model.CodeNotFound, "Cannot find domain %q aggregate %q", domain, aggregate).With("Domain", domain, "Aggregate", aggregate)
 }
 
+// Streams aggregate messages as they're appended; the "filter"
+// parameter, if given, withholds those about aggregates that don't
+// meet it.
 func (app *RestApplication) SubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	var f *filter.Filter
+	if expr := r.URL.Query().Get("filter"); expr != "" {
+		var err error
+		if f, err = filter.Parse(expr); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
 	h := w.Header()
 	h.Set("Content-Type", "text/event-stream")
 	h.Set("Cache-Control", "no-cache")
 	h.Set("Connection", "keep-alive")
 
-	closer := w.(http.CloseNotifier).CloseNotify()
-	events := make(chan []byte, 10)
+	buffer := app.SubscriberBuffer
+	if buffer <= 0 {
+		buffer = DefaultSubscriberBuffer
+	}
+	events := make(chan []byte, buffer)
 
 	// We'll initialize with an informational event.
 	events <- []byte("{\"info\": \"subscription started\"}")
 
 	done := app.EventSource.SubscribeToMutations(events)
 
+	// The notifier may still hold the events channel for a moment
+	// after we unsubscribe, so we leave it open rather than risk
+	// a send on a closed channel.
 	defer func() {
 		done <- true
-		close(events)
 		close(done)
 	}()
 
+	visible := subscriptionFilter(PrincipalFromRequest(r))
 	for {
 		select {
 		case event := <-events:
+			if !visible(event) || !eventFilter(f, event) {
+				continue
+			}
 			fmt.Fprintf(w, "%s\n", event)
 			w.(http.Flusher).Flush()
-		case <-closer:
-			break
+		case <-app.shuttingDown():
+			fmt.Fprintf(w, "%s\n", "{\"info\": \"subscription ended; server shutting down\"}")
+			w.(http.Flusher).Flush()
+			return
+		case <-r.Context().Done():
+			return
 		}
 	}
+}
 
-	return
+// Whether the principal may see the event; events about domains
+// the principal may not subscribe to are withheld.
+func subscriptionFilter(principal *auth.Principal) func([]byte) bool {
+	if principal == nil || principal.AllowsAll(auth.Subscribe) {
+		return func([]byte) bool { return true }
+	}
+	return func(event []byte) bool {
+		var message struct{ DomainKey *model.DomainKey }
+		if err := json.Unmarshal(event, &message); err != nil || message.DomainKey == nil {
+			// Not about any one domain
+			return true
+		}
+		return principal.Allows(auth.Subscribe, *message.DomainKey)
+	}
+}
+
+// Whether the event meets the filter, if any; events that aren't
+// about an aggregate always do.
+func eventFilter(f *filter.Filter, event []byte) bool {
+	if f == nil {
+		return true
+	}
+	// The clock entries' sequence numbers are store-specific, and
+	// not needed to filter.
+	var message struct {
+		DomainKey *model.DomainKey
+		Aggregate struct {
+			Key   model.AggregateKey
+			Attrs map[string]string
+			Log   []struct {
+				Approximate time.Time
+				ChangeSeq   model.ChangeSeq
+			}
+			Sources model.SourceLogMap
+		}
+	}
+	if err := json.Unmarshal(event, &message); err != nil || message.DomainKey == nil {
+		return true
+	}
+	a := message.Aggregate
+	log := make([]model.ClockEntry, len(a.Log))
+	for i, entry := range a.Log {
+		log[i] = model.ClockEntry{Approximate: entry.Approximate, ChangeSeq: entry.ChangeSeq}
+	}
+	return f.Matches(model.Aggregate{Key: a.Key, Attrs: a.Attrs, Log: log, Sources: a.Sources})
 }
 
 func HandleJsonRoute(mux *http.ServeMux, pattern string, h func(*http.Request) (JsonResponder, error)) {
 	mux.Handle(pattern, NewJsonHandler(h))
 }
 
+// Route names, for reverse routing.
+const (
+	HEALTH_ROUTE            = "health"
+	READY_ROUTE             = "ready"
+	METRICS_ROUTE           = "metrics"
+	OPENAPI_ROUTE           = "openapi"
+	DOMAINS_ROUTE           = "domains"
+	DOMAIN_ROUTE            = "domain"
+	DOMAIN_CHANGES_ROUTE    = "domain-changes"
+	DOMAIN_SOURCE_ROUTE     = "domain-source"
+	DOMAIN_SEARCH_ROUTE     = "domain-search"
+	DOMAIN_AGGREGATES_ROUTE = "domain-aggregates"
+	AGGREGATE_ROUTE         = "aggregate"
+	SOURCE_ROUTE            = "source"
+	EVENTS_ROUTE            = "events"
+)
+
+// The current API version's paths are under this prefix.  The API
+// routes are also served at their unprefixed paths, as before
+// versioning; the operational routes are only served unprefixed.
+const API_PREFIX = "/v1"
+
+// The application's route table, built on first use.
+func (app *RestApplication) routes() *Router {
+	app.routerOnce.Do(func() {
+		m := newHttpMetrics(app.Metrics)
+		rt := NewRouter(func(pattern string, h http.Handler) http.Handler {
+			return m.instrument(pattern, accessLog(app.Logger, pattern, h))
+		})
+		rt.NotFound = m.instrument("/", accessLog(app.Logger, "/", NewJsonHandler(NotFoundRoute)))
+		api := func(name, method, pattern string, h http.Handler) {
+			rt.Handle(name, method, API_PREFIX+pattern, h)
+		}
+		apiJson := func(name, method, pattern string, h func(*http.Request) (JsonResponder, error)) {
+			api(name, method, pattern, NewJsonHandler(h))
+		}
+		// Handlers that require the permission in the scope
+		guarded := func(perm auth.Permission, scope authScope, h func(*http.Request) (JsonResponder, error)) http.Handler {
+			return app.require(perm, scope, NewJsonHandler(h))
+		}
+
+		// Liveness and readiness probes
+		rt.HandleJson(HEALTH_ROUTE, http.MethodGet, "/healthz", HealthRoute)
+		rt.HandleJson(READY_ROUTE, http.MethodGet, "/readyz", app.ReadinessRoute)
+		// Prometheus metrics
+		if app.Metrics != nil {
+			rt.Handle(METRICS_ROUTE, http.MethodGet, "/metrics", app.require(auth.Admin, allScope, app.Metrics))
+		}
+
+		// The API's OpenAPI description
+		apiJson(OPENAPI_ROUTE, http.MethodGet, "/openapi.json", OpenAPIRoute)
+		// Get a list of domains;
+		// Post a new domain
+		api(DOMAINS_ROUTE, http.MethodGet, "/domains", guarded(auth.Read, someScope, app.ListDomainsRoute))
+		api(DOMAINS_ROUTE, http.MethodPost, "/domains", guarded(auth.Admin, someScope, app.CreateDomainRoute))
+		// Get a specific domain, and its change feed
+		api(DOMAIN_ROUTE, http.MethodGet, "/domains/{domain}", guarded(auth.Read, domainScope, app.DomainRoute))
+		api(DOMAIN_CHANGES_ROUTE, http.MethodGet, "/domains/{domain}/changes", guarded(auth.Read, domainScope, app.DomainChangesRoute))
+		// List the domain's aggregates, and find its sources by their keys and attrs
+		api(DOMAIN_AGGREGATES_ROUTE, http.MethodGet, "/domains/{domain}/aggregates", guarded(auth.Read, domainScope, app.DomainAggregatesRoute))
+		api(DOMAIN_SEARCH_ROUTE, http.MethodGet, "/domains/{domain}/search", guarded(auth.Read, domainScope, app.DomainSearchRoute))
+		// Post a new source to the aggregate the domain's key rule gives
+		api(DOMAIN_SOURCE_ROUTE, http.MethodPost, "/domains/{domain}/sources/{token}", guarded(auth.Append, domainScope, app.AppendDomainSourceRoute))
+		// Get an existing aggregate
+		api(AGGREGATE_ROUTE, http.MethodGet, "/aggregates/{domain}/{aggregate}", guarded(auth.Read, domainScope, app.AggregateRoute))
+		// Post a new source to an aggregate
+		api(SOURCE_ROUTE, http.MethodPost, "/aggregates/{domain}/{aggregate}/{token}", guarded(auth.Append, domainScope, app.AppendSourceRoute))
+		// Example notification route just for the prototype;
+		// events are filtered to the domains the principal may see,
+		// and by the filter parameter
+		api(EVENTS_ROUTE, http.MethodGet, "/events", app.require(auth.Subscribe, someScope, http.HandlerFunc(app.SubscriptionHandler)))
+
+		for _, info := range rt.Routes() {
+			if info.Name != OPENAPI_ROUTE && strings.HasPrefix(info.Pattern, API_PREFIX+"/") {
+				rt.Alias(info.Name, strings.TrimPrefix(info.Pattern, API_PREFIX))
+			}
+		}
+		app.router = rt
+	})
+	return app.router
+}
+
+// Serves the API.  Paths are routed as given, so unlike with an
+// http.ServeMux, keys containing encoded slashes or dots are safe.
+func (app *RestApplication) Handler() http.Handler {
+	return app.routes()
+}
+
 func (app *RestApplication) ApplyRoutes(mux *http.ServeMux) {
-	HandleJsonRoute(mux, "/", HelloWorldRoute)
-	// Get a list of domains;
-	// Post a new domain
-	HandleJsonRoute(mux, "/domains", app.DomainsCollectionRoute)
-	// Get a specific domain
-	HandleJsonRoute(mux, "/domains/", app.DomainRoute)
-	// Post a new aggregate
-	// Get an existing aggregate
-	HandleJsonRoute(mux, "/aggregates/", app.AggregatesRoute)
-	// Example notification route just for the prototype
-	mux.Handle("/events", http.HandlerFunc(app.SubscriptionHandler))
+	mux.Handle("/", app.Handler())
+}
+
+// Points the response's Location header at the named route.
+func (app *RestApplication) setLocation(resp JsonResponder, name string, values ...string) error {
+	path, err := app.routes().Path(name, values...)
+	if err != nil {
+		return err
+	}
+	resp.Header().Set("Location", path)
+	return nil
 }
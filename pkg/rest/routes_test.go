@@ -0,0 +1,710 @@
+package rest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/ethanrowe/botlnek/pkg/filter"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"github.com/ethanrowe/botlnek/pkg/store/inmemory"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func testApp() (*RestApplication, func()) {
+	store := inmemory.NewInMemoryStore()
+	app := &RestApplication{
+		DomainWriter:               store,
+		DomainReader:               store,
+		DomainLister:               store,
+		AggregateWriter:            store,
+		ConditionalAggregateWriter: store,
+		AttributedAggregateWriter:  store,
+		AggregateReader:            store,
+		AggregateWaiter:            store,
+		ChangeFeedReader:           store,
+		SourceSearcher:             store,
+		AggregateLister:            store,
+		EventSource:                store,
+		ReadinessChecker:           store,
+	}
+	return app, store.Stop
+}
+
+func postJson(h http.Handler, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestCreateDomainResponse(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+
+	recorder := postJson(h, "/domains", `{"Key": "a/b", "Attrs": {"x": "1"}}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected 201; got %d", recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "/v1/domains/a%2Fb" {
+		t.Errorf("Unexpected Location %q", location)
+	}
+	if body := recorder.Body.String(); body != `{"Key":"a/b","Attrs":{"x":"1"}}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+
+	// The duplicate gets the original registration.
+	recorder = postJson(h, "/domains", `{"Key": "a/b", "Attrs": {"x": "2"}}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202; got %d", recorder.Code)
+	}
+	if location := recorder.Header().Get("Location"); location != "/v1/domains/a%2Fb" {
+		t.Errorf("Unexpected Location %q", location)
+	}
+	if body := recorder.Body.String(); body != `{"Key":"a/b","Attrs":{"x":"1"}}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+}
+
+func TestAppendSourceResponse(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+
+	source := model.Source{Keys: map[string]string{"k": "v"}}
+	body := `{"Keys": {"k": "v"}, "Attrs": {"a": "b"}}`
+	receipts := make([]model.SourceReceipt, 0, 3)
+	for i, target := range []string{"/aggregates/d/g/t1", "/aggregates/d/g/t2", "/aggregates/d/g/t1"} {
+		recorder := postJson(h, target, body)
+		expectedStatus := http.StatusCreated
+		if i == 2 {
+			expectedStatus = http.StatusAccepted
+		}
+		if recorder.Code != expectedStatus {
+			t.Fatalf("%s: expected %d; got %d", target, expectedStatus, recorder.Code)
+		}
+		if location := recorder.Header().Get("Location"); location != "/v1/aggregates/d/g" {
+			t.Errorf("%s: unexpected Location %q", target, location)
+		}
+		var receipt model.SourceReceipt
+		receipt.ClockEntry.SeqNum = new(inmemory.InMemoryCounter)
+		if err := json.Unmarshal(recorder.Body.Bytes(), &receipt); err != nil {
+			t.Fatalf("%s: failed to parse receipt %s: %s", target, recorder.Body.String(), err)
+		}
+		receipts = append(receipts, receipt)
+	}
+
+	for i, expected := range []struct {
+		token      string
+		versionIdx int
+		isNew      bool
+	}{{"t1", 0, true}, {"t2", 1, true}, {"t1", 0, false}} {
+		receipt := receipts[i]
+		if receipt.Domain != "d" || receipt.Aggregate != "g" || receipt.Token != expected.token || receipt.KeyHash != source.KeyHash() {
+			t.Errorf("Receipt %d misidentifies the source: %v", i, receipt)
+		}
+		if receipt.VersionIdx != expected.versionIdx || receipt.New != expected.isNew {
+			t.Errorf("Receipt %d expected version %d (new: %t); got %d (new: %t)", i, expected.versionIdx, expected.isNew, receipt.VersionIdx, receipt.New)
+		}
+		if receipt.ClockEntry.ChangeSeq != model.ChangeSeq(expected.versionIdx+1) {
+			t.Errorf("Receipt %d has unexpected clock entry %v", i, receipt.ClockEntry)
+		}
+	}
+	if !receipts[0].ClockEntry.Approximate.Equal(receipts[2].ClockEntry.Approximate) {
+		t.Errorf("Duplicate receipt does not give the original registration: %v vs %v", receipts[0], receipts[2])
+	}
+}
+
+func TestAppendDomainSource(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/domains", `{"Key": "d", "KeyRule": {"TimeKey": "asof", "Truncate": "24h", "Layout": "20060102"}}`)
+	postJson(h, "/domains", `{"Key": "plain"}`)
+
+	recorder := postJson(h, "/v1/domains/d/sources/t", `{"Keys": {"asof": "2019-07-10T11:28:10Z"}}`)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Expected 201; got %d: %s", recorder.Code, recorder.Body.String())
+	}
+	if location := recorder.Header().Get("Location"); location != "/v1/aggregates/d/20190710" {
+		t.Errorf("Unexpected Location %q", location)
+	}
+	var receipts struct {
+		Receipts []struct{ Aggregate model.AggregateKey }
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &receipts)
+	if len(receipts.Receipts) != 1 || receipts.Receipts[0].Aggregate != "20190710" {
+		t.Errorf("Unexpected receipts %s", recorder.Body.String())
+	}
+	if recorder := postJson(h, "/domains/d/sources/t", `{"Keys": {"asof": "2019-07-10T11:28:10Z"}}`); recorder.Code != http.StatusAccepted {
+		t.Errorf("Expected 202 for a duplicate; got %d", recorder.Code)
+	}
+
+	// Sources fanned out to several aggregates, by the domain's rule
+	// or the request, land in each.
+	postJson(h, "/domains", `{"Key": "w", "KeyRule": {"TimeKey": "asof", "Truncate": "48h", "Hop": "24h", "Layout": "20060102"}}`)
+	for target, expected := range map[string]string{
+		"/domains/w/sources/t": "20190709 20190710",
+		"/domains/plain/sources/t?aggregate=x&aggregate=y&aggregate=x": "x y",
+		"/domains/d/sources/u?aggregate=20190710&aggregate=other":      "20190710 other",
+	} {
+		recorder := postJson(h, target, `{"Keys": {"asof": "2019-07-10T11:28:10Z"}}`)
+		var receipts struct {
+			Receipts []struct {
+				Aggregate model.AggregateKey
+				New       bool
+			}
+		}
+		json.Unmarshal(recorder.Body.Bytes(), &receipts)
+		landed := make([]string, 0)
+		for _, receipt := range receipts.Receipts {
+			if !receipt.New {
+				t.Errorf("%s: unexpected receipt %+v", target, receipt)
+			}
+			landed = append(landed, string(receipt.Aggregate))
+		}
+		if recorder.Code != http.StatusCreated || strings.Join(landed, " ") != expected {
+			t.Errorf("%s: expected 201 and %s; got %d: %s", target, expected, recorder.Code, recorder.Body.String())
+		}
+		if location := recorder.Header().Get("Location"); location != "" {
+			t.Errorf("%s: expected no Location for several aggregates; got %q", target, location)
+		}
+	}
+
+	for _, c := range []struct {
+		target, body string
+		status       int
+	}{
+		{"/domains/d/sources/t", `{"Keys": {"other": "x"}}`, 400},
+		{"/domains/d/sources/t", `{"Keys": {"asof": "yesterday"}}`, 400},
+		{"/domains/plain/sources/t", `{"Keys": {"asof": "2019-07-10T11:28:10Z"}}`, 400},
+		{"/domains/nope/sources/t", `{"Keys": {"asof": "2019-07-10T11:28:10Z"}}`, 404},
+		{"/domains", `{"Key": "bad", "KeyRule": {"Template": "{{.Keys"}}`, 400},
+		{"/domains/plain/sources/t?aggregate=", `{"Keys": {}}`, 400},
+	} {
+		if recorder := postJson(h, c.target, c.body); recorder.Code != c.status {
+			t.Errorf("%s %s: expected %d; got %d: %s", c.target, c.body, c.status, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/aggregates/d/g/t", `{"Keys": {"k": "v"}}`)
+
+	cases := []struct {
+		method, target, contentType, body, ifMatch string
+		status                                     int
+		expected                                   string
+	}{
+		{"GET", "/domains/nope", "", "", "", 404,
+			`{"Code":"not_found","Message":"Cannot find domain \"nope\"","Details":{"Domain":"nope"}}`},
+		{"GET", "/aggregates/d/nope", "", "", "", 404,
+			`{"Code":"not_found","Message":"Cannot find domain \"d\" aggregate \"nope\"","Details":{"Aggregate":"nope","Domain":"d"}}`},
+		{"GET", "/nowhere", "", "", "", 404,
+			`{"Code":"not_found","Message":"No such resource: /nowhere"}`},
+		{"POST", "/aggregates/d/g/t", "text/plain", `{"Keys": {}}`, "", 400,
+			`{"Code":"invalid","Message":"Invalid content-type \"text/plain\"; expected application/json"}`},
+		{"POST", "/aggregates/d/g/t", "application/json", `{"Keys": `, "", 400,
+			`{"Code":"invalid","Message":"Invalid JSON body: unexpected EOF"}`},
+		{"POST", "/domains", "application/json", `{"Attrs": {}}`, "", 400,
+			`{"Code":"invalid","Message":"Domain key cannot be empty"}`},
+		{"POST", "/aggregates/d/g/t", "application/json", `{"Keys": {"k": "w"}}`, "0", 412,
+			`{"Code":"precondition_failed","Message":"Domain \"d\" aggregate \"g\" is at version 1; expected 0","Details":{"Actual":1,"Aggregate":"g","Domain":"d","Expected":0}}`},
+		{"GET", "/domains/d/changes?limit=none", "", "", "", 400,
+			`{"Code":"invalid","Message":"Invalid limit \"none\""}`},
+		{"DELETE", "/domains", "", "", "", 405,
+			`{"Code":"method_not_allowed","Message":"Method DELETE is not allowed; use GET, HEAD, POST"}`},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.target, strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		if c.ifMatch != "" {
+			r.Header.Set("If-Match", c.ifMatch)
+		}
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, r)
+		if recorder.Code != c.status {
+			t.Errorf("%s %s: expected status %d; got %d", c.method, c.target, c.status, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != c.expected {
+			t.Errorf("%s %s: unexpected body\n\texpected %s\n\treceived %s", c.method, c.target, c.expected, body)
+		}
+	}
+}
+
+func TestErrorResponseStatus(t *testing.T) {
+	for code, status := range errorStatus {
+		if got := ErrorResponse(model.NewError(code, "oops")).StatusCode(); got != status {
+			t.Errorf("Code %s gave status %d; expected %d", code, got, status)
+		}
+	}
+	if got := ErrorResponse(errors.New("uncoded")).StatusCode(); got != http.StatusInternalServerError {
+		t.Errorf("Uncoded error gave status %d", got)
+	}
+	// An explicit status overrides a code that disagrees with it.
+	body, _ := NewJsonErrorResponse(http.StatusServiceUnavailable, model.NewError(model.CodeNotFound, "gone")).MarshalJSON()
+	if string(body) != `{"Code":"unavailable","Message":"gone"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+	body, _ = NewJsonErrorResponse(http.StatusNotFound, nil).MarshalJSON()
+	if string(body) != `{"Code":"not_found","Message":"Not Found"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+	// Sealed answers 409 too, but a bare 409 is the general conflict.
+	body, _ = NewJsonErrorResponse(http.StatusConflict, nil).MarshalJSON()
+	if string(body) != `{"Code":"conflict","Message":"Conflict"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+	// Wrapping keeps the code and details.
+	wrapped := wrappedError{model.NewError(model.CodeConflict, "taken").With("Key", "k")}
+	body, _ = ErrorResponse(wrapped).MarshalJSON()
+	if string(body) != `{"Code":"conflict","Message":"appending: taken","Details":{"Key":"k"}}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+}
+
+// An error wrapping another, as fmt.Errorf's %w does.
+type wrappedError struct{ err error }
+
+func (e wrappedError) Error() string {
+	return "appending: " + e.err.Error()
+}
+
+func (e wrappedError) Unwrap() error {
+	return e.err
+}
+
+func TestSourceProvenance(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+
+	for i, publisher := range []string{"etl", "backfill"} {
+		r := httptest.NewRequest(http.MethodPost, "/v1/aggregates/d/g/t", strings.NewReader(`{"Keys": {"n": "`+publisher+`"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("User-Agent", "test-agent")
+		r.Header.Set(REQUEST_ID_HEADER, "req-"+publisher)
+		r.Header.Set(PUBLISHER_HEADER, publisher)
+		r.RemoteAddr = "192.0.2.1:1234"
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, r)
+		if recorder.Code != http.StatusCreated {
+			t.Fatalf("Append %d failed: %d %s", i, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	read := func(query string) model.Aggregate {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/aggregates/d/g"+query, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200; got %d %s", query, recorder.Code, recorder.Body.String())
+		}
+		var aggr struct{ Sources model.SourceLogMap }
+		if err := json.Unmarshal(recorder.Body.Bytes(), &aggr); err != nil {
+			t.Fatalf("GET %s: bad body: %s", query, err)
+		}
+		return model.Aggregate{Sources: aggr.Sources}
+	}
+
+	for _, log := range read("").Sources["t"] {
+		if log.Provenance != nil {
+			t.Errorf("Provenance should be opt-in; got %v", log.Provenance)
+		}
+	}
+	logs := read("?provenance=true").Sources["t"]
+	if len(logs) != 2 {
+		t.Fatalf("Expected 2 sources; got %v", logs)
+	}
+	expected := model.Provenance{
+		RemoteAddr: "192.0.2.1:1234",
+		UserAgent:  "test-agent",
+		RequestID:  "req-etl",
+		Publisher:  "etl",
+	}
+	if logs[0].Provenance == nil || *logs[0].Provenance != expected {
+		t.Errorf("Unexpected provenance:\n\texpected %v\n\treceived %v", expected, logs[0].Provenance)
+	}
+	logs = read("?provenance=1&publisher=backfill").Sources["t"]
+	if len(logs) != 1 || logs[0].Provenance.Publisher != "backfill" {
+		t.Errorf("Expected only the backfill source; got %v", logs)
+	}
+	if logs := read("?requestId=nothing").Sources["t"]; len(logs) != 0 {
+		t.Errorf("Expected no sources; got %v", logs)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/aggregates/d/g?provenance=maybe", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad provenance flag; got %d", recorder.Code)
+	}
+}
+
+func TestDomainSearch(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/v1/domains", `{"Key": "d"}`)
+	for _, a := range []struct{ target, body string }{
+		{"/v1/aggregates/d/20190710/t", `{"Keys": {"asof": "2019-07-10T11:28:10Z"}, "Attrs": {"series": "foo-series"}}`},
+		{"/v1/aggregates/d/20190711/t", `{"Keys": {"asof": "2019-07-11T11:28:10Z"}, "Attrs": {"series": "foo-series"}}`},
+		{"/v1/aggregates/d/20190711/u", `{"Keys": {"asof": "2019-07-11T11:28:10Z"}, "Attrs": {"series": "bar-series"}}`},
+		{"/v1/aggregates/d/20190710/u", `{"Keys": {"asof": "2019-07-10T11:28:10Z"}, "Attrs": {"series": "foo-series"}}`},
+	} {
+		if recorder := postJson(h, a.target, a.body); recorder.Code != http.StatusCreated {
+			t.Fatalf("Append to %s failed: %d %s", a.target, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	type results struct {
+		Aggregates []model.AggregateKey
+		Sources    []model.SourceMatch
+		Next       model.ChangeSeq
+	}
+	search := func(query string, expected int) results {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/domains/d/search?"+query, nil))
+		var r results
+		if recorder.Code != expected {
+			t.Errorf("Search %s: expected %d; got %d %s", query, expected, recorder.Code, recorder.Body.String())
+		} else if expected == http.StatusOK {
+			if err := json.Unmarshal(recorder.Body.Bytes(), &r); err != nil {
+				t.Fatalf("Search %s: bad body: %s", query, err)
+			}
+		}
+		return r
+	}
+
+	r := search("attr.series=foo-series", http.StatusOK)
+	if len(r.Aggregates) != 2 || r.Aggregates[0] != "20190710" || r.Aggregates[1] != "20190711" || len(r.Sources) != 3 || r.Next != 4 {
+		t.Errorf("Unexpected results %+v", r)
+	}
+	r = search("key.asof=2019-07-10T11:28:10Z&token=u", http.StatusOK)
+	if len(r.Sources) != 1 || r.Sources[0].Aggregate != "20190710" || r.Sources[0].Token != "u" || r.Sources[0].ChangeSeq != 4 || r.Sources[0].Source.Attrs["series"] != "foo-series" {
+		t.Errorf("Unexpected results %+v", r)
+	}
+	if r.Sources[0].Provenance != nil {
+		t.Errorf("Provenance should be opt-in; got %v", r.Sources[0].Provenance)
+	}
+	// Pages follow the change that registered their last source.
+	r = search("attr.series=foo-series&limit=2", http.StatusOK)
+	if len(r.Sources) != 2 || r.Next != 2 {
+		t.Fatalf("Unexpected page %+v", r)
+	}
+	r = search("attr.series=foo-series&limit=2&after="+r.Next.String(), http.StatusOK)
+	if len(r.Sources) != 1 || r.Sources[0].Token != "u" || r.Next != 4 {
+		t.Errorf("Unexpected page %+v", r)
+	}
+	if r = search("key.asof=2019-07-11T11:28:10Z&attr.series=foo-series&provenance=true", http.StatusOK); len(r.Sources) != 1 || r.Sources[0].Provenance == nil {
+		t.Errorf("Unexpected results %+v", r)
+	}
+	if r = search("key.asof=never", http.StatusOK); len(r.Sources) != 0 || len(r.Aggregates) != 0 {
+		t.Errorf("Expected no results; got %+v", r)
+	}
+
+	// Filters apply to the sources' aggregates.
+	if r = search("attr.series=foo-series&filter="+url.QueryEscape(`any("u", attr.series == "bar-series")`), http.StatusOK); len(r.Sources) != 1 || r.Sources[0].Aggregate != "20190711" {
+		t.Errorf("Unexpected results %+v", r)
+	}
+
+	search("token=t", http.StatusBadRequest)
+	search("key.=x", http.StatusBadRequest)
+	search("key.asof=1&key.asof=2", http.StatusBadRequest)
+	search("key.asof=1&filter=count", http.StatusBadRequest)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/domains/missing/search?key.asof=x", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing domain; got %d", recorder.Code)
+	}
+}
+
+func TestDomainAggregates(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/v1/domains", `{"Key": "d"}`)
+	for _, target := range []string{"/v1/aggregates/d/b/t", "/v1/aggregates/d/a/t", "/v1/aggregates/d/c/t", "/v1/aggregates/d/a/u"} {
+		if recorder := postJson(h, target, `{"Keys": {"k": "1"}}`); recorder.Code != http.StatusCreated {
+			t.Fatalf("Append to %s failed: %d %s", target, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	list := func(target string, expected int) string {
+		recorder := httptest.NewRecorder()
+		h.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+		if recorder.Code != expected {
+			t.Errorf("List %s: expected %d; got %d %s", target, expected, recorder.Code, recorder.Body.String())
+		}
+		return recorder.Body.String()
+	}
+	for target, expected := range map[string]string{
+		"/v1/domains/d/aggregates":                                              `{"Aggregates":["a","b","c"],"Next":"c"}`,
+		"/v1/domains/d/aggregates?limit=2":                                      `{"Aggregates":["a","b"],"Next":"b"}`,
+		"/v1/domains/d/aggregates?limit=2&after=b":                              `{"Aggregates":["c"],"Next":"c"}`,
+		"/v1/domains/d/aggregates?after=c":                                      `{"Aggregates":[],"Next":"c"}`,
+		"/v1/domains/d/aggregates?filter=" + url.QueryEscape(`count("*") == 2`): `{"Aggregates":["a"],"Next":"a"}`,
+	} {
+		if body := list(target, http.StatusOK); body != expected {
+			t.Errorf("List %s: expected %s; got %s", target, expected, body)
+		}
+	}
+	list("/v1/domains/d/aggregates?filter="+url.QueryEscape(`count("*")`), http.StatusBadRequest)
+	list("/v1/domains/d/aggregates?limit=0", http.StatusBadRequest)
+	list("/v1/domains/missing/aggregates", http.StatusNotFound)
+	app.AggregateLister = nil
+	list("/v1/domains/d/aggregates", http.StatusNotImplemented)
+}
+
+func TestEventFilter(t *testing.T) {
+	f, err := filter.Parse(`any("t", key.k == "1") and version == 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := func(key string) []byte {
+		aggr := model.Aggregate{
+			Key:     "a",
+			Log:     []model.ClockEntry{{SeqNum: inmemory.InMemoryCounter(0), Approximate: time.Now(), ChangeSeq: 1}},
+			Sources: model.SourceLogMap{"t": {{Source: model.Source{Keys: map[string]string{"k": key}}}}},
+		}
+		message, _ := json.Marshal(model.AggregateMessage{DomainKey: "d", Aggregate: aggr})
+		return message
+	}
+	for e, expected := range map[string]bool{
+		string(event("1")):                 true,
+		string(event("2")):                 false,
+		`{"info": "subscription started"}`: true,
+	} {
+		if eventFilter(f, []byte(e)) != expected {
+			t.Errorf("Event %s should meet the filter: %t", e, expected)
+		}
+	}
+	if !eventFilter(nil, event("2")) {
+		t.Error("Without a filter, every event is met")
+	}
+
+	app, stop := testApp()
+	defer stop()
+	recorder := httptest.NewRecorder()
+	app.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/v1/events?filter=version", nil))
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "Invalid filter") {
+		t.Errorf("Expected an invalid filter to be refused; got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestEventsOmitProvenance(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	server := httptest.NewServer(app.Handler())
+	defer server.Close()
+	defer app.Shutdown()
+	postJson(app.Handler(), "/v1/domains", `{"Key": "d"}`)
+
+	resp, err := http.Get(server.URL + "/v1/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	// The informational event tells us we're subscribed.
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	recorder := postJson(app.Handler(), "/v1/aggregates/d/a/t", `{"Keys": {"k": "1"}}`, PUBLISHER_HEADER, "etl", "User-Agent", "tester")
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("Append failed: %d %s", recorder.Code, recorder.Body.String())
+	}
+	if aggr, _ := app.AggregateReader.GetAggregate("d", "a"); aggr == nil || aggr.Sources["t"][0].Provenance == nil {
+		t.Fatalf("Expected the store to record provenance; got %v", aggr)
+	}
+	event, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(event, `"Key":"a"`) || strings.Contains(event, "Provenance") || strings.Contains(event, "etl") {
+		t.Errorf("Expected the event without provenance; got %s", event)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		max      int
+		expected string
+	}{
+		{"agent", 10, "agent"},
+		{"agent", 3, "age"},
+		// "é" is two bytes, and "日" three.
+		{"café", 4, "caf"},
+		{"日日", 5, "日"},
+		{"日", 2, ""},
+	} {
+		actual := truncate(c.s, c.max)
+		if actual != c.expected || !utf8.ValidString(actual) {
+			t.Errorf("truncate(%q, %d): expected %q; got %q", c.s, c.max, c.expected, actual)
+		}
+	}
+}
+
+func getWith(h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, r)
+	return recorder
+}
+
+func TestConditionalGet(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/v1/domains", `{"Key": "d", "Attrs": {"owner": "ops"}}`)
+	postJson(h, "/v1/aggregates/d/a/t", `{"Keys": {"k": "1"}}`)
+
+	for _, c := range []struct {
+		target   string
+		modified bool
+	}{
+		{"/v1/domains/d", false},
+		{"/v1/aggregates/d/a", true},
+	} {
+		recorder := getWith(h, c.target)
+		etag := recorder.Header().Get("ETag")
+		if recorder.Code != http.StatusOK || etag == "" {
+			t.Fatalf("GET %s: expected 200 with an ETag; got %d %v", c.target, recorder.Code, recorder.Header())
+		}
+		if modified := recorder.Header().Get("Last-Modified"); (modified != "") != c.modified {
+			t.Errorf("GET %s: unexpected Last-Modified %q", c.target, modified)
+		} else if c.modified {
+			if _, err := http.ParseTime(modified); err != nil {
+				t.Errorf("GET %s: bad Last-Modified %q", c.target, modified)
+			}
+		}
+
+		// The current tag, alone, weak, or in a list, gives 304.
+		for _, match := range []string{etag, "W/" + etag, `"stale", ` + etag, "*"} {
+			recorder = getWith(h, c.target, "If-None-Match", match)
+			if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 || recorder.Header().Get("ETag") != etag {
+				t.Errorf("GET %s with If-None-Match %s: expected an empty 304; got %d %q", c.target, match, recorder.Code, recorder.Body.String())
+			}
+		}
+		recorder = getWith(h, c.target, "If-None-Match", `"stale"`)
+		if recorder.Code != http.StatusOK || recorder.Body.Len() == 0 || recorder.Header().Get("ETag") != etag {
+			t.Errorf("GET %s with a stale tag: expected 200; got %d", c.target, recorder.Code)
+		}
+	}
+
+	// Once the aggregate moves, its old tag is stale.
+	etag := getWith(h, "/v1/aggregates/d/a").Header().Get("ETag")
+	postJson(h, "/v1/aggregates/d/a/t", `{"Keys": {"k": "2"}}`)
+	recorder := getWith(h, "/v1/aggregates/d/a", "If-None-Match", etag)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") == etag {
+		t.Errorf("Expected a new version after an append; got %d %v", recorder.Code, recorder.Header())
+	}
+}
+
+func TestWaitForAggregate(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/v1/domains", `{"Key": "d"}`)
+	postJson(h, "/v1/aggregates/d/a/t", `{"Keys": {"k": "1"}}`)
+	etag := getWith(h, "/v1/aggregates/d/a").Header().Get("ETag")
+
+	// Already past the version
+	recorder := getWith(h, "/v1/aggregates/d/a?waitForVersion=0")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("ETag") != etag || !strings.Contains(recorder.Body.String(), `"Key":"a"`) {
+		t.Errorf("Expected an immediate 200; got %d %s", recorder.Code, recorder.Body.String())
+	}
+	// Timing out
+	recorder = getWith(h, "/v1/aggregates/d/a?waitForVersion=1&timeout=10ms")
+	if recorder.Code != http.StatusNotModified || recorder.Body.Len() != 0 || recorder.Header().Get("ETag") != etag {
+		t.Errorf("Expected 304 on timing out; got %d %s", recorder.Code, recorder.Body.String())
+	}
+	recorder = getWith(h, "/v1/aggregates/d/missing?waitForVersion=0&timeout=10ms")
+	if recorder.Code != http.StatusNoContent || recorder.Body.Len() != 0 {
+		t.Errorf("Expected 204 for a missing aggregate; got %d %s", recorder.Code, recorder.Body.String())
+	}
+	for _, query := range []string{"waitForVersion=x", "waitForVersion=-1", "waitForVersion=1&timeout=soon", "waitForVersion=1&timeout=-1s"} {
+		if recorder = getWith(h, "/v1/aggregates/d/a?"+query); recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400; got %d", query, recorder.Code)
+		}
+	}
+
+	// Released by an append, whether it comes before or after the
+	// wait begins
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- getWith(h, "/v1/aggregates/d/a?waitForVersion=1&timeout=5s")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	postJson(h, "/v1/aggregates/d/a/t", `{"Keys": {"k": "2"}}`)
+	select {
+	case recorder = <-done:
+		if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"k":"2"`) {
+			t.Errorf("Expected the new version; got %d %s", recorder.Code, recorder.Body.String())
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("The append didn't release the wait")
+	}
+
+	// Timeouts are clamped to the maximum.
+	app.MaxWaitTimeout = 10 * time.Millisecond
+	start := time.Now()
+	if recorder = getWith(h, "/v1/aggregates/d/a?waitForVersion=2&timeout=1h"); recorder.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 once the clamped timeout lapses; got %d", recorder.Code)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the timeout to be clamped; waited %s", elapsed)
+	}
+}
+
+func TestWaitForAggregateStoreStopped(t *testing.T) {
+	app, stop := testApp()
+	defer stop()
+	h := app.Handler()
+	postJson(h, "/v1/domains", `{"Key": "d"}`)
+	postJson(h, "/v1/aggregates/d/a/t", `{"Keys": {"k": "1"}}`)
+	etag := getWith(h, "/v1/aggregates/d/a").Header().Get("ETag")
+
+	done := make(chan [2]*httptest.ResponseRecorder)
+	go func() {
+		existing := make(chan *httptest.ResponseRecorder)
+		go func() {
+			existing <- getWith(h, "/v1/aggregates/d/a?waitForVersion=1&timeout=5s")
+		}()
+		missing := getWith(h, "/v1/aggregates/d/missing?waitForVersion=0&timeout=5s")
+		done <- [2]*httptest.ResponseRecorder{<-existing, missing}
+	}()
+	// Give the waits time to begin before the store stops.
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	// The waits end as if timed out.
+	select {
+	case recorders := <-done:
+		if r := recorders[0]; r.Code != http.StatusNotModified || r.Header().Get("ETag") != etag {
+			t.Errorf("Expected 304 for an existing aggregate; got %d %s", r.Code, r.Body.String())
+		}
+		if r := recorders[1]; r.Code != http.StatusNoContent {
+			t.Errorf("Expected 204 for a missing aggregate; got %d %s", r.Code, r.Body.String())
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatal("Stopping the store didn't end the waits")
+	}
+}
@@ -2,31 +2,66 @@ package rest
 
 import (
 	"encoding/json"
-	"errors"
-	"fmt"
 	"github.com/ethanrowe/botlnek/pkg/model"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Long-poll timeout when the request doesn't specify one.
+	DefaultWaitTimeout = 30 * time.Second
+	// Default upper bound on any requested long-poll timeout.
+	DefaultMaxWaitTimeout = 5 * time.Minute
+	// Page size for change feeds when the request doesn't specify one.
+	DefaultChangesLimit = 100
+	// Upper bound on any requested change feed page size.
+	MaxChangesLimit = 1000
+	// Events buffered per subscriber when the application
+	// doesn't specify otherwise.
+	DefaultSubscriberBuffer = 10
+	// Deadline for readiness checks when the application
+	// doesn't specify otherwise.
+	DefaultReadinessTimeout = 2 * time.Second
+)
+
+const (
+	// Names the publisher of a source, for its provenance.
+	PUBLISHER_HEADER = "X-Botlnek-Publisher"
+	// Longest publisher name, user agent, and such recorded
+	// in a source's provenance
+	maxProvenanceLength = 256
 )
 
 func JsonBodyDecoder(r *http.Request) (*json.Decoder, error) {
 	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
-		return nil, fmt.Errorf("Invalid content-type %q", ct)
+		return nil, model.Errorf(model.CodeInvalid, "Invalid content-type %q; expected application/json", ct)
 	}
 	if r.Body == nil {
-		return nil, errors.New("No JSON body provided")
+		return nil, model.NewError(model.CodeInvalid, "No JSON body provided")
 	}
 	return json.NewDecoder(r.Body), nil
 }
 
+// Decodes exactly one JSON object from the body into v.
+func decodeBody(decoder *json.Decoder, v interface{}) error {
+	if err := decoder.Decode(v); err != nil {
+		return model.Errorf(model.CodeInvalid, "Invalid JSON body: %s", err)
+	}
+	if decoder.More() {
+		return model.NewError(model.CodeInvalid, "Only one object can be provided in the body")
+	}
+	return nil
+}
+
 func DomainFromRequest(r *http.Request) (m model.Domain, e error) {
 	decoder, e := JsonBodyDecoder(r)
 	if e != nil {
 		return
 	}
-	e = decoder.Decode(&m)
-	if e == nil && decoder.More() {
-		e = errors.New("Only one object can be provided in the body")
-	}
+	e = decodeBody(decoder, &m)
 	return
 }
 
@@ -35,9 +70,211 @@ func SourceFromRequest(r *http.Request) (s model.Source, e error) {
 	if e != nil {
 		return
 	}
-	e = decoder.Decode(&s)
-	if e == nil && decoder.More() {
-		e = errors.New("Only one object can be provided in the body")
+	e = decodeBody(decoder, &s)
+	return
+}
+
+// Reads the aggregate keys given by "aggregate" parameters, without
+// duplicates; none if there are no such parameters.
+func AggregateKeysFromRequest(r *http.Request) ([]model.AggregateKey, error) {
+	values := r.URL.Query()["aggregate"]
+	if len(values) > model.MaxFanOut {
+		return nil, model.Errorf(model.CodeInvalid, "At most %d aggregates may be given; got %d", model.MaxFanOut, len(values))
+	}
+	keys := make([]model.AggregateKey, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if value == "" {
+			return nil, model.NewError(model.CodeInvalid, "Aggregate keys cannot be empty")
+		}
+		if !seen[value] {
+			seen[value] = true
+			keys = append(keys, model.AggregateKey(value))
+		}
+	}
+	return keys, nil
+}
+
+// Reads an If-Match header, which may give either an aggregate
+// version count (bare or quoted) or an aggregate entity tag.
+// Gives model.AnyVersion and an empty tag if the header is absent.
+func IfMatchFromRequest(r *http.Request) (version int, etag string, err error) {
+	version = model.AnyVersion
+	raw := strings.TrimSpace(r.Header.Get("If-Match"))
+	if raw == "" {
+		return
+	}
+	if v, e := strconv.Atoi(strings.Trim(raw, "\"")); e == nil {
+		if v < 0 {
+			err = model.Errorf(model.CodeInvalid, "Invalid If-Match version %q", raw)
+			return
+		}
+		version = v
+		return
+	}
+	if !strings.HasPrefix(raw, "\"") || !strings.HasSuffix(raw, "\"") || len(raw) < 2 {
+		err = model.Errorf(model.CodeInvalid, "Invalid If-Match entity tag %q", raw)
+		return
 	}
+	etag = raw
 	return
 }
+
+// Whether the If-None-Match header of the request matches the
+// given entity tag, in which case the client's copy is current.
+// Uses the weak comparison, as GET requires.
+func NoneMatch(r *http.Request, etag string) bool {
+	raw := r.Header.Get("If-None-Match")
+	if raw == "" || etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(raw, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets validator headers for the given entity tag and modification
+// time (skipped if zero).
+func SetValidators(header http.Header, etag string, modified time.Time) {
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !modified.IsZero() {
+		header.Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Reads the waitForVersion and timeout query parameters of a
+// long-poll request.  The timeout is clamped to the given maximum.
+func WaitParamsFromRequest(r *http.Request, max time.Duration) (version int, timeout time.Duration, err error) {
+	query := r.URL.Query()
+	version, err = strconv.Atoi(query.Get("waitForVersion"))
+	if err != nil || version < 0 {
+		err = model.Errorf(model.CodeInvalid, "Invalid waitForVersion %q", query.Get("waitForVersion"))
+		return
+	}
+	timeout = DefaultWaitTimeout
+	if raw := query.Get("timeout"); raw != "" {
+		timeout, err = time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			err = model.Errorf(model.CodeInvalid, "Invalid timeout %q", raw)
+			return
+		}
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return
+}
+
+// Reads the after and limit query parameters of a change feed request.
+// The limit is clamped to MaxChangesLimit.
+func ChangeParamsFromRequest(r *http.Request) (after model.ChangeSeq, limit int, err error) {
+	query := r.URL.Query()
+	if raw := query.Get("after"); raw != "" {
+		after, err = model.ParseChangeSeq(raw)
+		if err != nil {
+			return
+		}
+	}
+	limit, err = limitFromRequest(r)
+	return
+}
+
+// Reads the limit query parameter of a paged request, clamped to
+// MaxChangesLimit; DefaultChangesLimit if not given.
+func limitFromRequest(r *http.Request) (limit int, err error) {
+	limit = DefaultChangesLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			err = model.Errorf(model.CodeInvalid, "Invalid limit %q", raw)
+			return
+		}
+	}
+	if limit > MaxChangesLimit {
+		limit = MaxChangesLimit
+	}
+	return
+}
+
+// Reads the after, limit, and filter query parameters of an aggregate
+// list request.  The filter is checked by the lister.
+func AggregateListParamsFromRequest(r *http.Request) (after model.AggregateKey, limit int, filter string, err error) {
+	query := r.URL.Query()
+	after, filter = model.AggregateKey(query.Get("after")), query.Get("filter")
+	limit, err = limitFromRequest(r)
+	return
+}
+
+// Reads a source search from the query parameters: each "key.NAME"
+// and "attr.NAME" gives the value the sources' key or attr NAME must
+// have, "token" the token they must be registered under, "filter" a
+// filter their aggregates must meet, and the provenance parameters
+// select them as for aggregate reads.
+func SourceQueryFromRequest(r *http.Request) (q model.SourceQuery, err error) {
+	q = model.SourceQuery{Keys: make(map[string]string), Attrs: make(map[string]string)}
+	for param, values := range r.URL.Query() {
+		var terms map[string]string
+		var name string
+		switch {
+		case strings.HasPrefix(param, "key."):
+			terms, name = q.Keys, strings.TrimPrefix(param, "key.")
+		case strings.HasPrefix(param, "attr."):
+			terms, name = q.Attrs, strings.TrimPrefix(param, "attr.")
+		default:
+			continue
+		}
+		if name == "" || len(values) != 1 {
+			err = model.Errorf(model.CodeInvalid, "Parameter %q needs a name, and exactly one value", param).With("Parameter", param)
+			return
+		}
+		terms[name] = values[0]
+	}
+	q.Token = r.URL.Query().Get("token")
+	q.Filter = r.URL.Query().Get("filter")
+	if q.Provenance, _, err = AggregateViewFromRequest(r); err != nil {
+		return
+	}
+	err = q.Validate()
+	return
+}
+
+// Reads the query parameters of an aggregate read that shape its
+// sources: "provenance" includes their provenance if true, and
+// "principal", "publisher", "remoteAddr", "userAgent", and
+// "requestId" select sources by provenance.
+func AggregateViewFromRequest(r *http.Request) (filter model.ProvenanceFilter, includeProvenance bool, err error) {
+	query := r.URL.Query()
+	if raw := query.Get("provenance"); raw != "" {
+		includeProvenance, err = strconv.ParseBool(raw)
+		if err != nil {
+			err = model.Errorf(model.CodeInvalid, "Invalid provenance %q", raw)
+			return
+		}
+	}
+	filter = model.ProvenanceFilter{
+		Principal:  query.Get("principal"),
+		Publisher:  query.Get("publisher"),
+		RemoteAddr: query.Get("remoteAddr"),
+		UserAgent:  query.Get("userAgent"),
+		RequestID:  query.Get("requestId"),
+	}
+	return
+}
+
+// Cuts the string to at most max bytes, backing off to the start of
+// a rune so that valid UTF-8 stays valid.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
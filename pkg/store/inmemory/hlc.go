@@ -0,0 +1,142 @@
+package inmemory
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Fixed-width hex fields, so that string order matches counter order:
+	// physical unix nanoseconds, logical component, node ID.
+	HLC_COUNTER_FORMAT_STRING = "%016x.%08x.%08x"
+)
+
+// A hybrid logical clock reading.  Readings from any aggregate, on
+// any node, are totally ordered, and stay close to wall clock time.
+type HLCCounter struct {
+	Physical int64
+	Logical  uint32
+	Node     uint32
+}
+
+func (c HLCCounter) compare(other HLCCounter) int {
+	switch {
+	case c.Physical < other.Physical:
+		return -1
+	case c.Physical > other.Physical:
+		return 1
+	case c.Logical < other.Logical:
+		return -1
+	case c.Logical > other.Logical:
+		return 1
+	case c.Node < other.Node:
+		return -1
+	case c.Node > other.Node:
+		return 1
+	}
+	return 0
+}
+
+func (c HLCCounter) Cmp(a, b model.Counter) int {
+	return a.(HLCCounter).compare(b.(HLCCounter))
+}
+
+func (c HLCCounter) Less(a, b model.Counter) bool {
+	return a.(HLCCounter).compare(b.(HLCCounter)) < 0
+}
+
+// The wall clock time of the reading.
+func (c HLCCounter) Time() time.Time {
+	return time.Unix(0, c.Physical)
+}
+
+func (c HLCCounter) String() string {
+	return fmt.Sprintf(HLC_COUNTER_FORMAT_STRING, c.Physical, c.Logical, c.Node)
+}
+
+func (c HLCCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c *HLCCounter) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("Invalid HLC counter %q", s)
+	}
+	physical, err := strconv.ParseInt(parts[0], 16, 64)
+	if err != nil {
+		return err
+	}
+	logical, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return err
+	}
+	node, err := strconv.ParseUint(parts[2], 16, 32)
+	if err != nil {
+		return err
+	}
+	*c = HLCCounter{physical, uint32(logical), uint32(node)}
+	return nil
+}
+
+// Issues HLCCounter readings for a single node.
+type HybridLogicalClock struct {
+	node  uint32
+	last  HLCCounter
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+func NewHybridLogicalClock(node uint32) *HybridLogicalClock {
+	return &HybridLogicalClock{
+		node: node,
+		last: HLCCounter{Node: node},
+		now:  time.Now,
+	}
+}
+
+// Gives a reading greater than any this clock has previously
+// given or observed.
+func (c *HybridLogicalClock) Now() HLCCounter {
+	return c.advance(HLCCounter{})
+}
+
+// Merges a reading received from another node, such that
+// subsequent readings from this clock are greater than it.
+func (c *HybridLogicalClock) Observe(remote HLCCounter) HLCCounter {
+	return c.advance(remote)
+}
+
+func (c *HybridLogicalClock) advance(remote HLCCounter) HLCCounter {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	physical := c.now().UnixNano()
+	next := HLCCounter{Node: c.node}
+	switch {
+	case physical > c.last.Physical && physical > remote.Physical:
+		next.Physical = physical
+	case c.last.Physical > remote.Physical:
+		next.Physical, next.Logical = c.last.Physical, c.last.Logical+1
+	case remote.Physical > c.last.Physical:
+		next.Physical, next.Logical = remote.Physical, remote.Logical+1
+	default:
+		next.Physical = c.last.Physical
+		next.Logical = c.last.Logical + 1
+		if remote.Logical >= next.Logical {
+			next.Logical = remote.Logical + 1
+		}
+	}
+	c.last = next
+	return next
+}
@@ -0,0 +1,147 @@
+package inmemory
+
+import (
+	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHLCCounterOrdering(t *testing.T) {
+	ordered := []HLCCounter{
+		{Physical: 1, Logical: 0, Node: 9},
+		{Physical: 1, Logical: 1, Node: 0},
+		{Physical: 1, Logical: 1, Node: 1},
+		{Physical: 2, Logical: 0, Node: 0},
+		{Physical: 0x100000000, Logical: 0, Node: 0},
+	}
+
+	for i, a := range ordered {
+		for j, b := range ordered {
+			expected := 0
+			if i < j {
+				expected = -1
+			} else if i > j {
+				expected = 1
+			}
+			if got := a.Cmp(a, b); got != expected {
+				t.Errorf("Cmp(%s, %s): expected %d; got %d", a, b, expected, got)
+			}
+			if got := a.Less(a, b); got != (i < j) {
+				t.Errorf("Less(%s, %s): expected %v; got %v", a, b, i < j, got)
+			}
+		}
+	}
+
+	// The serialized form sorts the same way as the counters do.
+	serialized := make([]string, len(ordered))
+	for i, c := range ordered {
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("Failed marshaling %s: %s", c, err)
+		}
+		serialized[i] = string(data)
+
+		var back HLCCounter
+		if err = json.Unmarshal(data, &back); err != nil {
+			t.Fatalf("Failed unmarshaling %s: %s", data, err)
+		}
+		if back != c {
+			t.Errorf("Round trip mismatch (wanted %s; got %s)", c, back)
+		}
+	}
+	if !sort.StringsAreSorted(serialized) {
+		t.Errorf("Serialized counters are out of order: %q", serialized)
+	}
+}
+
+func TestHybridLogicalClock(t *testing.T) {
+	wall := time.Unix(1000, 0)
+	clock := NewHybridLogicalClock(7)
+	clock.now = func() time.Time { return wall }
+
+	first := clock.Now()
+	if first != (HLCCounter{wall.UnixNano(), 0, 7}) {
+		t.Errorf("Unexpected first reading %s", first)
+	}
+
+	// A stalled (or regressing) wall clock still gives increasing readings.
+	second := clock.Now()
+	wall = wall.Add(-time.Second)
+	third := clock.Now()
+	if !first.Less(first, second) || !second.Less(second, third) {
+		t.Errorf("Readings out of order: %s, %s, %s", first, second, third)
+	}
+	if third.Physical != first.Physical {
+		t.Errorf("Physical component regressed: %s", third)
+	}
+
+	// A reading from a node that's ahead pulls us along.
+	remote := HLCCounter{first.Physical + 500, 3, 2}
+	observed := clock.Observe(remote)
+	if !remote.Less(remote, observed) || observed.Node != 7 {
+		t.Errorf("Observed reading %s is not after remote %s", observed, remote)
+	}
+	if next := clock.Now(); !observed.Less(observed, next) {
+		t.Errorf("Reading %s is not after observed %s", next, observed)
+	}
+
+	// Once the wall clock passes everything seen, it takes over.
+	wall = time.Unix(2000, 0)
+	if latest := clock.Now(); latest != (HLCCounter{wall.UnixNano(), 0, 7}) {
+		t.Errorf("Expected wall clock reading; got %s", latest)
+	}
+}
+
+func TestStoreWithHybridLogicalClock(t *testing.T) {
+	s := NewInMemoryStore(WithHybridLogicalClock(3))
+	defer s.Stop()
+
+	aggrkeyGen := generateTestAggregateKeys("hlc")
+	tokenGen := generateTestTokens("hlc")
+	sourceGen := generateTestSources("hlc")
+
+	d := makeTestDomain(0, "clock", "hybrid")
+	if _, e := s.AppendNewDomain(d); e != nil {
+		t.Fatalf("Failed to append domain: %s", e)
+	}
+	aggrs := []model.AggregateKey{<-aggrkeyGen, <-aggrkeyGen}
+	tk := <-tokenGen
+
+	// Alternate between aggregates; the sequence numbers
+	// should be ordered across both of them.
+	for i := 0; i < 6; i++ {
+		if _, err := s.AppendNewSource(d.Key, aggrs[i%2], tk, <-sourceGen); err != nil {
+			t.Fatalf("Failed appending source: %s", err)
+		}
+	}
+
+	var entries []HLCCounter
+	for i := 0; i < 3; i++ {
+		for _, a := range aggrs {
+			aggr, err := s.GetAggregate(d.Key, a)
+			if err != nil || aggr == nil {
+				t.Fatalf("Failed to get aggregate %q (error: %v)", a, err)
+			}
+			clock := aggr.Log[i]
+			count, ok := clock.SeqNum.(HLCCounter)
+			if !ok {
+				t.Fatalf("Expected an HLC sequence number; got %T", clock.SeqNum)
+			}
+			if count.Node != 3 {
+				t.Errorf("Expected node 3; got %s", count)
+			}
+			if !clock.Approximate.Equal(count.Time()) {
+				t.Errorf("Approximate time %s does not match sequence number %s", clock.Approximate, count)
+			}
+			entries = append(entries, count)
+		}
+	}
+
+	for i := 1; i < len(entries); i++ {
+		if !entries[i-1].Less(entries[i-1], entries[i]) {
+			t.Errorf("Sequence number %d (%s) is not after %d (%s)", i, entries[i], i-1, entries[i-1])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package inmemory
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/filter"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"sort"
+	"time"
+)
+
+// Where a source is registered: the entry at Pos in the aggregate's
+// log of the token's sources, added by change Seq to the domain.
+type sourceRef struct {
+	Seq       model.ChangeSeq
+	Aggregate model.AggregateKey
+	Token     string
+	Pos       int
+}
+
+// The sources registered with a domain's aggregates, by the name and
+// value of one of their keys or attrs.  Each list of references is in
+// the order the sources were registered.
+type sourceIndex map[string]map[string][]sourceRef
+
+func (i sourceIndex) add(values map[string]string, ref sourceRef) {
+	for name, value := range values {
+		byValue, ok := i[name]
+		if !ok {
+			byValue = make(map[string][]sourceRef)
+			i[name] = byValue
+		}
+		byValue[value] = append(byValue[value], ref)
+	}
+}
+
+// The shortest of the lists of references for the query's keys and
+// attrs, which holds every match.
+func (as aggregateStore) candidates(q model.SourceQuery) []sourceRef {
+	var shortest []sourceRef
+	first := true
+	for _, terms := range []struct {
+		index  sourceIndex
+		values map[string]string
+	}{{as.Keys, q.Keys}, {as.Attrs, q.Attrs}} {
+		for name, value := range terms.values {
+			refs := terms.index[name][value]
+			if first || len(refs) < len(shortest) {
+				shortest, first = refs, false
+			}
+		}
+	}
+	return shortest
+}
+
+// Up to limit sources matching the query, registered after the given
+// change, whose aggregates meet the filter, if any.  Runs on the store
+// goroutine.
+func (as aggregateStore) search(q model.SourceQuery, f *filter.Filter, after model.ChangeSeq, limit int) []model.SourceMatch {
+	refs := as.candidates(q)
+	refs = refs[sort.Search(len(refs), func(i int) bool { return refs[i].Seq > after }):]
+	matches := make([]model.SourceMatch, 0)
+	// Whether each aggregate met the filter, as of the search
+	met := make(map[model.AggregateKey]bool)
+	now := time.Now()
+	for _, ref := range refs {
+		if limit >= 0 && len(matches) >= limit {
+			break
+		}
+		aggr := &as.Map[ref.Aggregate].Aggregate
+		log := aggr.Sources[ref.Token][ref.Pos]
+		if !q.Matches(ref.Token, log) {
+			continue
+		}
+		if f != nil {
+			ok, seen := met[ref.Aggregate]
+			if !seen {
+				ok = f.MatchesAt(*aggr, now)
+				met[ref.Aggregate] = ok
+			}
+			if !ok {
+				continue
+			}
+		}
+		matches = append(matches, model.SourceMatch{
+			Aggregate: ref.Aggregate,
+			Token:     ref.Token,
+			ChangeSeq: ref.Seq,
+			SourceLog: log,
+		})
+	}
+	return matches
+}
+
+// Up to limit of the aggregate keys sorting after the given key, in
+// order, whose aggregates meet the filter, if any.  Runs on the store
+// goroutine.
+func (as aggregateStore) list(after model.AggregateKey, f *filter.Filter, limit int) []model.AggregateKey {
+	keys := make([]model.AggregateKey, 0, len(as.Map))
+	for key := range as.Map {
+		if key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	if f == nil {
+		if limit >= 0 && limit < len(keys) {
+			keys = keys[:limit]
+		}
+		return keys
+	}
+	now := time.Now()
+	met := keys[:0]
+	for _, key := range keys {
+		if limit >= 0 && len(met) >= limit {
+			break
+		}
+		if f.MatchesAt(as.Map[key].Aggregate, now) {
+			met = append(met, key)
+		}
+	}
+	return met
+}
+
+// Parses the filter, or gives nil if there isn't one.
+func parseFilter(expr string) (*filter.Filter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return filter.Parse(expr)
+}
@@ -0,0 +1,71 @@
+package inmemory
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/metrics"
+	"time"
+)
+
+// The zero value records nothing.
+type storeMetrics struct {
+	sources    *metrics.Counter
+	domains    *metrics.Counter
+	aggregates *metrics.Gauge
+	versions   *metrics.Gauge
+	queueWait  *metrics.Histogram
+}
+
+type notifierMetrics struct {
+	subscribers *metrics.Gauge
+	delivered   *metrics.Counter
+	dropped     *metrics.Counter
+}
+
+// Record store and notifier metrics in the given registry.
+func WithMetrics(registry *metrics.Registry) StoreOption {
+	return func(s *InMemoryStore) {
+		s.metrics = storeMetrics{
+			sources: registry.Counter(
+				"botlnek_sources_appended_total",
+				"Source appends, by whether they created a version or duplicated an existing source.",
+				"domain", "token", "result",
+			),
+			domains: registry.Counter(
+				"botlnek_domains_created_total",
+				"Domains created.",
+			),
+			aggregates: registry.Gauge(
+				"botlnek_aggregates",
+				"Aggregates held in the store.",
+				"domain",
+			),
+			versions: registry.Gauge(
+				"botlnek_aggregate_versions",
+				"Aggregate versions held in the store, summed across aggregates.",
+				"domain",
+			),
+			queueWait: registry.Histogram(
+				"botlnek_store_queue_wait_seconds",
+				"Time operations wait for the store loop before running.",
+				metrics.LatencyBuckets,
+			),
+		}
+		s.notifier.metrics = notifierMetrics{
+			subscribers: registry.Gauge(
+				"botlnek_subscribers",
+				"Active mutation subscribers.",
+			),
+			delivered: registry.Counter(
+				"botlnek_notifier_events_delivered_total",
+				"Events delivered to subscribers.",
+			),
+			dropped: registry.Counter(
+				"botlnek_notifier_events_dropped_total",
+				"Events dropped because a subscriber wasn't ready.",
+			),
+		}
+	}
+}
+
+func (m storeMetrics) waited(d time.Duration) {
+	m.queueWait.Observe(d.Seconds())
+}
@@ -1,10 +1,15 @@
 package inmemory
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"github.com/ethanrowe/botlnek/pkg/logging"
+	"github.com/ethanrowe/botlnek/pkg/model"
 )
 
+// Given by notifications sent after the notifier is stopped.
+var ErrNotifierStopped = model.NewError(model.CodeUnavailable, "Notifier is stopped")
+
 type JSONNotifier struct {
 	// Channel of notifications
 	notifications chan []byte
@@ -14,8 +19,26 @@ type JSONNotifier struct {
 	exits chan chan []byte
 	// map of client channels.
 	clients map[chan []byte]bool
-	// Channel to stop operations
+	// channel of liveness checks, answered from the loop
+	pings chan chan bool
+	// Closed to stop operations
 	stop chan bool
+	// Closed once operations have stopped
+	done    chan bool
+	metrics notifierMetrics
+	logger  *logging.Logger
+}
+
+func newJSONNotifier() *JSONNotifier {
+	return &JSONNotifier{
+		notifications: make(chan []byte),
+		joins:         make(chan chan []byte),
+		exits:         make(chan chan []byte),
+		clients:       make(map[chan []byte]bool),
+		pings:         make(chan chan bool),
+		stop:          make(chan bool),
+		done:          make(chan bool),
+	}
 }
 
 func (n *JSONNotifier) Notify(data interface{}) error {
@@ -23,48 +46,95 @@ func (n *JSONNotifier) Notify(data interface{}) error {
 	if err != nil {
 		return err
 	}
-	n.notifications <- marshaled
-	return nil
+	select {
+	case n.notifications <- marshaled:
+		return nil
+	case <-n.done:
+		return ErrNotifierStopped
+	}
 }
 
+// Once the notifier stops, subscribing and unsubscribing
+// are no-ops; the client simply receives nothing further.
 func (n *JSONNotifier) Subscribe(client chan []byte) chan interface{} {
 	done := make(chan interface{})
-	n.joins <- client
+	select {
+	case n.joins <- client:
+	case <-n.done:
+	}
 
 	go func() {
 		<-done
-		n.exits <- client
+		select {
+		case n.exits <- client:
+		case <-n.done:
+		}
 	}()
 
 	return done
 }
 
+func (n *JSONNotifier) publish(event []byte) {
+	// Nonblocking sends; if a client isn't ready,
+	// it'll just miss the event.  Too bad.
+	for client, _ := range n.clients {
+		select {
+		case client <- event:
+			n.metrics.delivered.Inc()
+		default:
+			n.metrics.dropped.Inc()
+			n.logger.Debug("event dropped; subscriber not ready")
+		}
+	}
+}
+
 func (n *JSONNotifier) Run() {
-	fmt.Println("Launching notifier.")
+	n.logger.Info("notifier started")
+	defer close(n.done)
 	for {
 		select {
 		case client := <-n.joins:
 			n.clients[client] = true
+			n.metrics.subscribers.Set(float64(len(n.clients)))
 		case client := <-n.exits:
 			delete(n.clients, client)
+			n.metrics.subscribers.Set(float64(len(n.clients)))
 		case event := <-n.notifications:
-			// Nonblocking sends; if a client isn't ready,
-			// it'll just miss the event.  Too bad.
-			for client, _ := range n.clients {
+			n.publish(event)
+		case reply := <-n.pings:
+			reply <- true
+		case <-n.stop:
+			// Deliver whatever is still queued before stopping.
+			for {
 				select {
-				case client <- event:
-					continue
+				case event := <-n.notifications:
+					n.publish(event)
 				default:
-					continue
+					n.logger.Info("notifier stopped", "subscribers", len(n.clients))
+					return
 				}
 			}
-		case <-n.stop:
-			break
 		}
 	}
-	fmt.Println("Stopping notifier")
-	close(n.notifications)
-	close(n.exits)
-	close(n.joins)
+}
+
+// Gives nil once the notifier loop answers, or an error if
+// it's stopped or the context ends first.
+func (n *JSONNotifier) Ping(ctx context.Context) error {
+	reply := make(chan bool, 1)
+	select {
+	case n.pings <- reply:
+		<-reply
+		return nil
+	case <-n.done:
+		return ErrNotifierStopped
+	case <-ctx.Done():
+		return model.Errorf(model.CodeUnavailable, "Notifier unresponsive: %s", ctx.Err())
+	}
+}
+
+// Stops the notifier and waits for it to finish.
+func (n *JSONNotifier) Stop() {
 	close(n.stop)
+	<-n.done
 }
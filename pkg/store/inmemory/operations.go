@@ -2,26 +2,41 @@ package inmemory
 
 import (
 	"github.com/ethanrowe/botlnek/pkg/model"
+	"time"
 )
 
 type operation interface {
 	Do()
+	// Records an error for an operation that could not be done.
+	Fail(error)
 }
 
 type blockingOp struct {
 	op   operation
 	done chan bool
+	// When the op was created, and what to tell of how long
+	// it waited to be done, if anything
+	created time.Time
+	waited  func(time.Duration)
 }
 
 func (b blockingOp) Do() {
+	if b.waited != nil {
+		b.waited(time.Since(b.created))
+	}
 	b.op.Do()
 	b.done <- true
 }
 
+func (b blockingOp) Fail(err error) {
+	b.op.Fail(err)
+}
+
 func newBlockingOp(op operation) blockingOp {
 	return blockingOp{
-		op:   op,
-		done: make(chan bool),
+		op:      op,
+		done:    make(chan bool),
+		created: time.Now(),
 	}
 }
 
@@ -39,10 +54,32 @@ func (op *domainOp) Do() {
 	op.doer(op)
 }
 
+func (op *domainOp) Fail(err error) {
+	op.Err = err
+}
+
+type domainKeysOp struct {
+	doer func(*domainKeysOp)
+	Keys []model.DomainKey
+	Err  error
+}
+
+func newDomainKeysOp(d func(*domainKeysOp)) *domainKeysOp {
+	return &domainKeysOp{doer: d}
+}
+
+func (op *domainKeysOp) Do() {
+	op.doer(op)
+}
+
+func (op *domainKeysOp) Fail(err error) {
+	op.Err = err
+}
+
 type sourceOp struct {
-	doer   func(*sourceOp)
-	Source *model.Source
-	Err    error
+	doer    func(*sourceOp)
+	Receipt *model.SourceReceipt
+	Err     error
 }
 
 func newSourceOp(op func(*sourceOp)) *sourceOp {
@@ -53,6 +90,10 @@ func (op *sourceOp) Do() {
 	op.doer(op)
 }
 
+func (op *sourceOp) Fail(err error) {
+	op.Err = err
+}
+
 type aggregateOp struct {
 	doer      func(*aggregateOp)
 	Aggregate *model.Aggregate
@@ -66,3 +107,61 @@ func newAggregateOp(d func(*aggregateOp)) *aggregateOp {
 func (op *aggregateOp) Do() {
 	op.doer(op)
 }
+
+func (op *aggregateOp) Fail(err error) {
+	op.Err = err
+}
+
+type changesOp struct {
+	doer    func(*changesOp)
+	Changes []model.Change
+	Err     error
+}
+
+func newChangesOp(d func(*changesOp)) *changesOp {
+	return &changesOp{doer: d}
+}
+
+func (op *changesOp) Do() {
+	op.doer(op)
+}
+
+func (op *changesOp) Fail(err error) {
+	op.Err = err
+}
+
+type searchOp struct {
+	doer    func(*searchOp)
+	Matches []model.SourceMatch
+	Err     error
+}
+
+func newSearchOp(d func(*searchOp)) *searchOp {
+	return &searchOp{doer: d}
+}
+
+func (op *searchOp) Do() {
+	op.doer(op)
+}
+
+func (op *searchOp) Fail(err error) {
+	op.Err = err
+}
+
+type aggregateKeysOp struct {
+	doer func(*aggregateKeysOp)
+	Keys []model.AggregateKey
+	Err  error
+}
+
+func newAggregateKeysOp(d func(*aggregateKeysOp)) *aggregateKeysOp {
+	return &aggregateKeysOp{doer: d}
+}
+
+func (op *aggregateKeysOp) Do() {
+	op.doer(op)
+}
+
+func (op *aggregateKeysOp) Fail(err error) {
+	op.Err = err
+}
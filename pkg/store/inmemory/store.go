@@ -1,10 +1,17 @@
 package inmemory
 
 import (
+	"context"
+	"github.com/ethanrowe/botlnek/pkg/logging"
 	"github.com/ethanrowe/botlnek/pkg/model"
+	"sort"
+	"sync"
 	"time"
 )
 
+// Given by operations submitted after the store is stopped.
+var ErrStoreStopped = model.NewError(model.CodeUnavailable, "Store is stopped")
+
 type aggregateSourceKey struct {
 	CollectionToken string
 	SourceKey       string
@@ -13,7 +20,8 @@ type aggregateSourceKey struct {
 type aggregateContainer struct {
 	Count     InMemoryCounter
 	Aggregate model.Aggregate
-	KeyIndex  map[aggregateSourceKey]bool
+	// The position of each registered source in its token's log
+	KeyIndex map[aggregateSourceKey]int
 }
 
 func newAggregateContainer(aggregate model.AggregateKey) *aggregateContainer {
@@ -24,10 +32,22 @@ func newAggregateContainer(aggregate model.AggregateKey) *aggregateContainer {
 			Attrs:   make(map[string]string),
 			Log:     make([]model.ClockEntry, 0, 10),
 		},
-		KeyIndex: make(map[aggregateSourceKey]bool),
+		KeyIndex: make(map[aggregateSourceKey]int),
 	}
 }
 
+// A copy of the aggregate that is safe to read outside the
+// store goroutine while further sources are appended.
+func (pc *aggregateContainer) snapshot() *model.Aggregate {
+	aggr := pc.Aggregate
+	aggr.Log = append([]model.ClockEntry(nil), pc.Aggregate.Log...)
+	aggr.Sources = make(model.SourceLogMap, len(pc.Aggregate.Sources))
+	for token, logs := range pc.Aggregate.Sources {
+		aggr.Sources[token] = append([]model.SourceLog(nil), logs...)
+	}
+	return &aggr
+}
+
 func (pc *aggregateContainer) next() InMemoryCounter {
 	r := pc.Count
 	pc.Count = InMemoryCounter(int64(r) + 1)
@@ -37,86 +57,218 @@ func (pc *aggregateContainer) next() InMemoryCounter {
 type aggregateStore struct {
 	// A map of aggregate keys to aggregate containers
 	Map map[model.AggregateKey]*aggregateContainer
+	// Every version appended to the domain, in order; the
+	// change at index i has sequence number i+1.
+	Changes []model.Change
+	// Secondary indexes of the sources, by their keys and attrs
+	Keys  sourceIndex
+	Attrs sourceIndex
 }
 
 func newAggregateStore() aggregateStore {
 	return aggregateStore{
-		Map: make(map[model.AggregateKey]*aggregateContainer),
+		Map:   make(map[model.AggregateKey]*aggregateContainer),
+		Keys:  make(sourceIndex),
+		Attrs: make(sourceIndex),
 	}
 }
 
+// A domain's mirror of another's sources.
+type mirrorSubscription struct {
+	Domain model.DomainKey
+	Mirror model.Mirror
+}
+
 type InMemoryStore struct {
 	// Map of domains, by domain key
 	domains map[model.DomainKey]model.Domain
+	// The mirrors of each domain's sources, by upstream domain key
+	mirrors map[model.DomainKey][]mirrorSubscription
 	// Map of aggregateStores, by domain key
 	aggregates map[model.DomainKey]aggregateStore
 	requests   chan operation
-	stop       chan bool
-	running    bool
-	notifier   *JSONNotifier
+	// Closed to ask the store loop to stop
+	stop     chan bool
+	stopOnce sync.Once
+	// Closed once the store loop and notifier have stopped
+	done     chan bool
+	notifier *JSONNotifier
+	waiters  waiterSet
+	// Issues the clock entry for each new aggregate version
+	clock   func(*aggregateContainer) model.ClockEntry
+	metrics storeMetrics
+	logger  *logging.Logger
+}
+
+type StoreOption func(*InMemoryStore)
+
+// Versions are counted per aggregate; the default.
+func aggregateCounterClock(pc *aggregateContainer) model.ClockEntry {
+	return model.ClockEntry{SeqNum: pc.next(), Approximate: time.Now()}
+}
+
+// Issue version sequence numbers from a hybrid logical clock with
+// the given node ID, so they are ordered across aggregates and
+// nodes, and derive each version's approximate time from its
+// sequence number.
+func WithHybridLogicalClock(node uint32) StoreOption {
+	return func(s *InMemoryStore) {
+		hlc := NewHybridLogicalClock(node)
+		s.clock = func(pc *aggregateContainer) model.ClockEntry {
+			count := hlc.Now()
+			return model.ClockEntry{SeqNum: count, Approximate: count.Time()}
+		}
+	}
+}
+
+// Log store and notifier lifecycle events to the given logger.
+func WithLogger(logger *logging.Logger) StoreOption {
+	return func(s *InMemoryStore) {
+		s.logger = logger.With("component", "store")
+		s.notifier.logger = logger.With("component", "notifier")
+	}
+}
+
+// Buffer up to the given number of notifications, so appends
+// needn't wait for the notifier to fan each one out.
+func WithNotifierQueue(size int) StoreOption {
+	return func(s *InMemoryStore) {
+		s.notifier.notifications = make(chan []byte, size)
+	}
 }
 
-func NewInMemoryStore() *InMemoryStore {
+func NewInMemoryStore(options ...StoreOption) *InMemoryStore {
 	s := &InMemoryStore{
 		domains:    make(map[model.DomainKey]model.Domain),
+		mirrors:    make(map[model.DomainKey][]mirrorSubscription),
 		aggregates: make(map[model.DomainKey]aggregateStore),
 		requests:   make(chan operation),
 		stop:       make(chan bool),
-		running:    false,
-		notifier: &JSONNotifier{
-			notifications: make(chan []byte),
-			joins:         make(chan chan []byte),
-			exits:         make(chan chan []byte),
-			clients:       make(map[chan []byte]bool),
-		},
+		done:       make(chan bool),
+		waiters:    make(waiterSet),
+		clock:      aggregateCounterClock,
+		notifier:   newJSONNotifier(),
+	}
+	for _, option := range options {
+		option(s)
 	}
 	go s.Run()
 	return s
 }
 
+// Runs the operation on the store goroutine and waits for it to
+// finish.  Once the store is stopped, the operation fails instead.
 func (s *InMemoryStore) Submit(op operation) operation {
-	blocker := newBlockingOp(op)
-	s.requests <- blocker
-	<-blocker.done
-	close(blocker.done)
+	s.submitContext(context.Background(), op)
 	return op
 }
 
+// As Submit, but failing the op if the context ends before the store
+// loop takes it.  Once taken, the op is seen through.
+func (s *InMemoryStore) submitContext(ctx context.Context, op operation) {
+	blocker := newBlockingOp(op)
+	blocker.waited = s.metrics.waited
+	select {
+	case s.requests <- blocker:
+		<-blocker.done
+		close(blocker.done)
+	case <-s.done:
+		op.Fail(ErrStoreStopped)
+	case <-ctx.Done():
+		op.Fail(model.Errorf(model.CodeUnavailable, "Store unresponsive: %s", ctx.Err()))
+	}
+}
+
 func (s *InMemoryStore) Run() {
-	s.running = true
+	s.logger.Info("store started")
 
 	if s.notifier != nil {
 		go s.notifier.Run()
 	}
 
+loop:
 	for {
 		select {
 		case op := <-s.requests:
 			op.Do()
-		case _ = <-s.stop:
-			break
+		case <-s.stop:
+			break loop
 		}
 	}
-	close(s.requests)
-	close(s.stop)
+
+	// Nothing more will arrive for anyone still waiting.
+	s.waiters.releaseAll(s.current)
 
 	if s.notifier != nil {
-		s.notifier.stop <- true
+		s.notifier.Stop()
 	}
 
-	s.running = false
+	s.logger.Info("store stopped")
+	close(s.done)
 }
 
+// Stops the store, waiting for the operation in progress, and for
+// the notifier to deliver any queued notifications.
 func (s *InMemoryStore) Stop() {
-	s.stop <- true
+	s.Shutdown(context.Background())
+}
+
+// Like Stop, but gives up waiting when the context ends.
+func (s *InMemoryStore) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ready if an operation makes a round trip through the store loop,
+// and the notifier loop answers, before the context ends.  With
+// nothing persisted, there's nothing to recover.
+func (s *InMemoryStore) CheckReady(ctx context.Context) error {
+	op := newDomainOp(func(*domainOp) {})
+	if s.submitContext(ctx, op); op.Err != nil {
+		return op.Err
+	}
+	if s.notifier != nil {
+		return s.notifier.Ping(ctx)
+	}
+	return nil
 }
 
 func (s *InMemoryStore) AppendNewDomain(d model.Domain) (*model.Domain, error) {
+	if d.Key == "" {
+		return nil, model.NewError(model.CodeInvalid, "Domain key cannot be empty")
+	}
+	if !d.KeyRule.IsZero() {
+		if err := d.KeyRule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range d.Mirrors {
+		if err := m.Validate(d.Key); err != nil {
+			return nil, err
+		}
+	}
 	container := newDomainOp(func(op *domainOp) {
 		_, ok := s.domains[d.Key]
 		if !ok {
+			for _, m := range d.Mirrors {
+				if _, ok := s.domains[m.Domain]; !ok {
+					op.Err = model.Errorf(model.CodeInvalid, "Cannot mirror domain %q, which does not exist", m.Domain).With("Domain", string(m.Domain))
+					return
+				}
+			}
+			for _, m := range d.Mirrors {
+				s.mirrors[m.Domain] = append(s.mirrors[m.Domain], mirrorSubscription{d.Key, m})
+			}
 			s.domains[d.Key] = d
 			op.Domain = &d
+			s.metrics.domains.Inc()
 		}
 	})
 	s.Submit(container)
@@ -144,50 +296,187 @@ func (s *InMemoryStore) GetDomain(key model.DomainKey) (*model.Domain, error) {
 	return container.Domain, container.Err
 }
 
+func (s *InMemoryStore) ListDomains() ([]model.DomainKey, error) {
+	container := newDomainKeysOp(func(op *domainKeysOp) {
+		op.Keys = make([]model.DomainKey, 0, len(s.domains))
+		for key := range s.domains {
+			op.Keys = append(op.Keys, key)
+		}
+	})
+	s.Submit(container)
+	if container.Err != nil {
+		return nil, container.Err
+	}
+	sort.Slice(container.Keys, func(i, j int) bool {
+		return container.Keys[i] < container.Keys[j]
+	})
+	return container.Keys, nil
+}
+
 func (s *InMemoryStore) AppendNewSource(domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source) (*model.Source, error) {
+	return s.appendPlainSource(domain, aggregate, token, source, model.AnyVersion)
+}
+
+func (s *InMemoryStore) AppendNewSourceAtVersion(domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int) (*model.Source, error) {
+	return s.appendPlainSource(domain, aggregate, token, source, version)
+}
+
+func (s *InMemoryStore) AppendAttributedSource(domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int, provenance model.Provenance) (*model.SourceReceipt, error) {
+	return s.appendSource(domain, aggregate, token, source, version, provenance)
+}
+
+// Appends without provenance, giving the source if it's newly
+// registered, as the plain writers do.
+func (s *InMemoryStore) appendPlainSource(domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int) (*model.Source, error) {
+	receipt, err := s.appendSource(domain, aggregate, token, source, version, model.Provenance{})
+	if err != nil || !receipt.New {
+		return nil, err
+	}
+	return &source, nil
+}
+
+func (s *InMemoryStore) appendSource(domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int, provenance model.Provenance) (*model.SourceReceipt, error) {
+	if err := validateSourceKeys(domain, aggregate, token); err != nil {
+		return nil, err
+	}
 	container := newSourceOp(func(op *sourceOp) {
-		aggrs, ok := s.aggregates[domain]
-		if !ok {
-			aggrs = newAggregateStore()
+		op.Receipt, op.Err = s.register(domain, aggregate, token, source, version, provenance, nil)
+	})
+	s.Submit(container)
+	return container.Receipt, container.Err
+}
+
+// Registers the source with the aggregate, giving the receipt for
+// where it landed, whether newly registered or not, and mirrors a new
+// registration into the domains that subscribe to the token.  Runs on
+// the store goroutine.
+func (s *InMemoryStore) register(domain model.DomainKey, aggregate model.AggregateKey, token string, source model.Source, version int, provenance model.Provenance, origin *model.SourceOrigin) (*model.SourceReceipt, error) {
+	aggrs, ok := s.aggregates[domain]
+	if !ok {
+		aggrs = newAggregateStore()
+	}
+	aggrContainer, isExisting := aggrs.Map[aggregate]
+	if !isExisting {
+		aggrContainer = newAggregateContainer(aggregate)
+	}
+	// The precondition is checked before the idempotency check,
+	// so a conditional writer learns that the aggregate moved
+	// even if its source happens to be present already.
+	if current := len(aggrContainer.Aggregate.Log); version != model.AnyVersion && version != current {
+		return nil, model.VersionMismatchError{
+			Domain:    domain,
+			Aggregate: aggregate,
+			Expected:  version,
+			Actual:    current,
 		}
-		aggrContainer, ok := aggrs.Map[aggregate]
-		if !ok {
-			aggrContainer = newAggregateContainer(aggregate)
+	}
+	registrations, ok := aggrContainer.Aggregate.Sources[token]
+	if !ok {
+		registrations = make([]model.SourceLog, 0, 1)
+	}
+	idempotentKey := aggregateSourceKey{token, source.KeyHash()}
+	if pos, ok := aggrContainer.KeyIndex[idempotentKey]; ok {
+		s.metrics.sources.Inc(string(domain), token, "duplicate")
+		versionIdx := registrations[pos].VersionIdx
+		return receipt(domain, aggregate, token, idempotentKey.SourceKey, versionIdx, aggrContainer.Aggregate.Log[versionIdx], false), nil
+	}
+
+	// It's a new entry, so mutate the store.  Our mutations are
+	// confined to a single goroutine, so this is safe.
+	aggrContainer.KeyIndex[idempotentKey] = len(registrations)
+	clock := s.clock(aggrContainer)
+	clock.ChangeSeq = model.ChangeSeq(len(aggrs.Changes) + 1)
+	aggrContainer.Aggregate.Log = append(aggrContainer.Aggregate.Log, clock)
+	versionIdx := len(aggrContainer.Aggregate.Log) - 1
+	aggrs.Changes = append(aggrs.Changes, model.Change{
+		Seq:          clock.ChangeSeq,
+		AggregateKey: aggregate,
+		VersionIdx:   versionIdx,
+	})
+	entry := model.SourceLog{
+		VersionIdx: versionIdx,
+		Key:        idempotentKey.SourceKey,
+		Source:     source,
+		Origin:     origin,
+	}
+	if !provenance.IsZero() {
+		entry.Provenance = &provenance
+	}
+	aggrContainer.Aggregate.Sources[token] = append(registrations, entry)
+	ref := sourceRef{Seq: clock.ChangeSeq, Aggregate: aggregate, Token: token, Pos: len(registrations)}
+	aggrs.Keys.add(source.Keys, ref)
+	aggrs.Attrs.add(source.Attrs, ref)
+	aggrs.Map[aggregate] = aggrContainer
+	s.aggregates[domain] = aggrs
+
+	// And notify, ignoring errors.  Subscribers don't get to see
+	// provenance, which is only given to readers who ask for it.
+	_ = s.NotifyMutationSubscribers(model.AggregateMessage{
+		DomainKey: domain,
+		Aggregate: aggrContainer.Aggregate.View(model.ProvenanceFilter{}, false),
+	})
+	s.waiters.release(waiterKey{domain, aggregate}, aggrContainer)
+
+	s.metrics.sources.Inc(string(domain), token, "created")
+	s.metrics.versions.Add(1, string(domain))
+	if !isExisting {
+		s.metrics.aggregates.Add(1, string(domain))
+	}
+
+	s.mirror(model.SourceOrigin{
+		Domain:     domain,
+		Aggregate:  aggregate,
+		Token:      token,
+		VersionIdx: versionIdx,
+	}, source, provenance)
+	return receipt(domain, aggregate, token, idempotentKey.SourceKey, versionIdx, clock, true), nil
+}
+
+func receipt(domain model.DomainKey, aggregate model.AggregateKey, token, keyHash string, versionIdx int, clock model.ClockEntry, isNew bool) *model.SourceReceipt {
+	return &model.SourceReceipt{
+		Domain:     domain,
+		Aggregate:  aggregate,
+		Token:      token,
+		KeyHash:    keyHash,
+		VersionIdx: versionIdx,
+		ClockEntry: clock,
+		New:        isNew,
+	}
+}
+
+// Registers the source, newly registered upstream, with each domain
+// mirroring the upstream token.  A source the mirror's key rule cannot
+// place is logged and left out; the upstream registration stands
+// regardless.  Runs on the store goroutine.
+func (s *InMemoryStore) mirror(origin model.SourceOrigin, source model.Source, provenance model.Provenance) {
+	for _, sub := range s.mirrors[origin.Domain] {
+		if !sub.Mirror.Matches(origin.Token) {
+			continue
 		}
-		registrations, ok := aggrContainer.Aggregate.Sources[token]
-		if !ok {
-			registrations = make([]model.SourceLog, 0, 1)
-		}
-		idempotentKey := aggregateSourceKey{token, source.KeyHash()}
-		reg, _ := aggrContainer.KeyIndex[idempotentKey]
-		// This is a new reg if it's not present already.
-		if !reg {
-			op.Source = &source
-		}
-		if op.Err == nil && op.Source != nil {
-			// In this case it's a new entry, so mutate the
-			// store.  Our mutations are confined to a single
-			// goroutine, so this is safe.
-			aggrContainer.KeyIndex[idempotentKey] = true
-			clock := model.ClockEntry{aggrContainer.next(), time.Now()}
-			aggrContainer.Aggregate.Log = append(aggrContainer.Aggregate.Log, clock)
-			aggrContainer.Aggregate.Sources[token] = append(registrations, model.SourceLog{
-				VersionIdx: len(aggrContainer.Aggregate.Log) - 1,
-				Key:        idempotentKey.SourceKey,
-				Source:     source,
-			})
-			aggrs.Map[aggregate] = aggrContainer
-			s.aggregates[domain] = aggrs
-
-			// And notify, ignoring errors.
-			_ = s.NotifyMutationSubscribers(model.AggregateMessage{
-				DomainKey: domain,
-				Aggregate: aggrContainer.Aggregate,
-			})
+		keys, err := sub.Mirror.Keys(origin, source)
+		if err != nil {
+			s.logger.Warn("source not mirrored", "domain", sub.Domain,
+				"origin_domain", origin.Domain, "origin_aggregate", origin.Aggregate, "token", origin.Token, "error", err)
+			continue
 		}
-	})
-	s.Submit(container)
-	return container.Source, container.Err
+		for _, key := range keys {
+			o := origin
+			s.register(sub.Domain, key, sub.Mirror.MirroredToken(origin.Token), source, model.AnyVersion, provenance, &o)
+		}
+	}
+}
+
+func validateSourceKeys(domain model.DomainKey, aggregate model.AggregateKey, token string) error {
+	for _, key := range []struct{ name, value string }{
+		{"Domain", string(domain)},
+		{"Aggregate", string(aggregate)},
+		{"Token", token},
+	} {
+		if key.value == "" {
+			return model.Errorf(model.CodeInvalid, "%s key cannot be empty", key.name).With("Key", key.name)
+		}
+	}
+	return nil
 }
 
 /*
@@ -208,13 +497,113 @@ func (s *InMemoryStore) GetAggregate(domain model.DomainKey, aggregate model.Agg
 		if !ok {
 			return
 		}
-		op.Aggregate = &aggrContainer.Aggregate
+		op.Aggregate = aggrContainer.snapshot()
 		op.Err = nil
 	})
 	s.Submit(container)
 	return container.Aggregate, container.Err
 }
 
+func (s *InMemoryStore) GetChanges(domain model.DomainKey, after model.ChangeSeq, limit int) ([]model.Change, error) {
+	container := newChangesOp(func(op *changesOp) {
+		changes := s.aggregates[domain].Changes
+		// Sequence numbers are one past their index.
+		if after >= model.ChangeSeq(len(changes)) {
+			op.Changes = make([]model.Change, 0)
+			return
+		}
+		changes = changes[after:]
+		if limit >= 0 && limit < len(changes) {
+			changes = changes[:limit]
+		}
+		op.Changes = append(make([]model.Change, 0, len(changes)), changes...)
+	})
+	s.Submit(container)
+	return container.Changes, container.Err
+}
+
+func (s *InMemoryStore) SearchSources(domain model.DomainKey, query model.SourceQuery, after model.ChangeSeq, limit int) ([]model.SourceMatch, error) {
+	if err := query.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := parseFilter(query.Filter)
+	if err != nil {
+		return nil, err
+	}
+	container := newSearchOp(func(op *searchOp) {
+		aggrs, ok := s.aggregates[domain]
+		if !ok {
+			op.Matches = make([]model.SourceMatch, 0)
+			return
+		}
+		op.Matches = aggrs.search(query, f, after, limit)
+	})
+	s.Submit(container)
+	return container.Matches, container.Err
+}
+
+func (s *InMemoryStore) ListAggregates(domain model.DomainKey, after model.AggregateKey, limit int, expr string) ([]model.AggregateKey, error) {
+	f, err := parseFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	container := newAggregateKeysOp(func(op *aggregateKeysOp) {
+		aggrs, ok := s.aggregates[domain]
+		if !ok {
+			op.Keys = make([]model.AggregateKey, 0)
+			return
+		}
+		op.Keys = aggrs.list(after, f, limit)
+	})
+	s.Submit(container)
+	return container.Keys, container.Err
+}
+
+func (s *InMemoryStore) WaitForAggregate(ctx context.Context, domain model.DomainKey, aggregate model.AggregateKey, version int) (*model.Aggregate, error) {
+	key := waiterKey{domain, aggregate}
+	waiter := newAggregateWaiter(version)
+	container := newAggregateOp(func(op *aggregateOp) {
+		if aggrContainer, ok := s.aggregates[domain].Map[aggregate]; ok && len(aggrContainer.Aggregate.Log) > version {
+			op.Aggregate = aggrContainer.snapshot()
+			return
+		}
+		s.waiters.add(key, waiter)
+	})
+	s.Submit(container)
+	if container.Aggregate != nil || container.Err != nil {
+		return container.Aggregate, container.Err
+	}
+
+	select {
+	case aggr := <-waiter.ready:
+		return aggr, nil
+	case <-ctx.Done():
+	}
+
+	// Give up our place, and take the aggregate as it stands, unless
+	// a release beat us to it.
+	container = newAggregateOp(func(op *aggregateOp) {
+		s.waiters.remove(key, waiter)
+		op.Aggregate = s.current(key)
+	})
+	s.Submit(container)
+	select {
+	case aggr := <-waiter.ready:
+		return aggr, nil
+	default:
+		return container.Aggregate, container.Err
+	}
+}
+
+// A snapshot of the aggregate as it stands, or nil if there's no such
+// aggregate.  Runs on the store goroutine.
+func (s *InMemoryStore) current(key waiterKey) *model.Aggregate {
+	if aggrContainer, ok := s.aggregates[key.Domain].Map[key.Aggregate]; ok {
+		return aggrContainer.snapshot()
+	}
+	return nil
+}
+
 func (s *InMemoryStore) SubscribeToMutations(client chan []byte) chan interface{} {
 	return s.notifier.Subscribe(client)
 }
@@ -1,12 +1,15 @@
 package inmemory
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/ethanrowe/botlnek/pkg/model"
 	"github.com/ethanrowe/botlnek/pkg/util"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func makeTestDomain(i int, keyvals ...string) model.Domain {
@@ -63,7 +66,7 @@ func generateTestSources(prefix string) chan model.Source {
 				attrs[ak] = av
 			}
 			count++
-			chn <- model.Source{keys, attrs}
+			chn <- model.Source{Keys: keys, Attrs: attrs}
 		}
 	}()
 	return chn
@@ -183,7 +186,7 @@ func (s scenario) verify(store *InMemoryStore) (r bool, err error) {
 				// Find the source by position within the collection
 				srcLog := tks[expectPerToken[source.Token]-1]
 				if srcLog.Key != source.Key {
-					err = fmt.Errorf("Could not find domain %q aggregate %q token %q source %q (%q)\n\treceived: %q", dk, pk, source.Token, source.Key, source.Source, srcLog)
+					err = fmt.Errorf("Could not find domain %q aggregate %q token %q source %q (%v)\n\treceived: %v", dk, pk, source.Token, source.Key, source.Source, srcLog)
 					return r, err
 				}
 				// Verify that the version index matches our
@@ -223,7 +226,7 @@ func (s scenario) verify(store *InMemoryStore) (r bool, err error) {
 			}
 
 			if !reflect.DeepEqual(expectPerToken, receivedPerToken) {
-				err = fmt.Errorf("domain %q aggregate %q token sources mismatch (got %q; expected %q", dk, pk, receivedPerToken, expectPerToken)
+				err = fmt.Errorf("domain %q aggregate %q token sources mismatch (got %v; expected %v", dk, pk, receivedPerToken, expectPerToken)
 				return r, err
 			}
 		}
@@ -232,6 +235,22 @@ func (s scenario) verify(store *InMemoryStore) (r bool, err error) {
 	return
 }
 
+func TestListDomains(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+	keys, err := s.ListDomains()
+	if err != nil || keys == nil || len(keys) != 0 {
+		t.Fatalf("Expected an empty list; got %v, %v", keys, err)
+	}
+	for _, key := range []model.DomainKey{"b", "c", "a"} {
+		s.AppendNewDomain(model.Domain{Key: key})
+	}
+	keys, err = s.ListDomains()
+	if err != nil || !reflect.DeepEqual(keys, []model.DomainKey{"a", "b", "c"}) {
+		t.Fatalf("Expected sorted keys; got %v, %v", keys, err)
+	}
+}
+
 func TestAppendNewSource(t *testing.T) {
 	s := NewInMemoryStore()
 	defer s.Stop()
@@ -389,10 +408,550 @@ func TestAppendNewSourceNotification(t *testing.T) {
 		}
 
 		if !reflect.DeepEqual(receivedSources, sourceLogs[0:i+1]) {
-			t.Errorf("Mismatch of sources:\n\tExpected %q\n\tReceived %q\n", sourceLogs[0:i+1], receivedSources)
+			t.Errorf("Mismatch of sources:\n\tExpected %v\n\tReceived %v\n", sourceLogs[0:i+1], receivedSources)
 		}
 	}
 
 	close(events)
 	done <- true
 }
+
+func TestAppendValidation(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+	source := <-generateTestSources("validation")
+
+	if _, err := s.AppendNewDomain(model.Domain{}); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected an invalid error for an empty domain key; got %v", err)
+	}
+	for _, keys := range [][]string{{"", "a", "t"}, {"d", "", "t"}, {"d", "a", ""}} {
+		_, err := s.AppendNewSource(model.DomainKey(keys[0]), model.AggregateKey(keys[1]), keys[2], source)
+		if model.CodeOf(err) != model.CodeInvalid {
+			t.Errorf("Expected an invalid error for keys %q; got %v", keys, err)
+		}
+	}
+	if model.CodeOf(ErrStoreStopped) != model.CodeUnavailable || model.CodeOf(ErrNotifierStopped) != model.CodeUnavailable {
+		t.Error("Stopped store and notifier should be unavailable")
+	}
+}
+
+func TestAppendNewSourceAtVersion(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+
+	aggrkeyGen := generateTestAggregateKeys("sourceappend-conditional")
+	tokenGen := generateTestTokens("sourceappend-conditional")
+	sourceGen := generateTestSources("sourceappend-conditional")
+
+	d := makeTestDomain(0, "conditional", "appends")
+	if _, e := s.AppendNewDomain(d); e != nil {
+		t.Fatalf("Failed to append domain: %s", e)
+	}
+
+	pk := <-aggrkeyGen
+	tk := <-tokenGen
+	sources := []model.Source{<-sourceGen, <-sourceGen, <-sourceGen}
+
+	// A nonexistent aggregate is at version 0.
+	res, err := s.AppendNewSourceAtVersion(d.Key, pk, tk, sources[0], 1)
+	if res != nil {
+		t.Fatalf("Unexpected append result against missing aggregate: %v", res)
+	}
+	mismatch, ok := err.(model.VersionMismatchError)
+	if !ok {
+		t.Fatalf("Expected a version mismatch; got: %v", err)
+	}
+	if model.CodeOf(err) != model.CodePreconditionFailed {
+		t.Errorf("Version mismatch has code %s", model.CodeOf(err))
+	}
+	if mismatch.Expected != 1 || mismatch.Actual != 0 {
+		t.Errorf("Wrong mismatch details: %v", mismatch)
+	}
+	if aggr, _ := s.GetAggregate(d.Key, pk); aggr != nil {
+		t.Fatalf("Failed conditional append should not create the aggregate")
+	}
+
+	for i, source := range sources {
+		res, err = s.AppendNewSourceAtVersion(d.Key, pk, tk, source, i)
+		if err != nil {
+			t.Fatalf("Failed conditional append at version %d: %s", i, err)
+		}
+		if res == nil || !reflect.DeepEqual(*res, source) {
+			t.Fatalf("Result mismatch at version %d (wanted %v; got %v)", i, source, res)
+		}
+	}
+
+	// A stale expectation fails even for a redundant source.
+	res, err = s.AppendNewSourceAtVersion(d.Key, pk, tk, sources[0], 1)
+	if res != nil {
+		t.Errorf("Unexpected append result on stale version: %v", res)
+	}
+	mismatch, ok = err.(model.VersionMismatchError)
+	if !ok || mismatch.Expected != 1 || mismatch.Actual != len(sources) {
+		t.Errorf("Expected mismatch of 1 against %d; got: %v", len(sources), err)
+	}
+
+	// A current expectation with a redundant source is the usual no-op.
+	res, err = s.AppendNewSourceAtVersion(d.Key, pk, tk, sources[0], len(sources))
+	if res != nil || err != nil {
+		t.Errorf("Redundant conditional append should give nil, non-error result (result: %v; error: %v)", res, err)
+	}
+
+	aggr, err := s.GetAggregate(d.Key, pk)
+	if err != nil || aggr == nil {
+		t.Fatalf("Failed to get aggregate (error: %v)", err)
+	}
+	if l := len(aggr.Log); l != len(sources) {
+		t.Errorf("Expected %d versions; got %d", len(sources), l)
+	}
+}
+
+func TestAppendAttributedSource(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+	sourceGen := generateTestSources("attributed")
+	first, second := <-sourceGen, <-sourceGen
+
+	res, err := s.AppendAttributedSource("d", "a", "t", first, model.AnyVersion, model.Provenance{Principal: "alice"})
+	if res == nil || err != nil || !res.New || res.VersionIdx != 0 || res.KeyHash != first.KeyHash() || res.ClockEntry.ChangeSeq != 1 {
+		t.Fatalf("Failed attributed append (result: %v; error: %v)", res, err)
+	}
+	// A duplicate keeps the original provenance, and gives the
+	// original's receipt.
+	dup, err := s.AppendAttributedSource("d", "a", "t", first, model.AnyVersion, model.Provenance{Principal: "bob"})
+	if dup == nil || err != nil || dup.New || dup.VersionIdx != 0 || dup.ClockEntry != res.ClockEntry {
+		t.Fatalf("Duplicate attributed append should be a no-op (result: %v; error: %v)", dup, err)
+	}
+	if res, err = s.AppendAttributedSource("d", "a", "t", second, 1, model.Provenance{}); err != nil || !res.New || res.VersionIdx != 1 {
+		t.Fatalf("Failed conditional attributed append: %v, %v", res, err)
+	}
+	if _, err = s.AppendAttributedSource("d", "a", "t", second, 1, model.Provenance{}); model.CodeOf(err) != model.CodePreconditionFailed {
+		t.Errorf("Expected a failed precondition; got %v", err)
+	}
+
+	aggr, _ := s.GetAggregate("d", "a")
+	logs := aggr.Sources["t"]
+	if len(logs) != 2 {
+		t.Fatalf("Expected 2 sources; got %v", logs)
+	}
+	if logs[0].Provenance == nil || logs[0].Provenance.Principal != "alice" {
+		t.Errorf("Expected alice's provenance; got %v", logs[0].Provenance)
+	}
+	if logs[1].Provenance != nil {
+		t.Errorf("Expected no provenance without details; got %v", logs[1].Provenance)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+	mid := model.Domain{Key: "mid", Mirrors: []model.Mirror{
+		{Domain: "up", Tokens: []string{"model"}, KeyRule: model.KeyRule{Template: "{{.Keys.region}}-{{.Aggregate}}"}},
+	}}
+	down := model.Domain{Key: "down", Mirrors: []model.Mirror{{Domain: "mid", Token: "upstream"}}}
+	if _, err := s.AppendNewDomain(mid); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected mirroring a missing domain to be invalid; got %v", err)
+	}
+	if _, err := s.AppendNewDomain(model.Domain{Key: "self", Mirrors: []model.Mirror{{Domain: "self"}}}); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected mirroring itself to be invalid; got %v", err)
+	}
+	for _, d := range []model.Domain{{Key: "up"}, mid, down} {
+		if res, err := s.AppendNewDomain(d); res == nil || err != nil {
+			t.Fatalf("Failed to create domain %s (result: %v; error: %v)", d.Key, res, err)
+		}
+	}
+
+	source := model.Source{Keys: map[string]string{"region": "eu"}}
+	if _, err := s.AppendAttributedSource("up", "a", "other", source, model.AnyVersion, model.Provenance{}); err != nil {
+		t.Fatalf("Failed append: %s", err)
+	}
+	if res, err := s.AppendAttributedSource("up", "a", "model", source, 1, model.Provenance{Principal: "alice"}); res == nil || !res.New || err != nil {
+		t.Fatalf("Failed append (result: %v; error: %v)", res, err)
+	}
+	// Only new upstream registrations are mirrored.
+	if res, err := s.AppendNewSource("up", "a", "model", source); res != nil || err != nil {
+		t.Fatalf("Duplicate append should be a no-op (result: %v; error: %v)", res, err)
+	}
+	// A source the mirror cannot place is left upstream.
+	if res, err := s.AppendNewSource("up", "a", "model", model.Source{Keys: map[string]string{"k": "v"}}); res == nil || err != nil {
+		t.Fatalf("Failed append (result: %v; error: %v)", res, err)
+	}
+
+	aggr, _ := s.GetAggregate("mid", "eu-a")
+	if aggr == nil || len(aggr.Log) != 1 || len(aggr.Sources) != 1 || len(aggr.Sources["model"]) != 1 {
+		t.Fatalf("Expected the model source mirrored into mid; got %+v", aggr)
+	}
+	logs := aggr.Sources["model"]
+	expected := model.SourceOrigin{Domain: "up", Aggregate: "a", Token: "model", VersionIdx: 1}
+	if logs[0].Origin == nil || *logs[0].Origin != expected {
+		t.Errorf("Expected origin %+v; got %+v", expected, logs[0].Origin)
+	}
+	if logs[0].Provenance == nil || logs[0].Provenance.Principal != "alice" {
+		t.Errorf("Expected the upstream provenance; got %+v", logs[0].Provenance)
+	}
+	if !reflect.DeepEqual(logs[0].Source, source) {
+		t.Errorf("Expected source %+v; got %+v", source, logs[0].Source)
+	}
+
+	// Mirrors chain, each referring to the domain it mirrors.
+	aggr, _ = s.GetAggregate("down", "eu-a")
+	if aggr == nil || len(aggr.Sources["upstream"]) != 1 {
+		t.Fatalf("Expected the source mirrored into down; got %+v", aggr)
+	}
+	expected = model.SourceOrigin{Domain: "mid", Aggregate: "eu-a", Token: "model", VersionIdx: 0}
+	if origin := aggr.Sources["upstream"][0].Origin; origin == nil || *origin != expected {
+		t.Errorf("Expected origin %+v; got %+v", expected, origin)
+	}
+	if changes, _ := s.GetChanges("down", 0, -1); len(changes) != 1 {
+		t.Errorf("Expected the mirrored version in the change feed; got %v", changes)
+	}
+}
+
+func TestSearchSources(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+	source := func(asof, series string) model.Source {
+		return model.Source{Keys: map[string]string{"asof": asof}, Attrs: map[string]string{"series": series}}
+	}
+	s.AppendNewSource("d", "a", "t", source("1", "foo"))
+	s.AppendNewSource("d", "b", "t", source("1", "bar"))
+	s.AppendAttributedSource("d", "b", "u", source("2", "foo"), model.AnyVersion, model.Provenance{Publisher: "etl"})
+	s.AppendNewSource("d", "a", "t", source("1", "foo"))
+	s.AppendNewSource("other", "a", "t", source("1", "foo"))
+
+	for _, c := range []struct {
+		query    model.SourceQuery
+		after    model.ChangeSeq
+		limit    int
+		expected []string
+	}{
+		{model.SourceQuery{Keys: map[string]string{"asof": "1"}}, 0, -1, []string{"a/t/1", "b/t/2"}},
+		{model.SourceQuery{Attrs: map[string]string{"series": "foo"}}, 0, -1, []string{"a/t/1", "b/u/3"}},
+		{model.SourceQuery{Attrs: map[string]string{"series": "foo"}}, 1, -1, []string{"b/u/3"}},
+		{model.SourceQuery{Attrs: map[string]string{"series": "foo"}}, 0, 1, []string{"a/t/1"}},
+		{model.SourceQuery{Keys: map[string]string{"asof": "1"}, Attrs: map[string]string{"series": "bar"}}, 0, -1, []string{"b/t/2"}},
+		{model.SourceQuery{Keys: map[string]string{"asof": "2"}, Token: "t"}, 0, -1, []string{}},
+		{model.SourceQuery{Keys: map[string]string{"asof": "2"}, Provenance: model.ProvenanceFilter{Publisher: "etl"}}, 0, -1, []string{"b/u/3"}},
+		{model.SourceQuery{Keys: map[string]string{"missing": "1"}}, 0, -1, []string{}},
+		{model.SourceQuery{Attrs: map[string]string{"series": "foo"}, Filter: `count("*") >= 2`}, 0, -1, []string{"b/u/3"}},
+		{model.SourceQuery{Attrs: map[string]string{"series": "foo"}, Filter: `count("*") >= 2`}, 0, 0, []string{}},
+	} {
+		matches, err := s.SearchSources("d", c.query, c.after, c.limit)
+		found := make([]string, len(matches))
+		for i, m := range matches {
+			found[i] = fmt.Sprintf("%s/%s/%d", m.Aggregate, m.Token, m.ChangeSeq)
+		}
+		if err != nil || !reflect.DeepEqual(found, c.expected) {
+			t.Errorf("Query %+v after %d: expected %v; got %v, %v", c.query, c.after, c.expected, found, err)
+		}
+	}
+	if matches, err := s.SearchSources("missing", model.SourceQuery{Keys: map[string]string{"asof": "1"}}, 0, -1); len(matches) != 0 || err != nil {
+		t.Errorf("Expected no matches in a missing domain; got %v, %v", matches, err)
+	}
+	if _, err := s.SearchSources("d", model.SourceQuery{Token: "t"}, 0, -1); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected a query without keys or attrs to be invalid; got %v", err)
+	}
+	if _, err := s.SearchSources("d", model.SourceQuery{Keys: map[string]string{"asof": "1"}, Filter: "count("}, 0, -1); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected an invalid filter to be invalid; got %v", err)
+	}
+}
+
+func TestListAggregates(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+	for _, aggr := range []model.AggregateKey{"c", "a", "d", "b"} {
+		s.AppendNewSource("d", aggr, "t", model.Source{Keys: map[string]string{"k": "1"}})
+	}
+	s.AppendNewSource("d", "d", "u", model.Source{Keys: map[string]string{"k": "2"}})
+	s.AppendNewSource("d", "b", "u", model.Source{Keys: map[string]string{"k": "2"}})
+	s.AppendNewSource("other", "z", "t", model.Source{Keys: map[string]string{"k": "1"}})
+
+	for _, c := range []struct {
+		after    model.AggregateKey
+		limit    int
+		filter   string
+		expected []model.AggregateKey
+	}{
+		{"", -1, "", []model.AggregateKey{"a", "b", "c", "d"}},
+		{"a", 2, "", []model.AggregateKey{"b", "c"}},
+		{"d", -1, "", []model.AggregateKey{}},
+		{"", -1, `any("u", key.k == "2")`, []model.AggregateKey{"b", "d"}},
+		{"b", -1, `version == 2`, []model.AggregateKey{"d"}},
+		{"", 1, `version == 2`, []model.AggregateKey{"b"}},
+	} {
+		keys, err := s.ListAggregates("d", c.after, c.limit, c.filter)
+		if err != nil || !reflect.DeepEqual(keys, c.expected) {
+			t.Errorf("After %q, limit %d, filter %q: expected %v; got %v, %v", c.after, c.limit, c.filter, c.expected, keys, err)
+		}
+	}
+	if keys, err := s.ListAggregates("missing", "", -1, ""); len(keys) != 0 || err != nil {
+		t.Errorf("Expected no aggregates in a missing domain; got %v, %v", keys, err)
+	}
+	if _, err := s.ListAggregates("d", "", -1, "version"); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected an invalid filter to be invalid; got %v", err)
+	}
+}
+
+func TestWaitForAggregate(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+
+	aggrkeyGen := generateTestAggregateKeys("wait")
+	tokenGen := generateTestTokens("wait")
+	sourceGen := generateTestSources("wait")
+
+	d := makeTestDomain(0, "wait", "for it")
+	if _, e := s.AppendNewDomain(d); e != nil {
+		t.Fatalf("Failed to append domain: %s", e)
+	}
+	pk, tk := <-aggrkeyGen, <-tokenGen
+
+	// Nothing arrives, so we time out with nothing, as there's no
+	// aggregate yet.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	aggr, err := s.WaitForAggregate(ctx, d.Key, pk, 0)
+	cancel()
+	if aggr != nil || err != nil {
+		t.Fatalf("Expected nil, non-error result on timeout (result: %v; error: %v)", aggr, err)
+	}
+	if l := len(s.waiters); l != 0 {
+		t.Errorf("Expired waiter was not removed; %d remain", l)
+	}
+
+	// A waiter is released by the append that takes
+	// the aggregate past its version.
+	results := make(chan *model.Aggregate)
+	for i := 0; i < 2; i++ {
+		go func(version int) {
+			aggr, _ := s.WaitForAggregate(context.Background(), d.Key, pk, version)
+			results <- aggr
+		}(i)
+	}
+	for {
+		waiting := make(chan int, 1)
+		s.Submit(newAggregateOp(func(op *aggregateOp) {
+			waiting <- len(s.waiters[waiterKey{d.Key, pk}])
+		}))
+		if <-waiting == 2 {
+			break
+		}
+	}
+
+	for i := 1; i <= 2; i++ {
+		if _, err := s.AppendNewSource(d.Key, pk, tk, <-sourceGen); err != nil {
+			t.Fatalf("Failed appending source: %s", err)
+		}
+		select {
+		case aggr := <-results:
+			if aggr == nil || len(aggr.Log) != i {
+				t.Fatalf("Expected aggregate at version %d; got %v", i, aggr)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Waiter not released at version %d", i)
+		}
+	}
+
+	// Already past the version, so no waiting.
+	aggr, err = s.WaitForAggregate(context.Background(), d.Key, pk, 1)
+	if err != nil || aggr == nil || len(aggr.Log) != 2 {
+		t.Errorf("Expected immediate aggregate at version 2 (result: %v; error: %v)", aggr, err)
+	}
+
+	// Timing out on an aggregate that exists gives it as it stands.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	aggr, err = s.WaitForAggregate(ctx, d.Key, pk, 2)
+	cancel()
+	if err != nil || aggr == nil || len(aggr.Log) != 2 {
+		t.Errorf("Expected the aggregate at version 2 on timeout (result: %v; error: %v)", aggr, err)
+	}
+}
+
+func TestGetChanges(t *testing.T) {
+	s := NewInMemoryStore()
+	defer s.Stop()
+
+	aggrkeyGen := generateTestAggregateKeys("changes")
+	tokenGen := generateTestTokens("changes")
+	sourceGen := generateTestSources("changes")
+
+	doms := []model.Domain{
+		makeTestDomain(0, "change", "feed"),
+		makeTestDomain(1, "other", "feed"),
+	}
+	for _, d := range doms {
+		if _, e := s.AppendNewDomain(d); e != nil {
+			t.Fatalf("Failed to append domain: %s", e)
+		}
+	}
+	aggrs := []model.AggregateKey{<-aggrkeyGen, <-aggrkeyGen}
+	tk := <-tokenGen
+
+	// Interleave aggregates and domains; each domain's feed
+	// should only see its own changes, in append order.
+	expected := make([]model.Change, 0)
+	for i := 0; i < 6; i++ {
+		src := <-sourceGen
+		aggr := aggrs[(i/2)%2]
+		for _, d := range doms {
+			if _, err := s.AppendNewSource(d.Key, aggr, tk, src); err != nil {
+				t.Fatalf("Failed appending source: %s", err)
+			}
+			// Redundant appends aren't changes.
+			if _, err := s.AppendNewSource(d.Key, aggr, tk, src); err != nil {
+				t.Fatalf("Failed appending redundant source: %s", err)
+			}
+		}
+		expected = append(expected, model.Change{
+			Seq:          model.ChangeSeq(i + 1),
+			AggregateKey: aggr,
+			VersionIdx:   (i/4)*2 + i%2,
+		})
+	}
+
+	for _, d := range doms {
+		changes, err := s.GetChanges(d.Key, 0, -1)
+		if err != nil {
+			t.Fatalf("Failed getting changes: %s", err)
+		}
+		if !reflect.DeepEqual(changes, expected) {
+			t.Errorf("Change feed mismatch for domain %q:\n\texpected: %v\n\treceived: %v", d.Key, expected, changes)
+		}
+
+		// The versions carry their change sequence numbers.
+		for _, change := range changes {
+			aggr, _ := s.GetAggregate(d.Key, change.AggregateKey)
+			if seq := aggr.Log[change.VersionIdx].ChangeSeq; seq != change.Seq {
+				t.Errorf("Version %d of aggregate %q has change seq %s; expected %s", change.VersionIdx, change.AggregateKey, seq, change.Seq)
+			}
+		}
+	}
+
+	page, err := s.GetChanges(doms[0].Key, 2, 3)
+	if err != nil || !reflect.DeepEqual(page, expected[2:5]) {
+		t.Errorf("Paged change feed mismatch (error: %v):\n\texpected: %v\n\treceived: %v", err, expected[2:5], page)
+	}
+
+	page, err = s.GetChanges(doms[0].Key, 6, 10)
+	if err != nil || page == nil || len(page) != 0 {
+		t.Errorf("Expected empty page at end of feed (error: %v); got %v", err, page)
+	}
+
+	page, err = s.GetChanges(model.DomainKey("no-such-domain"), 0, 10)
+	if err != nil || page == nil || len(page) != 0 {
+		t.Errorf("Expected empty page for missing domain (error: %v); got %v", err, page)
+	}
+}
+
+func TestStopStore(t *testing.T) {
+	s := NewInMemoryStore(WithNotifierQueue(5))
+
+	aggrkeyGen := generateTestAggregateKeys("stop")
+	tokenGen := generateTestTokens("stop")
+	sourceGen := generateTestSources("stop")
+
+	d := makeTestDomain(0, "stop", "me")
+	if _, e := s.AppendNewDomain(d); e != nil {
+		t.Fatalf("Failed to append domain: %s", e)
+	}
+	pk, tk := <-aggrkeyGen, <-tokenGen
+
+	events := make(chan []byte, 5)
+	done := s.SubscribeToMutations(events)
+
+	waited := make(chan *model.Aggregate)
+	go func() {
+		aggr, _ := s.WaitForAggregate(context.Background(), d.Key, pk, 1)
+		waited <- aggr
+	}()
+
+	if _, err := s.AppendNewSource(d.Key, pk, tk, <-sourceGen); err != nil {
+		t.Fatalf("Failed appending source: %s", err)
+	}
+	for {
+		waiting := make(chan int, 1)
+		s.Submit(newAggregateOp(func(op *aggregateOp) {
+			waiting <- len(s.waiters[waiterKey{d.Key, pk}])
+		}))
+		if <-waiting == 1 {
+			break
+		}
+	}
+
+	stopped := make(chan bool)
+	go func() {
+		s.Stop()
+		stopped <- true
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Store did not stop")
+	}
+
+	// The queued notification is delivered before the notifier stops.
+	select {
+	case <-events:
+	default:
+		t.Error("Queued notification was not delivered")
+	}
+
+	// Pending waits end with the aggregate as it stands.
+	select {
+	case aggr := <-waited:
+		if aggr == nil || len(aggr.Log) != 1 {
+			t.Errorf("Expected the aggregate at version 1 from the interrupted wait; got %v", aggr)
+		}
+	case <-time.After(time.Second):
+		t.Error("Pending wait was not released")
+	}
+
+	// Further operations fail rather than block.
+	if _, err := s.GetDomain(d.Key); err != ErrStoreStopped {
+		t.Errorf("Expected ErrStoreStopped; got %v", err)
+	}
+	if _, err := s.AppendNewSource(d.Key, pk, tk, <-sourceGen); err != ErrStoreStopped {
+		t.Errorf("Expected ErrStoreStopped; got %v", err)
+	}
+
+	// Unsubscribing and stopping again are harmless.
+	done <- true
+	s.Stop()
+}
+
+func TestCheckReady(t *testing.T) {
+	s := NewInMemoryStore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.CheckReady(ctx); err != nil {
+		t.Errorf("Running store should be ready; got: %s", err)
+	}
+
+	// A store loop that's busy past the deadline isn't ready.
+	started, release := make(chan bool), make(chan bool)
+	go s.Submit(newDomainOp(func(*domainOp) {
+		started <- true
+		<-release
+	}))
+	<-started
+	goroutines := runtime.NumGoroutine()
+	busy, cancelBusy := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelBusy()
+	if err := s.CheckReady(busy); model.CodeOf(err) != model.CodeUnavailable {
+		t.Errorf("Busy store should be unavailable; got: %v", err)
+	}
+	// Nor does the probe leave anything behind waiting on the store.
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(time.Second); n > goroutines && time.Now().Before(deadline); n = runtime.NumGoroutine() {
+		time.Sleep(time.Millisecond)
+	}
+	if n > goroutines {
+		t.Errorf("Expected at most %d goroutines after the probe; got %d", goroutines, n)
+	}
+	close(release)
+
+	s.Stop()
+	if err := s.CheckReady(ctx); err != ErrStoreStopped {
+		t.Errorf("Stopped store should give ErrStoreStopped; got: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package inmemory
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/model"
+)
+
+type waiterKey struct {
+	Domain    model.DomainKey
+	Aggregate model.AggregateKey
+}
+
+// A reader blocked until an aggregate grows beyond
+// a given version count.
+type aggregateWaiter struct {
+	version int
+	// Buffered, so release never blocks the store loop.
+	ready chan *model.Aggregate
+}
+
+func newAggregateWaiter(version int) *aggregateWaiter {
+	return &aggregateWaiter{
+		version: version,
+		ready:   make(chan *model.Aggregate, 1),
+	}
+}
+
+// Waiters are only touched from within operations, so like
+// the rest of the store they're confined to the store goroutine.
+type waiterSet map[waiterKey][]*aggregateWaiter
+
+func (ws waiterSet) add(key waiterKey, w *aggregateWaiter) {
+	ws[key] = append(ws[key], w)
+}
+
+func (ws waiterSet) remove(key waiterKey, w *aggregateWaiter) {
+	waiters := ws[key]
+	for i, candidate := range waiters {
+		if candidate == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(ws, key)
+	} else {
+		ws[key] = waiters
+	}
+}
+
+// Hands the aggregate to every waiter it has outgrown,
+// and forgets them.
+func (ws waiterSet) release(key waiterKey, container *aggregateContainer) {
+	waiters, ok := ws[key]
+	if !ok {
+		return
+	}
+	version := len(container.Aggregate.Log)
+	remaining := waiters[:0]
+	for _, w := range waiters {
+		if version > w.version {
+			w.ready <- container.snapshot()
+		} else {
+			remaining = append(remaining, w)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(ws, key)
+	} else {
+		ws[key] = remaining
+	}
+}
+
+// Hands every waiter its aggregate as it stands (given by current),
+// as when its wait ends without a new version, and forgets them.
+func (ws waiterSet) releaseAll(current func(waiterKey) *model.Aggregate) {
+	for key, waiters := range ws {
+		for _, w := range waiters {
+			w.ready <- current(key)
+		}
+		delete(ws, key)
+	}
+}
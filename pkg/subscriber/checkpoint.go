@@ -0,0 +1,177 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// What a subscriber has done about an aggregate.
+type Checkpoint struct {
+	// The last version handled; zero if none
+	Version int
+	// Whether the aggregate needs no further handling
+	Done bool
+}
+
+// Records which aggregate versions were handled, and how far the
+// subscriber has read each domain's changes, so a subscriber can
+// pick up where it left off.
+type CheckpointStore interface {
+	// The aggregate's checkpoint; the zero checkpoint if none was saved.
+	Load(model.DomainKey, model.AggregateKey) (Checkpoint, error)
+	Save(model.DomainKey, model.AggregateKey, Checkpoint) error
+	// The change sequence number read up to in each domain.
+	Positions() (map[model.DomainKey]model.ChangeSeq, error)
+	SavePosition(model.DomainKey, model.ChangeSeq) error
+}
+
+type aggregateKey struct {
+	Domain    model.DomainKey
+	Aggregate model.AggregateKey
+}
+
+// Keeps checkpoints for as long as the process runs.
+type MemoryCheckpointStore struct {
+	lock        sync.Mutex
+	checkpoints map[aggregateKey]Checkpoint
+	positions   map[model.DomainKey]model.ChangeSeq
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{
+		checkpoints: make(map[aggregateKey]Checkpoint),
+		positions:   make(map[model.DomainKey]model.ChangeSeq),
+	}
+}
+
+func (m *MemoryCheckpointStore) Load(domain model.DomainKey, aggregate model.AggregateKey) (Checkpoint, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.checkpoints[aggregateKey{domain, aggregate}], nil
+}
+
+func (m *MemoryCheckpointStore) Save(domain model.DomainKey, aggregate model.AggregateKey, c Checkpoint) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.checkpoints[aggregateKey{domain, aggregate}] = c
+	return nil
+}
+
+func (m *MemoryCheckpointStore) Positions() (map[model.DomainKey]model.ChangeSeq, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	positions := make(map[model.DomainKey]model.ChangeSeq, len(m.positions))
+	for domain, seq := range m.positions {
+		positions[domain] = seq
+	}
+	return positions, nil
+}
+
+func (m *MemoryCheckpointStore) SavePosition(domain model.DomainKey, seq model.ChangeSeq) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.positions[domain] = seq
+	return nil
+}
+
+// Keeps checkpoints in a JSON file, which is rewritten (by replacing
+// it, so it's never left half-written) on every save.  Suits
+// subscribers following a modest number of aggregates.
+type FileCheckpointStore struct {
+	path   string
+	memory *MemoryCheckpointStore
+	// Held while writing, so writes land in order
+	writing sync.Mutex
+}
+
+type checkpointFile struct {
+	Positions   map[model.DomainKey]model.ChangeSeq
+	Checkpoints map[model.DomainKey]map[model.AggregateKey]Checkpoint
+}
+
+// Reads the file's checkpoints, if it exists.
+func NewFileCheckpointStore(path string) (*FileCheckpointStore, error) {
+	f := &FileCheckpointStore{path: path, memory: NewMemoryCheckpointStore()}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var contents checkpointFile
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, model.Errorf(model.CodeInvalid, "Invalid checkpoint file %s: %s", path, err)
+	}
+	for domain, seq := range contents.Positions {
+		f.memory.positions[domain] = seq
+	}
+	for domain, checkpoints := range contents.Checkpoints {
+		for aggregate, c := range checkpoints {
+			f.memory.checkpoints[aggregateKey{domain, aggregate}] = c
+		}
+	}
+	return f, nil
+}
+
+func (f *FileCheckpointStore) Load(domain model.DomainKey, aggregate model.AggregateKey) (Checkpoint, error) {
+	return f.memory.Load(domain, aggregate)
+}
+
+func (f *FileCheckpointStore) Save(domain model.DomainKey, aggregate model.AggregateKey, c Checkpoint) error {
+	f.memory.Save(domain, aggregate, c)
+	return f.write()
+}
+
+func (f *FileCheckpointStore) Positions() (map[model.DomainKey]model.ChangeSeq, error) {
+	return f.memory.Positions()
+}
+
+func (f *FileCheckpointStore) SavePosition(domain model.DomainKey, seq model.ChangeSeq) error {
+	f.memory.SavePosition(domain, seq)
+	return f.write()
+}
+
+func (f *FileCheckpointStore) write() error {
+	f.writing.Lock()
+	defer f.writing.Unlock()
+	m := f.memory
+	m.lock.Lock()
+	contents := checkpointFile{
+		Positions:   m.positions,
+		Checkpoints: make(map[model.DomainKey]map[model.AggregateKey]Checkpoint),
+	}
+	for key, c := range m.checkpoints {
+		if contents.Checkpoints[key.Domain] == nil {
+			contents.Checkpoints[key.Domain] = make(map[model.AggregateKey]Checkpoint)
+		}
+		contents.Checkpoints[key.Domain][key.Aggregate] = c
+	}
+	data, err := json.Marshal(contents)
+	m.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
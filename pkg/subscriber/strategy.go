@@ -0,0 +1,91 @@
+package subscriber
+
+import (
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"time"
+)
+
+// A version of an aggregate, as delivered to a handler.
+type Event struct {
+	Domain    model.DomainKey
+	Aggregate model.Aggregate
+	// The aggregate's version: the number of entries in its log.
+	Version int
+}
+
+// What to do about an event.
+type Decision struct {
+	// Whether to handle the event
+	Handle bool
+	// Whether the aggregate needs no handling after this event
+	Done bool
+	// How long to wait for a further version of the aggregate before
+	// handling this one; a further version takes its place.
+	Delay time.Duration
+}
+
+// Decides which events to handle.  The subscriber only consults the
+// strategy about versions newer than the last one handled, of
+// aggregates not yet done; it consults it about each newer version,
+// whether or not it handles the ones before.
+type Strategy interface {
+	Decide(Event, Checkpoint) Decision
+}
+
+type StrategyFunc func(Event, Checkpoint) Decision
+
+func (f StrategyFunc) Decide(e Event, c Checkpoint) Decision {
+	return f(e, c)
+}
+
+// Handles every new version.
+func EveryVersion() Strategy {
+	return StrategyFunc(func(Event, Checkpoint) Decision {
+		return Decision{Handle: true}
+	})
+}
+
+// Handles the first version for which the condition holds, and
+// none after it.
+func FirstTime(condition func(Event) bool) Strategy {
+	return StrategyFunc(func(e Event, _ Checkpoint) Decision {
+		if condition(e) {
+			return Decision{Handle: true, Done: true}
+		}
+		return Decision{}
+	})
+}
+
+// Handles what the strategy decides to once the aggregate has gone
+// the given time without a new version; a new version in the meantime
+// is decided on afresh, and restarts the wait.
+func Debounce(wait time.Duration, s Strategy) Strategy {
+	return StrategyFunc(func(e Event, c Checkpoint) Decision {
+		d := s.Decide(e, c)
+		if d.Handle && d.Delay < wait {
+			d.Delay = wait
+		}
+		return d
+	})
+}
+
+// Conditions for FirstTime.
+
+// The aggregate has a source registered under each of the tokens.
+func HasTokens(tokens ...string) func(Event) bool {
+	return func(e Event) bool {
+		for _, token := range tokens {
+			if len(e.Aggregate.Sources[token]) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// The aggregate has at least the given number of versions.
+func AtLeastVersions(n int) func(Event) bool {
+	return func(e Event) bool {
+		return e.Version >= n
+	}
+}
@@ -0,0 +1,209 @@
+package subscriber
+
+import (
+	"context"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/logging"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"time"
+)
+
+type Handler interface {
+	Handle(context.Context, Event) error
+}
+
+type HandlerFunc func(context.Context, Event) error
+
+func (f HandlerFunc) Handle(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+// Follows the server's aggregates, and hands the versions its strategy
+// decides on to its handler, one at a time.  Each version handled is
+// checkpointed, so it isn't handled again, even by a later subscriber
+// with the same checkpoint store.
+//
+// The subscriber also checkpoints how far it has read each domain's
+// changes, and on starting again catches up from there.  A domain
+// named in Domains that has no saved position is read from its
+// beginning; without Domains, only new changes are followed.  Versions
+// awaiting a strategy's delay hold the positions back, so they're
+// decided on again after a restart.
+type Subscriber struct {
+	Client *client.Client
+	// Only these domains are followed, if given.
+	Domains []model.DomainKey
+	// Only aggregates meeting this expression of package filter are
+	// offered to the strategy, if given.
+	Filter   string
+	Strategy Strategy
+	Handler  Handler
+	// Optional; checkpoints are kept in memory if not given.
+	Checkpoints CheckpointStore
+	// Optional
+	Logger *logging.Logger
+}
+
+// A version awaiting its strategy's delay.
+type pendingEvent struct {
+	event    Event
+	decision Decision
+	due      time.Time
+}
+
+// Position in the change feeds, as of a message.
+type delivery struct {
+	message   model.AggregateMessage
+	positions map[model.DomainKey]model.ChangeSeq
+}
+
+// Follows the aggregates until the context ends, giving its error, or
+// until the handler, the checkpoint store, or the subscription fails.
+// A version whose handling fails isn't checkpointed.
+func (s *Subscriber) Run(ctx context.Context) error {
+	if s.Checkpoints == nil {
+		s.Checkpoints = NewMemoryCheckpointStore()
+	}
+	resume, err := s.Checkpoints.Positions()
+	if err != nil {
+		return err
+	}
+	for _, domain := range s.Domains {
+		if _, ok := resume[domain]; !ok {
+			resume[domain] = 0
+		}
+	}
+	saved := make(map[model.DomainKey]model.ChangeSeq, len(resume))
+	for domain, seq := range resume {
+		saved[domain] = seq
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub := s.Client.Subscribe(ctx, client.SubscribeOptions{Domains: s.Domains, Resume: resume, Filter: s.Filter})
+	deliveries := make(chan delivery)
+	go func() {
+		defer close(deliveries)
+		for sub.Next() {
+			select {
+			case deliveries <- delivery{sub.Message(), sub.Positions()}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer sub.Close()
+
+	pending := make(map[aggregateKey]*pendingEvent)
+	var positions map[model.DomainKey]model.ChangeSeq
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				if err := sub.Err(); err != nil {
+					return err
+				}
+				return ctx.Err()
+			}
+			positions = d.positions
+			if err := s.offer(ctx, d.message, pending); err != nil {
+				return err
+			}
+		case <-timer.C:
+			if err := s.handleDue(ctx, pending); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if len(pending) == 0 {
+			for domain, seq := range positions {
+				if saved[domain] == seq {
+					continue
+				}
+				if err := s.Checkpoints.SavePosition(domain, seq); err != nil {
+					return err
+				}
+				saved[domain] = seq
+			}
+		}
+		resetTimer(timer, pending)
+	}
+}
+
+// Decides on the message's version, and handles it if it's not to
+// be delayed.
+func (s *Subscriber) offer(ctx context.Context, message model.AggregateMessage, pending map[aggregateKey]*pendingEvent) error {
+	e := Event{Domain: message.DomainKey, Aggregate: message.Aggregate, Version: len(message.Aggregate.Log)}
+	key := aggregateKey{e.Domain, e.Aggregate.Key}
+	checkpoint, err := s.Checkpoints.Load(key.Domain, key.Aggregate)
+	if err != nil {
+		return err
+	}
+	if checkpoint.Done || e.Version <= checkpoint.Version {
+		return nil
+	}
+	if p, ok := pending[key]; ok && p.event.Version >= e.Version {
+		return nil
+	}
+
+	// A newer version supersedes any awaiting its delay.
+	delete(pending, key)
+	decision := s.Strategy.Decide(e, checkpoint)
+	switch {
+	case !decision.Handle:
+		s.Logger.Debug("version skipped", "domain", e.Domain, "aggregate", e.Aggregate.Key, "version", e.Version)
+		return nil
+	case decision.Delay > 0:
+		pending[key] = &pendingEvent{e, decision, time.Now().Add(decision.Delay)}
+		return nil
+	}
+	return s.handle(ctx, e, decision)
+}
+
+// Handles the versions whose delays are up.
+func (s *Subscriber) handleDue(ctx context.Context, pending map[aggregateKey]*pendingEvent) error {
+	now := time.Now()
+	for key, p := range pending {
+		if p.due.After(now) {
+			continue
+		}
+		delete(pending, key)
+		if err := s.handle(ctx, p.event, p.decision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Subscriber) handle(ctx context.Context, e Event, decision Decision) error {
+	s.Logger.Debug("handling version", "domain", e.Domain, "aggregate", e.Aggregate.Key, "version", e.Version)
+	if err := s.Handler.Handle(ctx, e); err != nil {
+		s.Logger.Error("handler failed", "domain", e.Domain, "aggregate", e.Aggregate.Key, "version", e.Version, "error", err)
+		return err
+	}
+	return s.Checkpoints.Save(e.Domain, e.Aggregate.Key, Checkpoint{Version: e.Version, Done: decision.Done})
+}
+
+// Sets the timer for the earliest pending version, if any.
+func resetTimer(timer *time.Timer, pending map[aggregateKey]*pendingEvent) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	var earliest time.Time
+	for _, p := range pending {
+		if earliest.IsZero() || p.due.Before(earliest) {
+			earliest = p.due
+		}
+	}
+	if !earliest.IsZero() {
+		timer.Reset(time.Until(earliest))
+	}
+}
@@ -0,0 +1,207 @@
+package subscriber
+
+import (
+	"context"
+	"github.com/ethanrowe/botlnek/pkg/client"
+	"github.com/ethanrowe/botlnek/pkg/model"
+	"github.com/ethanrowe/botlnek/pkg/rest"
+	"github.com/ethanrowe/botlnek/pkg/store/inmemory"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testClient() (*client.Client, func()) {
+	store := inmemory.NewInMemoryStore()
+	app := &rest.RestApplication{
+		DomainWriter:     store,
+		DomainReader:     store,
+		AggregateWriter:  store,
+		AggregateReader:  store,
+		ChangeFeedReader: store,
+		EventSource:      store,
+	}
+	server := httptest.NewServer(app.Handler())
+	c := client.New(server.URL)
+	c.Backoff = time.Millisecond
+	return c, func() {
+		app.Shutdown()
+		server.Close()
+		store.Stop()
+	}
+}
+
+func appendSource(t *testing.T, c *client.Client, aggregate model.AggregateKey, token, key string) {
+	source := model.Source{Keys: map[string]string{"k": key}}
+	if _, err := c.AppendSource(context.Background(), "d", aggregate, token, source); err != nil {
+		t.Fatalf("Failed to append: %s", err)
+	}
+}
+
+// Runs a subscriber to domain "d" in the background, giving the events
+// it handles and a function that stops it and gives Run's error.
+func runSubscriber(c *client.Client, strategy Strategy, checkpoints CheckpointStore) (chan Event, func() error) {
+	events := make(chan Event, 10)
+	s := &Subscriber{
+		Client:   c,
+		Domains:  []model.DomainKey{"d"},
+		Strategy: strategy,
+		Handler: HandlerFunc(func(ctx context.Context, e Event) error {
+			events <- e
+			return nil
+		}),
+		Checkpoints: checkpoints,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	return events, func() error {
+		cancel()
+		return <-done
+	}
+}
+
+func expectEvent(t *testing.T, events chan Event, aggregate model.AggregateKey, version int) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if e.Domain != "d" || e.Aggregate.Key != aggregate || e.Version != version || len(e.Aggregate.Log) != version {
+			t.Fatalf("Expected %s version %d; got %s version %d", aggregate, version, e.Aggregate.Key, e.Version)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s version %d", aggregate, version)
+	}
+}
+
+func expectNoEvent(t *testing.T, events chan Event, wait time.Duration) {
+	t.Helper()
+	select {
+	case e := <-events:
+		t.Fatalf("Unexpected event for %s version %d", e.Aggregate.Key, e.Version)
+	case <-time.After(wait):
+	}
+}
+
+func TestStrategies(t *testing.T) {
+	e := Event{Domain: "d", Aggregate: model.Aggregate{Sources: model.SourceLogMap{"a": {{}}}}, Version: 1}
+	if d := EveryVersion().Decide(e, Checkpoint{}); !d.Handle || d.Done || d.Delay != 0 {
+		t.Errorf("EveryVersion: unexpected decision %+v", d)
+	}
+	if d := FirstTime(HasTokens("a", "b")).Decide(e, Checkpoint{}); d.Handle {
+		t.Errorf("FirstTime: unexpected decision %+v without token b", d)
+	}
+	if d := FirstTime(HasTokens("a")).Decide(e, Checkpoint{}); !d.Handle || !d.Done {
+		t.Errorf("FirstTime: unexpected decision %+v", d)
+	}
+	if d := Debounce(time.Second, FirstTime(AtLeastVersions(1))).Decide(e, Checkpoint{}); !d.Handle || !d.Done || d.Delay != time.Second {
+		t.Errorf("Debounce: unexpected decision %+v", d)
+	}
+	if d := Debounce(time.Second, FirstTime(AtLeastVersions(2))).Decide(e, Checkpoint{}); d.Handle || d.Delay != 0 {
+		t.Errorf("Debounce: unexpected decision %+v for a skipped version", d)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints.json")
+
+	store, err := NewFileCheckpointStore(path)
+	if err != nil {
+		t.Fatalf("Failed to open a new store: %s", err)
+	}
+	store.Save("d", "a", Checkpoint{Version: 3, Done: true})
+	store.SavePosition("d", 7)
+
+	store, err = NewFileCheckpointStore(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen the store: %s", err)
+	}
+	if c, err := store.Load("d", "a"); err != nil || c != (Checkpoint{Version: 3, Done: true}) {
+		t.Errorf("Unexpected checkpoint %+v, %s", c, err)
+	}
+	if c, _ := store.Load("d", "b"); c != (Checkpoint{}) {
+		t.Errorf("Expected the zero checkpoint; got %+v", c)
+	}
+	if positions, _ := store.Positions(); positions["d"] != 7 {
+		t.Errorf("Unexpected positions %v", positions)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the checkpoint file; got %d files", len(files))
+	}
+
+	ioutil.WriteFile(path, []byte("nonsense"), 0644)
+	if _, err := NewFileCheckpointStore(path); model.CodeOf(err) != model.CodeInvalid {
+		t.Errorf("Expected an invalid error for a corrupt file; got %v", err)
+	}
+}
+
+func TestFirstTime(t *testing.T) {
+	c, stop := testClient()
+	defer stop()
+	c.CreateDomain(context.Background(), model.Domain{Key: "d"})
+	// Existing aggregates are considered too.
+	appendSource(t, c, "p", "a", "1")
+
+	events, halt := runSubscriber(c, FirstTime(HasTokens("a", "b")), nil)
+	appendSource(t, c, "q", "b", "1")
+	appendSource(t, c, "p", "b", "1")
+	expectEvent(t, events, "p", 2)
+	appendSource(t, c, "p", "b", "2")
+	appendSource(t, c, "q", "a", "1")
+	expectEvent(t, events, "q", 2)
+	expectNoEvent(t, events, 50*time.Millisecond)
+	if err := halt(); err != context.Canceled {
+		t.Errorf("Expected Run to give the context's error; got %v", err)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	c, stop := testClient()
+	defer stop()
+	c.CreateDomain(context.Background(), model.Domain{Key: "d"})
+
+	events, halt := runSubscriber(c, Debounce(100*time.Millisecond, EveryVersion()), nil)
+	defer halt()
+	for i, key := range []string{"1", "2", "3"} {
+		appendSource(t, c, "p", "a", key)
+		if i < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	expectEvent(t, events, "p", 3)
+	expectNoEvent(t, events, 150*time.Millisecond)
+}
+
+func TestResume(t *testing.T) {
+	c, stop := testClient()
+	defer stop()
+	c.CreateDomain(context.Background(), model.Domain{Key: "d"})
+	checkpoints := NewMemoryCheckpointStore()
+
+	appendSource(t, c, "p", "a", "1")
+	events, halt := runSubscriber(c, EveryVersion(), checkpoints)
+	expectEvent(t, events, "p", 1)
+	halt()
+
+	// Versions appended while no subscriber runs are caught up on,
+	// and handled versions aren't handled again.
+	appendSource(t, c, "q", "a", "1")
+	appendSource(t, c, "p", "a", "2")
+	events, halt = runSubscriber(c, EveryVersion(), checkpoints)
+	defer halt()
+	expectEvent(t, events, "q", 1)
+	expectEvent(t, events, "p", 2)
+	expectNoEvent(t, events, 50*time.Millisecond)
+	if positions, _ := checkpoints.Positions(); positions["d"] != 3 {
+		t.Errorf("Expected position 3 to be saved; got %v", positions)
+	}
+}
@@ -17,13 +17,17 @@ type StringKVPairs []StringKVPair
 func (p StringKVPairs) Len() int           { return len(p) }
 func (p StringKVPairs) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 func (p StringKVPairs) Less(i, j int) bool { return p[i].Key < p[j].Key }
-func (p StringKVPairs) WriteTo(w io.Writer) {
+func (p StringKVPairs) WriteTo(w io.Writer) (n int64, err error) {
 	for _, pair := range p {
-		w.Write([]byte(pair.Key))
-		w.Write(nullChar)
-		w.Write([]byte(pair.Value))
-		w.Write(nullChar)
+		for _, b := range [][]byte{[]byte(pair.Key), nullChar, []byte(pair.Value), nullChar} {
+			c, err := w.Write(b)
+			n += int64(c)
+			if err != nil {
+				return n, err
+			}
+		}
 	}
+	return
 }
 func (p StringKVPairs) ToMap() map[string]string {
 	m := make(map[string]string)